@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	jobsPath      = "/jobs"
+	snapshotsPath = "/snapshots"
+	restoreSuffix = "/restore"
+	cancelSuffix  = "/cancel"
+)
+
+// apiError is the body of an error response.
+type apiError struct {
+	Message string `json:"message"`
+}
+
+// registerHandlers adds the REST endpoints of the service to mux.
+func registerHandlers(mux *http.ServeMux) {
+	mux.HandleFunc(jobsPath, handleJobs)
+	mux.HandleFunc(jobsPath+"/", handleJob)
+	mux.HandleFunc(snapshotsPath, handleSnapshots)
+	mux.HandleFunc(snapshotsPath+"/", handleSnapshot)
+	mux.HandleFunc(historyPath, handleHistory)
+	mux.HandleFunc(healthPath, handleHealth)
+	mux.HandleFunc(readyPath, handleReady)
+}
+
+// handleJobs serves GET /jobs, optionally filtered by ?shkeptncontext=.
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Message: "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs.list(r.URL.Query().Get("shkeptncontext")))
+}
+
+// handleJob serves GET /jobs/{id} and POST /jobs/{id}/cancel.
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, jobsPath+"/")
+	if strings.HasSuffix(id, cancelSuffix) {
+		handleCancel(w, r, strings.TrimSuffix(id, cancelSuffix))
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Message: "method not allowed"})
+		return
+	}
+	job, ok := jobs.get(id)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, apiError{Message: "job " + id + " not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// handleCancel serves POST /jobs/{id}/cancel, which cancels a queued or
+// running job. The response is the job, which is finished as cancelled once
+// the synchronization stopped.
+func handleCancel(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Message: "method not allowed"})
+		return
+	}
+	job, ok := jobs.get(id)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, apiError{Message: "job " + id + " not found"})
+		return
+	}
+	if job.isFinished() || !syncScheduler.cancel(id) {
+		writeJSON(w, http.StatusConflict, apiError{Message: "job " + id + " is not running"})
+		return
+	}
+	job, _ = jobs.get(id)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// handleHistory serves GET /history, which returns the records of finished
+// jobs, optionally filtered by ?project=, ?stage=, ?service=, ?status=,
+// ?target= (the target database) and the time range ?from= and ?to= (RFC
+// 3339). ?limit= limits the number of records, the most recent first.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Message: "method not allowed"})
+		return
+	}
+	if jobHistory == nil {
+		writeJSON(w, http.StatusServiceUnavailable, apiError{Message: "job history is not configured"})
+		return
+	}
+	query, err := parseHistoryQuery(r.URL.Query())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Message: err.Error()})
+		return
+	}
+	records, err := jobHistory.Query(r.Context(), query)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Message: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// parseHistoryQuery reads the filters of a history request.
+func parseHistoryQuery(values url.Values) (HistoryQuery, error) {
+	query := HistoryQuery{
+		Project: values.Get("project"),
+		Stage:   values.Get("stage"),
+		Service: values.Get("service"),
+		State:   JobState(values.Get("status")),
+		Target:  values.Get("target"),
+		Limit:   defaultHistoryLimit,
+	}
+	var err error
+	if from := values.Get("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return query, fmt.Errorf("invalid from: %s", err.Error())
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return query, fmt.Errorf("invalid to: %s", err.Error())
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 1 || query.Limit > maxHistoryLimit {
+			return query, fmt.Errorf("invalid limit %s, expected 1 to %d", limit, maxHistoryLimit)
+		}
+	}
+	return query, nil
+}
+
+// handleSnapshots serves GET /snapshots, optionally filtered by ?database=
+// and ?service=.
+func handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Message: "method not allowed"})
+		return
+	}
+	snapshots, err := listSnapshots(getDumpDirs())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Message: err.Error()})
+		return
+	}
+	database, service := r.URL.Query().Get("database"), r.URL.Query().Get("service")
+	result := []*SnapshotManifest{}
+	for _, snapshot := range snapshots {
+		if (database == "" || snapshot.Source.Database == database) &&
+			(service == "" || strings.EqualFold(snapshot.Service, service)) {
+			result = append(result, snapshot)
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleSnapshot serves GET /snapshots/{id} and POST /snapshots/{id}/restore.
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, snapshotsPath+"/")
+	if strings.HasSuffix(id, restoreSuffix) {
+		handleRestore(w, r, strings.TrimSuffix(id, restoreSuffix))
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Message: "method not allowed"})
+		return
+	}
+	snapshot, err := findSnapshot(getDumpDirs(), id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Message: err.Error()})
+		return
+	}
+	if snapshot == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Message: "snapshot " + id + " not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+// handleRestore serves POST /snapshots/{id}/restore, which restores the
+// snapshot into the target database of a service. The optional body selects
+// the project, stage and service, which default to the ones of the
+// snapshot. The response is the accepted restore job.
+func handleRestore(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Message: "method not allowed"})
+		return
+	}
+	snapshot, err := findSnapshot(getDumpDirs(), id)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Message: err.Error()})
+		return
+	}
+	if snapshot == nil {
+		writeJSON(w, http.StatusNotFound, apiError{Message: "snapshot " + id + " not found"})
+		return
+	}
+
+	if syncScheduler.isClosed() {
+		writeJSON(w, http.StatusServiceUnavailable, apiError{Message: "service is shutting down"})
+		return
+	}
+
+	data := &RestoreEventData{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(data); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{Message: "invalid request body: " + err.Error()})
+			return
+		}
+	}
+	data.Snapshot = id
+	if data.Project == "" && data.Service == "" {
+		data.Project, data.Stage, data.Service = snapshot.Project, snapshot.Stage, snapshot.Service
+	}
+	if data.Project == "" {
+		writeJSON(w, http.StatusBadRequest, apiError{Message: "project is required"})
+		return
+	}
+
+	// the job is returned at once, the stage is looked up and the restore
+	// is queued in the background
+	shkeptncontext := uuid.New().String()
+	job := jobs.create(shkeptncontext, "")
+	jobs.setService(job.ID, data.Project, data.Stage, data.Service)
+	jobs.setMode(job.ID, SyncRestore, 0)
+	jobs.setSnapshot(job.ID, id)
+	accepted, _ := jobs.get(job.ID)
+
+	stdLogger := newLogger(shkeptncontext, "").withJob(job.ID)
+	go startRestore(stdLogger, shkeptncontext, job.ID, data)
+	writeJSON(w, http.StatusAccepted, accepted)
+}
+
+// writeJSON writes v as JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		defaultLogger.Error(fmt.Sprintf("failed to write response: %s", err.Error()))
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-tools-common/archive"
+	"github.com/mongodb/mongo-tools-common/util"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// archiveSync dumps the source database as archives into the storage and
+// restores the archives into the target database. The archives are
+// streamed to and from the storage and removed when the job has finished.
+// With parallel collections, the archive of a collection is restored as
+// soon as it is dumped, while the other collections are still dumped; the
+// job is restoring during the whole overlap.
+func archiveSync(ctx context.Context, jobID string, dbInfo *DatabaseInfo) error {
+	stdLogger := loggerFrom(ctx)
+	defer func() {
+		if err := removeArchives(context.Background(), dbInfo); err != nil {
+			stdLogger.Error(fmt.Sprintf("Failed to remove archives: %s", err.Error()))
+		}
+	}()
+
+	collections := getArchiveCollections(dbInfo)
+	parallel := dbInfo.getParallelCollections()
+	if parallel > 1 {
+		// dump and restore overlap, so they are limited together and the
+		// job is restoring, as with streaming. The state is not changed per
+		// collection, so the phases are not split by the collections.
+		jobs.setState(jobID, JobRestoring)
+		timeout := time.Duration(0)
+		if dbInfo.timeouts.Dump > 0 && dbInfo.timeouts.Restore > 0 {
+			timeout = dbInfo.timeouts.Dump + dbInfo.timeouts.Restore
+		}
+		stdLogger.Debug(fmt.Sprintf("start mongo dump and restore through %s", dbInfo.archivePrefix))
+		err := runPhase(ctx, "dump and restore", timeout, func(ctx context.Context) error {
+			return forEachCollection(ctx, collections, parallel, func(ctx context.Context, col string) error {
+				err := withRetry(ctx, dbInfo, "dump", col, func(ctx context.Context) error {
+					return dumpArchive(ctx, dbInfo, col)
+				})
+				if err != nil {
+					return fmt.Errorf("Failed to execute mongo dump on database  %s: %s", dbInfo.sourceDB, err.Error())
+				}
+				err = withRetry(ctx, dbInfo, "restore", col, func(ctx context.Context) error {
+					return restoreArchive(ctx, dbInfo, col)
+				})
+				if err != nil {
+					return fmt.Errorf("Failed to execute mongo restore on database  %s: %s", dbInfo.targetDB, err.Error())
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		stdLogger.Debug(fmt.Sprintf("mongo dump and restore done"))
+		return verifyTarget(ctx, jobID, dbInfo)
+	}
+
+	jobs.setState(jobID, JobDumping)
+	stdLogger.Debug(fmt.Sprintf("start mongo dump into %s", dbInfo.archivePrefix))
+	err := runPhase(ctx, "dump", dbInfo.timeouts.Dump, func(ctx context.Context) error {
+		for _, col := range collections {
+			err := withRetry(ctx, dbInfo, "dump", col, func(ctx context.Context) error {
+				return dumpArchive(ctx, dbInfo, col)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if isInterrupted(err) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to execute mongo dump on database  %s: %s", dbInfo.sourceDB, err.Error())
+	}
+	stdLogger.Debug(fmt.Sprintf("mongo dump done"))
+
+	jobs.setState(jobID, JobRestoring)
+	stdLogger.Debug(fmt.Sprintf("start mongo restore from %s", dbInfo.archivePrefix))
+	err = runPhase(ctx, "restore", dbInfo.timeouts.Restore, func(ctx context.Context) error {
+		for _, col := range collections {
+			err := withRetry(ctx, dbInfo, "restore", col, func(ctx context.Context) error {
+				return restoreArchive(ctx, dbInfo, col)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if isInterrupted(err) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to execute mongo restore on database  %s: %s", dbInfo.targetDB, err.Error())
+	}
+	stdLogger.Debug(fmt.Sprintf("mongo restore done"))
+	return verifyTarget(ctx, jobID, dbInfo)
+}
+
+// getArchiveCollections returns the collections which are dumped into an
+// archive each. An empty name stands for an archive of all collections.
+func getArchiveCollections(dbInfo *DatabaseInfo) []string {
+	if len(dbInfo.collections) == 0 {
+		return []string{""}
+	}
+	return dbInfo.collections
+}
+
+// getArchiveKey returns the key of the archive of a collection, or of all
+// collections if col is empty.
+func getArchiveKey(dbInfo *DatabaseInfo, col string) string {
+	name := dbInfo.sourceDB
+	if col != "" {
+		name += "." + util.EscapeCollectionName(col)
+	}
+	name += ".archive"
+	if dbInfo.gzip {
+		name += ".gz"
+	}
+	if dbInfo.encryption != nil {
+		name += encryptedSuffix
+	}
+	return path.Join(dbInfo.archivePrefix, name)
+}
+
+// getArchiveStorage returns the storage of the archives, which is the dump
+// directory if no storage is configured.
+func (dbInfo *DatabaseInfo) getArchiveStorage() Storage {
+	if dbInfo.storage != nil {
+		return dbInfo.storage
+	}
+	return &fsStorage{dir: dbInfo.dumpDir}
+}
+
+// dumpArchive dumps a collection into its archive in the storage. The
+// archive is encrypted while it is written, if encryption is configured,
+// and discarded if the dump fails.
+func dumpArchive(ctx context.Context, dbInfo *DatabaseInfo, col string) error {
+	w, err := dbInfo.getArchiveStorage().Create(ctx, getArchiveKey(dbInfo, col))
+	if err != nil {
+		return err
+	}
+	out := io.Writer(w)
+	var ew *encryptWriter
+	if dbInfo.encryption != nil {
+		if ew, err = newEncryptWriter(w, dbInfo.encryption); err != nil {
+			w.Abort()
+			return err
+		}
+		out = ew
+	}
+	mongoDump, err := getArchiveDump(dbInfo, col, out)
+	if err == nil {
+		err = mongoDump.Init()
+	}
+	if err == nil {
+		err = runDump(ctx, mongoDump)
+	}
+	if err == nil && ew != nil {
+		err = ew.Close()
+	}
+	if err != nil {
+		loggerFrom(ctx).Error(fmt.Sprintf("mongo dump failed: %s", err))
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// restoreArchive restores the archive of a collection from the storage.
+func restoreArchive(ctx context.Context, dbInfo *DatabaseInfo, col string) error {
+	r, err := dbInfo.getArchiveStorage().Open(ctx, getArchiveKey(dbInfo, col))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	in, err := decryptArchive(dbInfo, r)
+	if err != nil {
+		return err
+	}
+	restore, err := getArchiveRestore(dbInfo, in)
+	if err != nil {
+		loggerFrom(ctx).Error(fmt.Sprintf("mongo restore initialization failed: %s", err))
+		return err
+	}
+	return runRestore(ctx, restore)
+}
+
+// decryptArchive returns the decrypted content of an archive, if encryption
+// is configured.
+func decryptArchive(dbInfo *DatabaseInfo, r io.Reader) (io.Reader, error) {
+	if dbInfo.encryption == nil {
+		return r, nil
+	}
+	return newDecryptReader(r, dbInfo.encryption)
+}
+
+// getArchiveState returns the state of the collections in the archives of
+// the dump. A missing archive is skipped, so its collections are reported
+// as missing.
+func getArchiveState(dbInfo *DatabaseInfo) (map[string]*collectionState, error) {
+	state := map[string]*collectionState{}
+	for _, col := range getArchiveCollections(dbInfo) {
+		key := getArchiveKey(dbInfo, col)
+		if err := readArchiveState(dbInfo, key, state); err != nil {
+			return nil, fmt.Errorf("invalid archive %s: %s", key, err.Error())
+		}
+	}
+	return state, nil
+}
+
+// readArchiveState adds the collections of the source database in an
+// archive to state. The metadata is read from the prelude of the archive and
+// the documents are counted per collection.
+func readArchiveState(dbInfo *DatabaseInfo, key string, state map[string]*collectionState) error {
+	r, err := dbInfo.getArchiveStorage().Open(context.Background(), key)
+	if err == errObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	in, err := decryptArchive(dbInfo, r)
+	if err != nil {
+		return err
+	}
+	if dbInfo.gzip {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		in = gz
+	}
+	prelude := &archive.Prelude{}
+	if err := prelude.Read(in); err != nil {
+		return err
+	}
+	counter := &archiveCounter{counts: map[string]int64{}}
+	if err := (&archive.Parser{In: in}).ReadAllBlocks(counter); err != nil {
+		return err
+	}
+
+	for _, cm := range prelude.NamespaceMetadatas {
+		if cm.Database != dbInfo.sourceDB || strings.HasPrefix(cm.Collection, "system.") {
+			continue
+		}
+		meta, err := readDumpMetadata(strings.NewReader(cm.Metadata))
+		if err != nil {
+			return err
+		}
+		if _, isView := meta.Options["viewOn"]; isView {
+			continue
+		}
+		indexes, err := getIndexDefinitions(meta.Indexes)
+		if err != nil {
+			return err
+		}
+		state[cm.Collection] = &collectionState{Count: counter.counts[cm.Database+"."+cm.Collection], Indexes: indexes}
+	}
+	return nil
+}
+
+// archiveCounter counts the documents per namespace of an archive.
+type archiveCounter struct {
+	counts  map[string]int64
+	current string
+}
+
+// HeaderBSON starts the documents of a namespace.
+func (c *archiveCounter) HeaderBSON(data []byte) error {
+	header := archive.NamespaceHeader{}
+	if err := bson.Unmarshal(data, &header); err != nil {
+		return err
+	}
+	c.current = header.Database + "." + header.Collection
+	return nil
+}
+
+// BodyBSON counts a document of the current namespace.
+func (c *archiveCounter) BodyBSON(data []byte) error {
+	c.counts[c.current]++
+	return nil
+}
+
+// End is called at the end of the archive.
+func (c *archiveCounter) End() error {
+	return nil
+}
+
+// removeArchives deletes the archives of the job from the storage.
+func removeArchives(ctx context.Context, dbInfo *DatabaseInfo) error {
+	keys, err := dbInfo.storage.List(ctx, dbInfo.archivePrefix+"/")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := dbInfo.storage.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
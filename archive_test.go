@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mongodb/mongo-tools-common/archive"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// writeArchiveFile writes a gzipped archive of the given number of
+// documents per collection of a database.
+func writeArchiveFile(t *testing.T, path string, db string, docs map[string]int, meta dumpMetadata) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, archive.MagicNumber)
+	block := func(header interface{}, bodies ...interface{}) {
+		for _, doc := range append([]interface{}{header}, bodies...) {
+			content, err := bson.Marshal(doc)
+			if err != nil {
+				t.Fatalf("Error message: %s", err)
+			}
+			buf.Write(content)
+		}
+		buf.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF})
+	}
+
+	metadata, err := bson.MarshalExtJSON(meta, true, false)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	prelude := []interface{}{}
+	for col := range docs {
+		prelude = append(prelude, archive.CollectionMetadata{Database: db, Collection: col, Metadata: string(metadata)})
+	}
+	block(archive.Header{FormatVersion: "0.1"}, prelude...)
+	for col, n := range docs {
+		bodies := []interface{}{}
+		for i := 0; i < n; i++ {
+			bodies = append(bodies, bson.D{{Key: "_id", Value: i}})
+		}
+		block(archive.NamespaceHeader{Database: db, Collection: col}, bodies...)
+		block(archive.NamespaceHeader{Database: db, Collection: col, EOF: true})
+	}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(buf.Bytes())
+	w.Close()
+	if err := ioutil.WriteFile(path, gz.Bytes(), 0644); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+}
+
+// TestGetArchiveState reads the collections of a gzipped archive per
+// collection, of which one is missing.
+func TestGetArchiveState(t *testing.T) {
+	fmt.Println("\n>> TestGetArchiveState()")
+
+	dumpDir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(dumpDir)
+	dbInfo := &DatabaseInfo{
+		sourceDB:    "carts-db",
+		dumpDir:     dumpDir,
+		collections: []string{"items", "categories"},
+		gzip:        true,
+		archive:     true,
+	}
+	meta := dumpMetadata{Indexes: []bson.D{
+		{{Key: "v", Value: 2}, {Key: "key", Value: bson.D{{Key: "_id", Value: 1}}}, {Key: "name", Value: "_id_"}},
+	}}
+	writeArchiveFile(t, filepath.Join(dumpDir, "carts-db.items.archive.gz"), "carts-db", map[string]int{"items": 3}, meta)
+
+	dump, err := getDumpState(dbInfo)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if len(dump) != 1 || dump["items"] == nil || dump["items"].Count != 3 || len(dump["items"].Indexes) != 1 {
+		t.Errorf("unexpected dump state: %v", dump)
+	}
+
+	dbInfo.collections = nil
+	writeArchiveFile(t, filepath.Join(dumpDir, "carts-db.archive.gz"), "carts-db", map[string]int{"items": 2, "categories": 4}, meta)
+	if dump, err = getDumpState(dbInfo); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if len(dump) != 2 || dump["items"].Count != 2 || dump["categories"].Count != 4 {
+		t.Errorf("unexpected dump state: %v", dump)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mongodb/mongo-tools-common/db"
+)
+
+// errCancelRequested is the error of a synchronization cancelled through
+// the API.
+var errCancelRequested = errors.New("synchronization cancelled on request")
+
+// Timeouts limits the duration of a synchronization and of its phases. A
+// zero value does not limit the duration.
+type Timeouts struct {
+	// Total limits the whole synchronization, including the time it waits
+	// for the verification
+	Total time.Duration `yaml:"total"`
+	// Dump limits dumping the source database
+	Dump time.Duration `yaml:"dump"`
+	// Restore limits restoring, streaming or replaying into the target
+	// database
+	Restore time.Duration `yaml:"restore"`
+	// Verify limits each verification
+	Verify time.Duration `yaml:"verify"`
+}
+
+// validate checks that the timeouts are not negative.
+func (t *Timeouts) validate() error {
+	if t.Total < 0 || t.Dump < 0 || t.Restore < 0 || t.Verify < 0 {
+		return errors.New("invalid timeouts, total, dump, restore and verify must not be negative")
+	}
+	return nil
+}
+
+// timeoutError is the error of a phase which exceeded its timeout.
+type timeoutError struct {
+	phase   string
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s exceeded the timeout of %s", e.phase, e.timeout)
+}
+
+// isInterrupted returns true if err stopped a synchronization before it
+// finished, because it was cancelled, exceeded a timeout or the service
+// was shut down.
+func isInterrupted(err error) bool {
+	_, isTimeout := err.(*timeoutError)
+	return err == errCancelled || err == errCancelRequested || err == errShutdown || isTimeout
+}
+
+// causeKey is the context key of the cancelCause of a task.
+type causeKey struct{}
+
+// cancelCause records why the context of a task is cancelled.
+type cancelCause struct {
+	mu  sync.Mutex
+	err error
+}
+
+// set records err unless a cause is already recorded.
+func (c *cancelCause) set(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// get returns the recorded cause.
+func (c *cancelCause) get() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// cancelled returns why ctx is cancelled: errCancelRequested if the job was
+// cancelled through the API, errShutdown if the service is shut down,
+// otherwise errCancelled.
+func cancelled(ctx context.Context) error {
+	if cause, ok := ctx.Value(causeKey{}).(*cancelCause); ok {
+		if err := cause.get(); err != nil {
+			return err
+		}
+	}
+	return errCancelled
+}
+
+// runPhase runs a phase of a synchronization, limited by timeout if it is
+// set. The phase is added to the logger of ctx. If the phase is interrupted,
+// the cancellation or the timeout is returned instead of the error of the
+// phase.
+func runPhase(ctx context.Context, phase string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	phaseCtx := withLogger(ctx, loggerFrom(ctx).withPhase(phase))
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		phaseCtx, cancel = context.WithTimeout(phaseCtx, timeout)
+		defer cancel()
+	}
+	err := fn(phaseCtx)
+	switch {
+	case ctx.Err() != nil:
+		return cancelled(ctx)
+	case phaseCtx.Err() != nil:
+		return &timeoutError{phase: phase, timeout: timeout}
+	}
+	return err
+}
+
+// runTool runs an operation of mongodump or mongorestore using the session
+// provider. If ctx is done before the operation finished, the client of the
+// session provider is disconnected, which aborts the running operation with
+// an error. The session provider is closed afterwards. While the operation
+// runs, the log lines of mongo-tools are logged with the logger of ctx.
+func runTool(ctx context.Context, sp *db.SessionProvider, fn func() error) error {
+	defer sp.Close()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	defer registerToolLogger(loggerFrom(ctx))()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// the client stays set in the session provider, so the tool
+			// fails instead of using a nil client
+			if client, err := sp.GetSession(); err == nil {
+				client.Disconnect(context.Background())
+			}
+		case <-done:
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"hash"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CheckChecksum reports a collection whose documents differ
+const CheckChecksum = "checksum"
+
+// verifyChecksums proves that the synchronized collections of the target
+// database are equal to the source database. The md5 hashes of dbHash are
+// compared first. Collections with different hashes, or all collections if
+// dbHash is not supported, are compared document by document ordered by _id,
+// which finds the first differing document. Filtered collections are always
+// compared document by document.
+func verifyChecksums(ctx context.Context, dbInfo *DatabaseInfo) (*VerificationReport, error) {
+	source, err := getDatabase(ctx, dbInfo, "source")
+	if err != nil {
+		return nil, err
+	}
+	defer source.Client().Disconnect(context.Background())
+	target, err := getDatabase(ctx, dbInfo, "target")
+	if err != nil {
+		return nil, err
+	}
+	defer target.Client().Disconnect(context.Background())
+
+	names := dbInfo.collections
+	if len(names) == 0 {
+		if names, err = listCollections(ctx, source); err != nil {
+			return nil, err
+		}
+	}
+
+	sourceHashes := getCollectionHashes(ctx, source, names)
+	targetHashes := getCollectionHashes(ctx, target, names)
+
+	report := &VerificationReport{Phase: CheckChecksum, Expected: "source", Found: "target", Mismatches: []Mismatch{}}
+	for _, name := range names {
+		_, filtered := dbInfo.filters[name]
+		if !filtered && sourceHashes[name] != "" && sourceHashes[name] == targetHashes[name] {
+			continue
+		}
+		query, err := dbInfo.filters[name].getQuery()
+		if err != nil {
+			return nil, err
+		}
+		mismatch, err := compareDocuments(ctx, source.Collection(name), target.Collection(name), query)
+		if err != nil {
+			return nil, err
+		}
+		if mismatch != nil {
+			report.Mismatches = append(report.Mismatches, *mismatch)
+		}
+	}
+	return report, nil
+}
+
+// getCollectionHashes returns the md5 hashes of the given collections
+// calculated by dbHash. The result is empty if the command fails, e.g.
+// because it is not allowed for the user.
+func getCollectionHashes(ctx context.Context, db *mongo.Database, collections []string) map[string]string {
+	var result struct {
+		Collections map[string]string `bson:"collections"`
+	}
+	cmd := bson.D{{Key: "dbHash", Value: 1}, {Key: "collections", Value: collections}}
+	if err := db.RunCommand(ctx, cmd).Decode(&result); err != nil || result.Collections == nil {
+		return map[string]string{}
+	}
+	return result.Collections
+}
+
+// compareDocuments reads the documents of both collections matching query
+// ordered by _id and hashes them. It returns a mismatch with the first
+// differing _id and both hashes, or nil if all documents are equal.
+func compareDocuments(ctx context.Context, source *mongo.Collection, target *mongo.Collection, query bson.D) (*Mismatch, error) {
+	findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	sourceCursor, err := source.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer sourceCursor.Close(ctx)
+	targetCursor, err := target.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer targetCursor.Close(ctx)
+
+	sourceHash, targetHash := md5.New(), md5.New()
+	firstID := ""
+	for {
+		hasSource := sourceCursor.Next(ctx)
+		hasTarget := targetCursor.Next(ctx)
+		if !hasSource && !hasTarget {
+			break
+		}
+		if hasSource {
+			sourceHash.Write(sourceCursor.Current)
+		}
+		if hasTarget {
+			targetHash.Write(targetCursor.Current)
+		}
+		if firstID != "" || (hasSource && hasTarget && bytes.Equal(sourceCursor.Current, targetCursor.Current)) {
+			continue
+		}
+		if hasSource {
+			firstID = sourceCursor.Current.Lookup("_id").String()
+		} else {
+			firstID = targetCursor.Current.Lookup("_id").String()
+		}
+	}
+	if err := sourceCursor.Err(); err != nil {
+		return nil, err
+	}
+	if err := targetCursor.Err(); err != nil {
+		return nil, err
+	}
+
+	if firstID == "" {
+		return nil, nil
+	}
+	return &Mismatch{
+		Collection: source.Name(),
+		Check:      CheckChecksum,
+		DocumentID: firstID,
+		Expected:   hexDigest(sourceHash),
+		Found:      hexDigest(targetHash),
+	}, nil
+}
+
+// hexDigest returns the hash as hex string.
+func hexDigest(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
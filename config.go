@@ -0,0 +1,566 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mr "github.com/mongodb/mongo-tools/mongorestore"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// SyncConfig is the content of the synchronization configuration file. The
+// file can be written in YAML or JSON.
+type SyncConfig struct {
+	Services []ServiceConfig `yaml:"services"`
+}
+
+// ServiceConfig maps a project, stage and service to the databases that are
+// synchronized. An empty project or stage matches every project or stage.
+type ServiceConfig struct {
+	Project     string         `yaml:"project"`
+	Stage       string         `yaml:"stage"`
+	Service     string         `yaml:"service"`
+	Source      DatabaseConfig `yaml:"source"`
+	Target      DatabaseConfig `yaml:"target"`
+	Collections []string       `yaml:"collections"`
+	Options     SyncOptions    `yaml:"options"`
+	// Masking maps collection names to the rules applied to their documents
+	// between the dump and the restore.
+	Masking map[string][]MaskRule `yaml:"masking"`
+	// Filters maps collection names to the query, limit and sampling
+	// selecting the synchronized documents.
+	Filters map[string]CollectionFilter `yaml:"filters"`
+}
+
+// DatabaseConfig holds the connection settings of a source or target database.
+type DatabaseConfig struct {
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	Database string `yaml:"database"`
+	// Namespace is appended to the host, defaults to <project>-<stage>.
+	Namespace string `yaml:"namespace"`
+	// URI is a mongodb:// connection string used instead of host and port,
+	// e.g. for replica sets or TLS. It must not contain a password.
+	URI string `yaml:"uri"`
+	// Credentials is the directory of a mounted secret containing the files
+	// username and password.
+	Credentials string `yaml:"credentials"`
+}
+
+// SyncOptions groups the options of a synchronization.
+type SyncOptions struct {
+	// DumpDir overrides the DUMP_DIR environment variable.
+	DumpDir string `yaml:"dumpDir"`
+	// KeepExisting restores without dropping the target collections first.
+	KeepExisting bool `yaml:"keepExisting"`
+	// Streaming pipes the dump directly into the restore instead of writing
+	// it to the dump directory.
+	Streaming bool `yaml:"streaming"`
+	// OverlapPolicy overrides SYNC_OVERLAP_POLICY for this service.
+	OverlapPolicy OverlapPolicy `yaml:"overlapPolicy"`
+	// SkipVerification disables the comparison of the source, the dump and
+	// the target after the dump and the restore.
+	SkipVerification bool `yaml:"skipVerification"`
+	// DeepVerification additionally compares the documents of the source and
+	// the target after the restore.
+	DeepVerification bool `yaml:"deepVerification"`
+	// Incremental replays the changes of the source since the last
+	// synchronization instead of dumping the whole database. The source
+	// must be a replica set.
+	Incremental bool `yaml:"incremental"`
+	// Snapshots keeps the dumps in a versioned catalog below the dump
+	// directory instead of removing them after the restore.
+	Snapshots *SnapshotOptions `yaml:"snapshots"`
+	// SafeRestore restores into staging collections of the target database
+	// and replaces the target collections only after the staging
+	// collections are verified.
+	SafeRestore bool `yaml:"safeRestore"`
+	// Storage streams the dump as archives into a filesystem or an
+	// S3-compatible object storage instead of the dump directory.
+	Storage *StorageConfig `yaml:"storage"`
+	// Gzip compresses the dump files or archives.
+	Gzip bool `yaml:"gzip"`
+	// Archive writes one archive file per dump instead of a file per
+	// collection into the dump directory.
+	Archive bool `yaml:"archive"`
+	// ParallelCollections is the number of collections which are dumped and
+	// restored at the same time, defaults to 1.
+	ParallelCollections int `yaml:"parallelCollections"`
+	// InsertionWorkers is the number of insertion workers per restored
+	// collection, defaults to the mongorestore default of 1.
+	InsertionWorkers int `yaml:"insertionWorkers"`
+	// Encryption encrypts the archives with AES-GCM and a key of a mounted
+	// secret. It requires archive or storage.
+	Encryption *EncryptionConfig `yaml:"encryption"`
+	// MaskingKey is the file of a mounted secret holding the key of the
+	// hash masking action.
+	MaskingKey string `yaml:"maskingKey"`
+	// Timeouts limit the duration of the synchronization and of its dump,
+	// restore and verification phases.
+	Timeouts Timeouts `yaml:"timeouts"`
+	// Retry configures the attempts and the backoff of the dump and restore
+	// of a collection which fail with a transient error.
+	Retry RetryPolicy `yaml:"retry"`
+	// DryRun only plans the synchronizations of the service, which can also
+	// be requested per event.
+	DryRun bool `yaml:"dryRun"`
+}
+
+// configStore holds the currently loaded synchronization configuration.
+type configStore struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	config  *SyncConfig
+	// loaded is set after the initial load, reloadErr is the error of the
+	// last failed reload
+	loaded    bool
+	reloadErr error
+}
+
+var syncConfig = &configStore{}
+
+// loadSyncConfig reads and validates the configuration file at path.
+func loadSyncConfig(path string) (*SyncConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSyncConfig(content)
+}
+
+// parseSyncConfig parses and validates a YAML or JSON configuration.
+func parseSyncConfig(content []byte) (*SyncConfig, error) {
+	config := &SyncConfig{}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("invalid sync configuration: %s", err.Error())
+	}
+	for i := range config.Services {
+		config.Services[i].setDefaults()
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// setDefaults fills in the default port of the source and target.
+func (sc *ServiceConfig) setDefaults() {
+	if sc.Source.Port == "" {
+		sc.Source.Port = defaultPort
+	}
+	if sc.Target.Port == "" {
+		sc.Target.Port = defaultPort
+	}
+}
+
+// validate checks that every service entry is complete and unique.
+func (c *SyncConfig) validate() error {
+	seen := map[string]bool{}
+	for i, sc := range c.Services {
+		if sc.Service == "" {
+			return fmt.Errorf("invalid sync configuration: services[%d] has no service", i)
+		}
+		key := sc.Project + "/" + sc.Stage + "/" + strings.ToLower(sc.Service)
+		if seen[key] {
+			return fmt.Errorf("invalid sync configuration: duplicate entry for %s", key)
+		}
+		seen[key] = true
+
+		if err := sc.Source.validate("source"); err != nil {
+			return fmt.Errorf("invalid sync configuration for %s: %s", key, err.Error())
+		}
+		if err := sc.Target.validate("target"); err != nil {
+			return fmt.Errorf("invalid sync configuration for %s: %s", key, err.Error())
+		}
+		if sc.Source == sc.Target {
+			return fmt.Errorf("invalid sync configuration for %s: source and target are the same database", key)
+		}
+		if sc.Options.OverlapPolicy != "" && !sc.Options.OverlapPolicy.isValid() {
+			return fmt.Errorf("invalid sync configuration for %s: unknown overlap policy %s", key, sc.Options.OverlapPolicy)
+		}
+		for _, col := range sc.Collections {
+			if col == "" {
+				return fmt.Errorf("invalid sync configuration for %s: empty collection name", key)
+			}
+		}
+		for col, rules := range sc.Masking {
+			for _, rule := range rules {
+				if err := rule.validate(); err != nil {
+					return fmt.Errorf("invalid sync configuration for %s: collection %s: %s", key, col, err.Error())
+				}
+				if (rule.Action == MaskHash || rule.Action == MaskFake) && sc.Options.MaskingKey == "" {
+					return fmt.Errorf("invalid sync configuration for %s: collection %s: action %s of field %s requires a maskingKey", key, col, rule.Action, rule.Field)
+				}
+			}
+		}
+		for col, filter := range sc.Filters {
+			if err := filter.validate(); err != nil {
+				return fmt.Errorf("invalid sync configuration for %s: collection %s: %s", key, col, err.Error())
+			}
+			// mongodump accepts a query only for a single collection
+			if !contains(sc.Collections, col) {
+				return fmt.Errorf("invalid sync configuration for %s: filtered collection %s is not listed in collections", key, col)
+			}
+			if sc.Options.Incremental {
+				return fmt.Errorf("invalid sync configuration for %s: collection %s: filters can not be used with incremental synchronization", key, col)
+			}
+			if filter.Limit > 0 && sc.Options.Streaming {
+				return fmt.Errorf("invalid sync configuration for %s: collection %s: limit can not be used with streaming", key, col)
+			}
+			if (filter.Limit > 0 || filter.isSampled()) && sc.Options.DeepVerification {
+				return fmt.Errorf("invalid sync configuration for %s: collection %s: limited or sampled documents can not be verified with deepVerification", key, col)
+			}
+		}
+		if sc.Options.Snapshots != nil {
+			if err := sc.Options.Snapshots.validate(); err != nil {
+				return fmt.Errorf("invalid sync configuration for %s: %s", key, err.Error())
+			}
+			if sc.Options.Streaming {
+				return fmt.Errorf("invalid sync configuration for %s: snapshots require a dump directory and can not be used with streaming", key)
+			}
+		}
+		if sc.Options.SafeRestore && (sc.Options.Streaming || sc.Options.KeepExisting) {
+			return fmt.Errorf("invalid sync configuration for %s: safeRestore replaces the target collections and can not be used with streaming or keepExisting", key)
+		}
+		if sc.Options.Storage != nil {
+			if err := sc.Options.Storage.validate(); err != nil {
+				return fmt.Errorf("invalid sync configuration for %s: %s", key, err.Error())
+			}
+			if sc.Options.Streaming || len(sc.Masking) > 0 || sc.Options.Snapshots != nil || sc.Options.SafeRestore || hasLimit(sc.Filters) {
+				return fmt.Errorf("invalid sync configuration for %s: storage writes archives and can not be used with streaming, masking, limit, snapshots or safeRestore", key)
+			}
+		}
+		if (sc.Options.Gzip || sc.Options.Archive) && sc.Options.Streaming {
+			return fmt.Errorf("invalid sync configuration for %s: gzip and archive can not be used with streaming", key)
+		}
+		if sc.Options.Archive && (len(sc.Masking) > 0 || sc.Options.SafeRestore || hasLimit(sc.Filters)) {
+			return fmt.Errorf("invalid sync configuration for %s: archive can not be used with masking, limit or safeRestore", key)
+		}
+		if sc.Options.Encryption != nil {
+			if err := sc.Options.Encryption.validate(); err != nil {
+				return fmt.Errorf("invalid sync configuration for %s: %s", key, err.Error())
+			}
+			// the files of a dump directory are written unencrypted by
+			// mongodump, only archives are encrypted while they are written
+			if !sc.Options.Archive && sc.Options.Storage == nil {
+				return fmt.Errorf("invalid sync configuration for %s: encryption can only be used with archive or storage", key)
+			}
+		}
+		if err := sc.Options.Timeouts.validate(); err != nil {
+			return fmt.Errorf("invalid sync configuration for %s: %s", key, err.Error())
+		}
+		if err := sc.Options.Retry.validate(); err != nil {
+			return fmt.Errorf("invalid sync configuration for %s: %s", key, err.Error())
+		}
+		if sc.Options.ParallelCollections < 0 || sc.Options.InsertionWorkers < 0 {
+			return fmt.Errorf("invalid sync configuration for %s: parallelCollections and insertionWorkers must not be negative", key)
+		}
+		if len(sc.Masking) > 0 && sc.Options.Streaming {
+			return fmt.Errorf("invalid sync configuration for %s: masking requires a dump directory and can not be used with streaming", key)
+		}
+		if len(sc.Masking) > 0 && sc.Options.DeepVerification {
+			return fmt.Errorf("invalid sync configuration for %s: masked documents can not be verified with deepVerification", key)
+		}
+	}
+	return nil
+}
+
+// validate checks the connection settings of a database.
+func (dc DatabaseConfig) validate(name string) error {
+	if dc.URI != "" {
+		if err := validateURI(dc.URI); err != nil {
+			return fmt.Errorf("invalid %s uri: %s", name, err.Error())
+		}
+	} else if dc.Host == "" {
+		return fmt.Errorf("no %s host configured", name)
+	}
+	if dc.Database == "" {
+		return fmt.Errorf("no %s database configured", name)
+	}
+	if !isValidPort(dc.Port) {
+		return fmt.Errorf("invalid %s port \"%s\"", name, dc.Port)
+	}
+	return nil
+}
+
+// lookup returns the most specific entry matching the project, stage and
+// service, or nil if there is none.
+func (c *SyncConfig) lookup(project, stage, service string) *ServiceConfig {
+	var match *ServiceConfig
+	best := -1
+	for i := range c.Services {
+		sc := &c.Services[i]
+		if !strings.EqualFold(sc.Service, service) {
+			continue
+		}
+		score := 0
+		if sc.Project != "" {
+			if sc.Project != project {
+				continue
+			}
+			score += 2
+		}
+		if sc.Stage != "" {
+			if sc.Stage != stage {
+				continue
+			}
+			score++
+		}
+		if score > best {
+			match, best = sc, score
+		}
+	}
+	return match
+}
+
+// init loads the configuration file at path. A missing file is not an error,
+// in this case the configuration is read from the environment variables.
+func (s *configStore) init(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.path = path
+	if path == "" {
+		s.loaded = true
+		return nil
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		defaultLogger.Info(fmt.Sprintf("sync configuration %s not found, using environment variables", path))
+		s.loaded = true
+		return nil
+	} else if err != nil {
+		return err
+	}
+	config, err := loadSyncConfig(path)
+	if err != nil {
+		return err
+	}
+	s.config = config
+	s.modTime = info.ModTime()
+	s.loaded = true
+	return nil
+}
+
+// reload loads the configuration file again if it has changed. An invalid
+// file is reported and the previous configuration is kept.
+func (s *configStore) reload() {
+	s.mu.RLock()
+	path, modTime := s.path, s.modTime
+	s.mu.RUnlock()
+
+	if path == "" {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.ModTime().Equal(modTime) {
+		return
+	}
+	config, err := loadSyncConfig(path)
+	if err != nil {
+		defaultLogger.Error(fmt.Sprintf("failed to reload sync configuration: %s", err.Error()))
+		s.mu.Lock()
+		s.reloadErr = err
+		s.mu.Unlock()
+		return
+	}
+
+	s.mu.Lock()
+	s.config = config
+	s.modTime = info.ModTime()
+	s.reloadErr = nil
+	s.mu.Unlock()
+	defaultLogger.Info(fmt.Sprintf("reloaded sync configuration %s", path))
+}
+
+// watch reloads the configuration file in the given interval.
+func (s *configStore) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.reload()
+	}
+}
+
+// get returns the configuration of the service. If no configuration file is
+// loaded or it has no entry for the service, the <SERVICE>_* environment
+// variables are used.
+func (s *configStore) get(project, stage, service string) (*ServiceConfig, error) {
+	s.mu.RLock()
+	config := s.config
+	s.mu.RUnlock()
+
+	if config != nil {
+		if sc := config.lookup(project, stage, service); sc != nil {
+			result := *sc
+			return &result, nil
+		}
+	}
+	return getServiceConfigFromEnv(service)
+}
+
+// getServices returns the services of the configuration file.
+func (s *configStore) getServices() []ServiceConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.config == nil {
+		return nil
+	}
+	return append([]ServiceConfig{}, s.config.Services...)
+}
+
+// getDumpDirs returns the dump directories configured for the services.
+func (s *configStore) getDumpDirs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	dirs := []string{}
+	if s.config == nil {
+		return dirs
+	}
+	for _, sc := range s.config.Services {
+		if sc.Options.DumpDir != "" && !contains(dirs, sc.Options.DumpDir) {
+			dirs = append(dirs, sc.Options.DumpDir)
+		}
+	}
+	return dirs
+}
+
+// getServiceConfigFromEnv reads the configuration of a service from the
+// <SERVICE>_SOURCEDB, <SERVICE>_TARGETDB, ... environment variables.
+func getServiceConfigFromEnv(service string) (*ServiceConfig, error) {
+	service = strings.ToUpper(service) // in our demo example, this will be carts --> toUpper: CARTS
+
+	sourceDB := os.Getenv(service + "_SOURCEDB")
+	if sourceDB == "" {
+		return nil, fmt.Errorf("No source database configured for %s", service)
+	}
+	targetDB := os.Getenv(service + "_TARGETDB")
+	if targetDB == "" {
+		return nil, fmt.Errorf("No target database configured for %s", service)
+	}
+	sourceHost := os.Getenv(service + "_SOURCE_HOST")
+	if sourceHost == "" {
+		return nil, fmt.Errorf("No source host configured for %s", service)
+	}
+	targetHost := os.Getenv(service + "_TARGET_HOST")
+	if targetHost == "" {
+		return nil, fmt.Errorf("No target host configured for %s", service)
+	}
+	port := os.Getenv(service + "_PORT")
+
+	return &ServiceConfig{
+		Service:     service,
+		Source:      DatabaseConfig{Host: sourceHost, Port: port, Database: sourceDB},
+		Target:      DatabaseConfig{Host: targetHost, Port: port, Database: targetDB},
+		Collections: getCollections(os.Getenv(service + "_COLLECTIONS")),
+	}, nil
+}
+
+// newDatabaseInfo creates the DatabaseInfo of a synchronization in the
+// namespace <project>-<stage>.
+func newDatabaseInfo(sc *ServiceConfig, namespace string) (*DatabaseInfo, error) {
+	sourceHost, sourceURI, err := getHostAndURI(sc.Source, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source: %s", err.Error())
+	}
+	targetHost, targetURI, err := getHostAndURI(sc.Target, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %s", err.Error())
+	}
+
+	dumpDir := sc.Options.DumpDir
+	if dumpDir == "" {
+		dumpDir = os.Getenv("DUMP_DIR")
+	}
+
+	args := []string{}
+	if !sc.Options.KeepExisting {
+		args = append(args, mr.DropOption)
+	}
+
+	var storage Storage
+	if sc.Options.Storage != nil {
+		if storage, err = newStorage(sc.Options.Storage, dumpDir); err != nil {
+			return nil, fmt.Errorf("invalid storage: %s", err.Error())
+		}
+	}
+
+	var encryption *encryptionKeys
+	if sc.Options.Encryption != nil {
+		if encryption, err = loadEncryptionKeys(sc.Options.Encryption); err != nil {
+			return nil, err
+		}
+	}
+
+	masking := sc.Masking
+	if sc.Options.MaskingKey != "" {
+		key, err := loadMaskingKey(sc.Options.MaskingKey)
+		if err != nil {
+			return nil, err
+		}
+		masking = withMaskingKey(sc.Masking, key)
+	}
+
+	return &DatabaseInfo{
+		sourceDB:    sc.Source.Database,
+		targetDB:    sc.Target.Database,
+		sourceHost:  sourceHost,
+		targetHost:  targetHost,
+		sourceURI:   sourceURI,
+		targetURI:   targetURI,
+		port:        sc.Source.Port,
+		targetPort:  sc.Target.Port,
+		dumpDir:     dumpDir,
+		collections: sc.Collections,
+		args:        args,
+		streaming:   sc.Options.Streaming,
+
+		skipVerification: sc.Options.SkipVerification,
+		deepVerification: sc.Options.DeepVerification,
+		masking:          masking,
+		filters:          sc.Filters,
+		incremental:      sc.Options.Incremental,
+		snapshots:        sc.Options.Snapshots,
+		safeRestore:      sc.Options.SafeRestore,
+		storage:          storage,
+		gzip:             sc.Options.Gzip,
+		archive:          sc.Options.Archive,
+
+		parallelCollections: sc.Options.ParallelCollections,
+		insertionWorkers:    sc.Options.InsertionWorkers,
+		encryption:          encryption,
+		timeouts:            sc.Options.Timeouts,
+		retry:               sc.Options.Retry,
+	}, nil
+}
+
+// getHostAndURI returns the host and the connection string of a database.
+// The namespace is only appended to a host without a configured URI.
+func getHostAndURI(dc DatabaseConfig, namespace string) (string, string, error) {
+	host := dc.Host + "." + namespaceOf(dc, namespace)
+	if dc.URI != "" {
+		hosts, err := getHosts(dc.URI)
+		if err != nil {
+			return "", "", err
+		}
+		host = hosts
+	}
+	uri, err := getConnectionString(dc, host)
+	if err != nil {
+		return "", "", err
+	}
+	return host, uri, nil
+}
+
+// namespaceOf returns the namespace configured for the database or the default.
+func namespaceOf(dc DatabaseConfig, namespace string) string {
+	if dc.Namespace != "" {
+		return dc.Namespace
+	}
+	return namespace
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testSyncConfig = `
+services:
+- service: carts
+  source:
+    host: carts-db
+    database: carts-db
+  target:
+    host: carts-db-canary
+    database: carts-db-canary
+  collections:
+  - items
+  - "categories;archived"
+- project: sockshop
+  stage: production
+  service: carts
+  source:
+    host: carts-db
+    port: "27018"
+    database: carts-db
+  target:
+    host: carts-db-test
+    database: carts-db-test
+    namespace: testing
+  options:
+    dumpDir: /data/carts
+    keepExisting: true
+`
+
+// TestParseSyncConfig parses a configuration file and looks up services.
+func TestParseSyncConfig(t *testing.T) {
+	fmt.Println("\n>> TestParseSyncConfig()")
+
+	config, err := parseSyncConfig([]byte(testSyncConfig))
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+
+	sc := config.lookup("sockshop", "dev", "carts")
+	if sc == nil || sc.Target.Database != "carts-db-canary" {
+		t.Fatalf("unexpected service configuration: %+v", sc)
+	}
+	if len(sc.Collections) != 2 || sc.Collections[1] != "categories;archived" {
+		t.Errorf("unexpected collections: %v", sc.Collections)
+	}
+	if sc.Source.Port != defaultPort {
+		t.Errorf("unexpected port, expected: %s, found: %s", defaultPort, sc.Source.Port)
+	}
+
+	sc = config.lookup("sockshop", "production", "CARTS")
+	if sc == nil || sc.Target.Database != "carts-db-test" {
+		t.Fatalf("unexpected service configuration: %+v", sc)
+	}
+	dbInfo, err := newDatabaseInfo(sc, "sockshop-production")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if dbInfo.sourceHost != "carts-db.sockshop-production" || dbInfo.targetHost != "carts-db-test.testing" {
+		t.Errorf("unexpected hosts: %s, %s", dbInfo.sourceHost, dbInfo.targetHost)
+	}
+	if dbInfo.port != "27018" || dbInfo.getTargetPort() != defaultPort || dbInfo.dumpDir != "/data/carts" {
+		t.Errorf("unexpected database information: %+v", dbInfo)
+	}
+	if len(dbInfo.args) != 0 {
+		t.Errorf("unexpected restore arguments: %v", dbInfo.args)
+	}
+
+	if sc := config.lookup("sockshop", "dev", "orders"); sc != nil {
+		t.Errorf("expected no configuration for orders, found: %+v", sc)
+	}
+}
+
+// TestInvalidSyncConfig checks the validation of configuration files.
+func TestInvalidSyncConfig(t *testing.T) {
+	fmt.Println("\n>> TestInvalidSyncConfig()")
+
+	configs := map[string]string{
+		"unknown field":   `services: [{service: carts, sourceDB: carts-db}]`,
+		"no target":       `services: [{service: carts, source: {host: a, database: b}}]`,
+		"invalid port":    `services: [{service: carts, source: {host: a, database: b, port: "0"}, target: {host: c, database: d}}]`,
+		"same database":   `services: [{service: carts, source: {host: a, database: b}, target: {host: a, database: b}}]`,
+		"password in uri": `services: [{service: carts, source: {uri: "mongodb://u:p@a", database: b}, target: {host: c, database: d}}]`,
+		"duplicate":       `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}}, {service: CARTS, source: {host: a, database: b}, target: {host: c, database: e}}]`,
+		"masking action":  `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, masking: {users: [{field: email, action: encrypt}]}}]`,
+		"filter query":    `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, collections: [items], filters: {items: {query: "{price: "}}}]`,
+		"filter unlisted": `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, filters: {items: {limit: 10}}}]`,
+		"filter sample":   `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, collections: [items], filters: {items: {sample: 120}}}]`,
+		"masking stream":  `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, masking: {users: [{field: email, action: drop}]}, options: {streaming: true}}]`,
+		"snapshot stream": `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, options: {streaming: true, snapshots: {keep: 3}}}]`,
+		"snapshot keep":   `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, options: {snapshots: {keep: -1}}}]`,
+		"safe restore":    `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, options: {safeRestore: true, keepExisting: true}}]`,
+		"storage type":    `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, options: {storage: {type: ftp}}}]`,
+		"storage stream":  `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, options: {streaming: true, storage: {type: s3, endpoint: "http://minio:9000", bucket: dumps}}}]`,
+		"storage bucket":  `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, options: {storage: {type: s3, endpoint: "http://minio:9000"}}}]`,
+		"gzip stream":     `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, options: {streaming: true, gzip: true}}]`,
+		"archive mask":    `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, masking: {users: [{field: email, action: drop}]}, options: {archive: true}}]`,
+		"parallel":        `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, options: {parallelCollections: -1}}]`,
+		"encryption key":  `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, options: {encryption: {keys: /secrets/dump-keys}}}]`,
+		"encryption dir":  `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, options: {encryption: {keys: /secrets/dump-keys, keyId: current}}}]`,
+		"hash key":        `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, masking: {users: [{field: email, action: hash}]}}]`,
+		"fake key":        `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, masking: {users: [{field: email, action: fake}]}}]`,
+		"timeouts":        `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, options: {timeouts: {dump: -1s}}}]`,
+		"retry":           `services: [{service: carts, source: {host: a, database: b}, target: {host: c, database: d}, options: {retry: {maxAttempts: -1}}}]`,
+	}
+	for name, config := range configs {
+		if _, err := parseSyncConfig([]byte(config)); err == nil {
+			t.Errorf("%s: expected an error, but no error was thrown.", name)
+		}
+	}
+}
+
+// TestSyncConfigReload changes the configuration file and checks the
+// fallback to the environment variables.
+func TestSyncConfigReload(t *testing.T) {
+	fmt.Println("\n>> TestSyncConfigReload()")
+
+	dir, err := ioutil.TempDir("", "sync-config")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sync.json")
+
+	store := &configStore{}
+	if err := store.init(path); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	sc, err := store.get("sockshop", "dev", "carts")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if sc.Source.Database != os.Getenv("CARTS_SOURCEDB") {
+		t.Errorf("expected configuration from environment, found: %+v", sc)
+	}
+
+	config := `{"services": [{"service": "carts", "source": {"host": "a", "database": "carts-json"}, "target": {"host": "b", "database": "carts-json-canary"}}]}`
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	store.reload()
+
+	sc, err = store.get("sockshop", "dev", "carts")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if sc.Source.Database != "carts-json" {
+		t.Errorf("expected reloaded configuration, found: %+v", sc)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("services: [{service: carts}]"), 0644); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	store.reload()
+
+	sc, _ = store.get("sockshop", "dev", "carts")
+	if sc.Source.Database != "carts-json" {
+		t.Errorf("expected previous configuration after invalid reload, found: %+v", sc)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	commonopts "github.com/mongodb/mongo-tools-common/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+const (
+	// file names of a mounted kubernetes.io/basic-auth secret
+	usernameFile = "username"
+	passwordFile = "password"
+)
+
+// getConnectionString returns the connection string of a database. Without a
+// configured URI it is mongodb://<host>:<port>. The credentials of the
+// mounted secret are added to the connection string.
+func getConnectionString(dc DatabaseConfig, host string) (string, error) {
+	uri := dc.URI
+	if uri == "" {
+		uri = "mongodb://" + host + ":" + dc.Port
+	}
+	if dc.Credentials == "" {
+		return uri, nil
+	}
+
+	username, password, err := readCredentials(dc.Credentials)
+	if err != nil {
+		return "", err
+	}
+	return withCredentials(uri, username, password)
+}
+
+// readCredentials reads the username and password from the directory of a
+// mounted secret.
+func readCredentials(dir string) (string, string, error) {
+	username, err := ioutil.ReadFile(filepath.Join(dir, usernameFile))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read credentials: %s", err.Error())
+	}
+	password, err := ioutil.ReadFile(filepath.Join(dir, passwordFile))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read credentials: %s", err.Error())
+	}
+	return strings.TrimSpace(string(username)), strings.TrimSpace(string(password)), nil
+}
+
+// withCredentials adds the username and password to a connection string.
+func withCredentials(uri string, username string, password string) (string, error) {
+	cs, err := connstring.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if cs.Username != "" {
+		return "", fmt.Errorf("connection string already contains credentials")
+	}
+	i := strings.Index(uri, "://")
+	return uri[:i+3] + url.UserPassword(username, password).String() + "@" + uri[i+3:], nil
+}
+
+// getHosts returns the hosts of a connection string as a comma separated list.
+func getHosts(uri string) (string, error) {
+	cs, err := connstring.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(cs.Hosts, ","), nil
+}
+
+// validateURI checks that a configured connection string can be parsed and
+// does not contain a password, which has to be provided in a secret.
+func validateURI(uri string) error {
+	cs, err := connstring.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if cs.PasswordSet {
+		return fmt.Errorf("the connection string must not contain a password, use credentials instead")
+	}
+	return nil
+}
+
+// getToolOptions returns the ToolOptions of mongodump and mongorestore for
+// a connection string. Authentication, TLS and the replica set are taken
+// from the connection string.
+func getToolOptions(uri string, db string) (*commonopts.ToolOptions, error) {
+	toolURI, err := commonopts.NewURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	cs := toolURI.ParsedConnString()
+
+	return &commonopts.ToolOptions{
+		URI:            toolURI,
+		Connection:     &commonopts.Connection{},
+		Auth:           &commonopts.Auth{},
+		Namespace:      &commonopts.Namespace{DB: db},
+		ReplicaSetName: cs.ReplicaSet,
+		Direct:         cs.Connect == connstring.SingleConnect,
+	}, nil
+}
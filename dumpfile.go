@@ -0,0 +1,132 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mongodb/mongo-tools-common/util"
+)
+
+// splitDumpFileName returns the unescaped collection name and the kind of a
+// dump file, which is .bson or .metadata.json. The kind is empty for other
+// files.
+func splitDumpFileName(fileName string) (string, string) {
+	name := strings.TrimSuffix(fileName, ".gz")
+	for _, kind := range []string{".bson", ".metadata.json"} {
+		if strings.HasSuffix(name, kind) {
+			collection, err := util.UnescapeCollectionName(strings.TrimSuffix(name, kind))
+			if err != nil {
+				return "", ""
+			}
+			return collection, kind
+		}
+	}
+	return "", ""
+}
+
+// openDumpFile opens a dump file, which is decompressed if its name ends
+// with .gz.
+func openDumpFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &util.WrappedReadCloser{ReadCloser: gz, Inner: file}, nil
+}
+
+// countBSONDocuments counts the documents of a .bson file.
+func countBSONDocuments(r io.Reader) (int64, error) {
+	var count int64
+	for {
+		if _, err := readBSONDocument(r); err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return 0, err
+		}
+		count++
+	}
+}
+
+// maxBSONDocumentSize is the largest accepted document length, the 16MB
+// limit of MongoDB plus 16KB for the overhead of commands.
+const maxBSONDocumentSize = 16*1024*1024 + 16*1024
+
+// readBSONDocument reads the next document of a .bson file. Each document
+// starts with its length as little endian int32. io.EOF is returned at the
+// end of the file. Lengths beyond the maximum document size of MongoDB
+// plus some headroom are rejected before the document is allocated.
+func readBSONDocument(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, errors.New("truncated document")
+	}
+	length := int32(binary.LittleEndian.Uint32(header))
+	if length < 5 || length > maxBSONDocumentSize {
+		return nil, fmt.Errorf("invalid document length %d", length)
+	}
+	doc := make([]byte, length)
+	copy(doc, header)
+	if _, err := io.ReadFull(r, doc[4:]); err != nil {
+		return nil, errors.New("truncated document")
+	}
+	return doc, nil
+}
+
+// getDumpDataFile returns the path of the .bson or .bson.gz file of a
+// collection in the dump directory.
+func getDumpDataFile(dbInfo *DatabaseInfo, col string) (string, error) {
+	path := filepath.Join(dbInfo.dumpDir, dbInfo.sourceDB, util.EscapeCollectionName(col)+".bson")
+	for _, p := range []string{path, path + ".gz"} {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("missing data file of collection %s in dump directory", col)
+}
+
+// rewriteDumpFile passes the content of a .bson or .bson.gz file to rewrite
+// and replaces the file by the written content. The file is written to a
+// temporary file first, so it is left unchanged if rewrite fails.
+func rewriteDumpFile(path string, rewrite func(r io.Reader, w io.Writer) error) error {
+	r, err := openDumpFile(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".rewrite-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	var w io.WriteCloser = tmp
+	if strings.HasSuffix(path, ".gz") {
+		w = &util.WrappedWriteCloser{WriteCloser: gzip.NewWriter(tmp), Inner: tmp}
+	}
+	err = rewrite(r, w)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
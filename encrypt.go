@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// encryptedSuffix is appended to the name of an encrypted dump file
+	encryptedSuffix = ".enc"
+	// encryptionMagic starts every encrypted file
+	encryptionMagic = "MDBSENC1"
+	// encryptionChunkSize is the size of the plaintext of a sealed chunk
+	encryptionChunkSize = 64 * 1024
+	// encryptionKeySize is the size of the keys of the secret and the data
+	// keys, which selects AES-256
+	encryptionKeySize = 32
+	// lastChunkFlag is set in the length of the last chunk
+	lastChunkFlag = 1 << 31
+)
+
+var errTruncatedEncryption = errors.New("truncated encrypted file")
+
+// EncryptionConfig enables the encryption of the dump files with AES-GCM.
+type EncryptionConfig struct {
+	// Keys is the directory of a mounted secret with one file per key, named
+	// by the id of the key and containing 32 base64 encoded bytes
+	Keys string `yaml:"keys"`
+	// KeyID is the id of the key new dumps are encrypted with, the other
+	// keys are used to decrypt existing snapshots
+	KeyID string `yaml:"keyId"`
+}
+
+// validate checks that the directory of the keys and the key id are set.
+func (c *EncryptionConfig) validate() error {
+	if c.Keys == "" || c.KeyID == "" {
+		return errors.New("encryption requires the directory of the keys and a keyId")
+	}
+	return nil
+}
+
+// encryptionKeys are the keys of the mounted secret. keyID is the key new
+// files are encrypted with.
+type encryptionKeys struct {
+	keyID string
+	keys  map[string][]byte
+}
+
+// encryptionHeader follows the magic of an encrypted file. DataKey is the
+// random key of the file, sealed with the key KeyID of the secret.
+type encryptionHeader struct {
+	KeyID   string `json:"keyId"`
+	DataKey []byte `json:"dataKey"`
+}
+
+// loadEncryptionKeys reads the keys from the directory of a mounted secret.
+// Hidden files, which Kubernetes uses for updating the secret, are skipped.
+func loadEncryptionKeys(c *EncryptionConfig) (*encryptionKeys, error) {
+	files, err := ioutil.ReadDir(c.Keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption keys: %s", err.Error())
+	}
+	keys := map[string][]byte{}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(c.Keys, file.Name())
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key %s: %s", file.Name(), err.Error())
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil || len(key) != encryptionKeySize {
+			return nil, fmt.Errorf("encryption key %s is not a base64 encoded 256-bit key", file.Name())
+		}
+		keys[file.Name()] = key
+	}
+	if _, ok := keys[c.KeyID]; !ok {
+		return nil, fmt.Errorf("encryption key %s not found in %s", c.KeyID, c.Keys)
+	}
+	return &encryptionKeys{keyID: c.KeyID, keys: keys}, nil
+}
+
+// newGCM returns AES-GCM with the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptWriter encrypts the content written to it in chunks, each sealed
+// with the data key of the file and the number of the chunk as nonce. The
+// last chunk is marked by the highest bit of its length, which is also
+// authenticated, so a truncated file is detected.
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+}
+
+// newEncryptWriter writes the header with a new data key to w and returns
+// a writer encrypting with this data key. Close writes the last chunk, but
+// does not close w.
+func newEncryptWriter(w io.Writer, keys *encryptionKeys) (*encryptWriter, error) {
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	keyAEAD, err := newGCM(keys.keys[keys.keyID])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, keyAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header, err := json.Marshal(encryptionHeader{
+		KeyID:   keys.keyID,
+		DataKey: keyAEAD.Seal(nonce, nonce, dataKey, []byte(keys.keyID)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var prefix bytes.Buffer
+	prefix.WriteString(encryptionMagic)
+	binary.Write(&prefix, binary.LittleEndian, uint32(len(header)))
+	prefix.Write(header)
+	if _, err := w.Write(prefix.Bytes()); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead}, nil
+}
+
+// Write encrypts all complete chunks. The rest is kept for the next write,
+// so the last chunk is written by Close.
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	for len(e.buf) > encryptionChunkSize {
+		if err := e.seal(e.buf[:encryptionChunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[encryptionChunkSize:]
+	}
+	return len(p), nil
+}
+
+// Close encrypts the remaining content as last chunk.
+func (e *encryptWriter) Close() error {
+	err := e.seal(e.buf, true)
+	e.buf = nil
+	return err
+}
+
+// seal writes the length and the ciphertext of a chunk.
+func (e *encryptWriter) seal(chunk []byte, last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.aead, e.counter), chunk, chunkData(last))
+	e.counter++
+	length := uint32(len(sealed))
+	if last {
+		length |= lastChunkFlag
+	}
+	if err := binary.Write(e.w, binary.LittleEndian, length); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptReader decrypts the chunks of an encrypted file.
+type decryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	last    bool
+}
+
+// newDecryptReader reads the header of an encrypted file and returns a
+// reader of the decrypted content. The file must be encrypted with one of
+// the keys.
+func newDecryptReader(r io.Reader, keys *encryptionKeys) (*decryptReader, error) {
+	magic := make([]byte, len(encryptionMagic)+4)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errors.New("not an encrypted file")
+	}
+	length := binary.LittleEndian.Uint32(magic[len(encryptionMagic):])
+	if length > encryptionChunkSize {
+		return nil, errors.New("invalid encryption header")
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, errTruncatedEncryption
+	}
+	header := encryptionHeader{}
+	if err := json.Unmarshal(content, &header); err != nil {
+		return nil, fmt.Errorf("invalid encryption header: %s", err.Error())
+	}
+	key, ok := keys.keys[header.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %s", header.KeyID)
+	}
+	keyAEAD, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	size := keyAEAD.NonceSize()
+	if len(header.DataKey) < size {
+		return nil, errors.New("invalid encryption header: data key too short")
+	}
+	dataKey, err := keyAEAD.Open(nil, header.DataKey[:size], header.DataKey[size:], []byte(header.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key with key %s", header.KeyID)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: r, aead: aead}, nil
+}
+
+// Read returns the decrypted content of the chunks. io.EOF is only returned
+// after the last chunk.
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.last {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.
+func (d *decryptReader) open() error {
+	var length uint32
+	if err := binary.Read(d.r, binary.LittleEndian, &length); err != nil {
+		return errTruncatedEncryption
+	}
+	last := length&lastChunkFlag != 0
+	length &^= lastChunkFlag
+	if length > encryptionChunkSize+uint32(d.aead.Overhead()) {
+		return errors.New("failed to decrypt, the encrypted file is corrupted")
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return errTruncatedEncryption
+	}
+	chunk, err := d.aead.Open(nil, chunkNonce(d.aead, d.counter), sealed, chunkData(last))
+	if err != nil {
+		return errors.New("failed to decrypt, the encrypted file is corrupted")
+	}
+	d.counter++
+	d.buf, d.last = chunk, last
+	return nil
+}
+
+// chunkNonce returns the nonce of a chunk, its number. The data key is
+// unique per file, so the nonces are never reused with the same key.
+func chunkNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+// chunkData is the additional data of a chunk, which marks the last chunk.
+func chunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// writeEncryptionKeys writes base64 encoded random keys into a directory
+// like a mounted secret.
+func writeEncryptionKeys(t *testing.T, dir string, ids ...string) {
+	for _, id := range ids {
+		key := make([]byte, encryptionKeySize)
+		rand.Read(key)
+		if err := ioutil.WriteFile(filepath.Join(dir, id), []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+			t.Fatalf("Error message: %s", err)
+		}
+	}
+}
+
+// TestEncryption encrypts content with a rotated key, decrypts it and
+// detects truncated and tampered files.
+func TestEncryption(t *testing.T) {
+	fmt.Println("\n>> TestEncryption()")
+
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	writeEncryptionKeys(t, dir, "2019-10", "2019-11")
+	os.Mkdir(filepath.Join(dir, "..data"), 0755)
+
+	old, err := loadEncryptionKeys(&EncryptionConfig{Keys: dir, KeyID: "2019-10"})
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if _, err := loadEncryptionKeys(&EncryptionConfig{Keys: dir, KeyID: "2019-12"}); err == nil {
+		t.Errorf("expected an error for a missing key, but no error was thrown.")
+	}
+
+	content := make([]byte, 3*encryptionChunkSize+100)
+	rand.Read(content)
+	var encrypted bytes.Buffer
+	w, err := newEncryptWriter(&encrypted, old)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	w.Write(content[:1000])
+	w.Write(content[1000:])
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if bytes.Contains(encrypted.Bytes(), content[:100]) {
+		t.Errorf("expected the content to be encrypted")
+	}
+
+	// the file is still decrypted after the rotation to the next key
+	rotated, err := loadEncryptionKeys(&EncryptionConfig{Keys: dir, KeyID: "2019-11"})
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	r, err := newDecryptReader(bytes.NewReader(encrypted.Bytes()), rotated)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	decrypted, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if !bytes.Equal(decrypted, content) {
+		t.Errorf("unexpected decrypted content of %d bytes", len(decrypted))
+	}
+
+	truncated := encrypted.Bytes()[:encrypted.Len()-encryptionChunkSize]
+	if r, err := newDecryptReader(bytes.NewReader(truncated), rotated); err == nil {
+		if _, err := ioutil.ReadAll(r); err != errTruncatedEncryption {
+			t.Errorf("unexpected error, expected: %s, found: %v", errTruncatedEncryption, err)
+		}
+	}
+	tampered := append([]byte{}, encrypted.Bytes()...)
+	tampered[len(tampered)-1] ^= 1
+	if r, err := newDecryptReader(bytes.NewReader(tampered), rotated); err == nil {
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Errorf("expected an error for a tampered file, but no error was thrown.")
+		}
+	}
+	delete(rotated.keys, "2019-10")
+	if _, err := newDecryptReader(bytes.NewReader(encrypted.Bytes()), rotated); err == nil {
+		t.Errorf("expected an error for an unknown key, but no error was thrown.")
+	}
+}
+
+// TestEncryptSnapshot keeps an encrypted archive as snapshot, reads its
+// state and restores it only with the key it is encrypted with.
+func TestEncryptSnapshot(t *testing.T) {
+	fmt.Println("\n>> TestEncryptSnapshot()")
+
+	keyDir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(keyDir)
+	writeEncryptionKeys(t, keyDir, "current")
+	keys, err := loadEncryptionKeys(&EncryptionConfig{Keys: keyDir, KeyID: "current"})
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+
+	dumpDir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(dumpDir)
+	job := jobs.create("ctx-encrypt", "event-encrypt")
+	dbInfo := &DatabaseInfo{sourceDB: "carts-db", sourceHost: "carts-db.sockshop-production", port: "27017",
+		collections: []string{"items"}, gzip: true, archive: true, encryption: keys, snapshots: &SnapshotOptions{}}
+	dbInfo.snapshotDir = getSnapshotDir(dumpDir, dbInfo)
+	dbInfo.dumpDir = getPendingSnapshotDir(dbInfo.snapshotDir, job.ID)
+	os.MkdirAll(dbInfo.dumpDir, 0755)
+
+	// the archive is encrypted while it is written, like by dumpArchive
+	plain := filepath.Join(dumpDir, "items.archive.gz")
+	meta := dumpMetadata{Indexes: []bson.D{{{Key: "v", Value: 2}, {Key: "key", Value: bson.D{{Key: "_id", Value: 1}}}, {Key: "name", Value: "_id_"}}}}
+	writeArchiveFile(t, plain, "carts-db", map[string]int{"items": 3}, meta)
+	content, _ := ioutil.ReadFile(plain)
+	os.Remove(plain)
+	var encrypted bytes.Buffer
+	ew, err := newEncryptWriter(&encrypted, keys)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	ew.Write(content)
+	ew.Close()
+	ioutil.WriteFile(filepath.Join(dbInfo.dumpDir, getArchiveKey(dbInfo, "items")), encrypted.Bytes(), 0600)
+
+	snapshot, err := saveSnapshot(job.ID, dbInfo)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if !snapshot.Archive || len(snapshot.Archives) != 1 || len(snapshot.KeyIDs) != 1 || snapshot.Collections["items"] != 3 {
+		t.Errorf("unexpected snapshot: %+v", snapshot)
+	}
+	files, _ := ioutil.ReadDir(snapshot.dir)
+	for _, file := range files {
+		if file.Name() != manifestFile && filepath.Ext(file.Name()) != encryptedSuffix {
+			t.Errorf("unexpected unencrypted file %s", file.Name())
+		}
+	}
+
+	restore := &DatabaseInfo{sourceDB: "carts-db-v2", targetDB: "carts-db-canary", encryption: keys}
+	if err := useSnapshot(restore, snapshot); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if !restore.archive || len(restore.collections) != 1 || restore.dumpDir != snapshot.dir {
+		t.Errorf("unexpected database information: %+v", restore)
+	}
+	state, err := getDumpState(restore)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if len(state) != 1 || state["items"].Count != 3 {
+		t.Errorf("unexpected dump state: %v", state)
+	}
+
+	assertError(t, "snapshot "+snapshot.ID+" is encrypted with key current, which is not configured",
+		useSnapshot(&DatabaseInfo{}, snapshot))
+	snapshot.Archives = nil
+	assertError(t, "snapshot "+snapshot.ID+" is an archive of all collections and can not be restored partially",
+		useSnapshot(&DatabaseInfo{collections: []string{"items"}, encryption: keys}, snapshot))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/cloudevents/sdk-go/pkg/cloudevents"
+	"github.com/cloudevents/sdk-go/pkg/cloudevents/client"
+	cloudeventshttp "github.com/cloudevents/sdk-go/pkg/cloudevents/transport/http"
+	"github.com/cloudevents/sdk-go/pkg/cloudevents/types"
+	"github.com/google/uuid"
+	keptnevents "github.com/keptn/go-utils/pkg/events"
+)
+
+const (
+	// SynchronizedEventType is a CloudEvent for indicating that a database synchronization has finished
+	SynchronizedEventType = "sh.keptn.event.mongodb.synchronized"
+
+	// SynchronizationFailedEventType is a CloudEvent for indicating that a database synchronization has failed
+	SynchronizationFailedEventType = "sh.keptn.event.mongodb.synchronization.failed"
+
+	eventSource = "mongodb-service"
+)
+
+// eventTimeout limits the sending of an event, so an unresponsive event
+// broker does not block the worker which finishes a job.
+var eventTimeout = 10 * time.Second
+
+// DatabaseSummary describes the source or the target of a synchronization.
+type DatabaseSummary struct {
+	// Host is the host name including the namespace
+	Host string `json:"host"`
+	// Port is the port of the mongo database
+	Port string `json:"port"`
+	// Database is the name of the database
+	Database string `json:"database"`
+}
+
+// SynchronizationEventData represents the data for a synchronized or synchronization failed event
+type SynchronizationEventData struct {
+	// JobID is the id of the synchronization job
+	JobID string `json:"jobId"`
+	// Project is the name of the project
+	Project string `json:"project"`
+	// Stage is the name of the stage
+	Stage string `json:"stage"`
+	// Service is the name of the service
+	Service string `json:"service"`
+	// Source is the database the data was dumped from
+	Source DatabaseSummary `json:"source"`
+	// Target is the database the data was restored to
+	Target DatabaseSummary `json:"target"`
+	// Collections are the synchronized collections, empty if all collections were synchronized
+	Collections []string `json:"collections"`
+	// Duration is the time the synchronization took
+	Duration string `json:"duration"`
+	// Error contains the reason of a failed synchronization
+	Error string `json:"error,omitempty"`
+}
+
+// getSynchronizationEventData builds the event data from the configuration change
+// event, the database information and the result of the synchronization.
+func getSynchronizationEventData(jobID string, e *keptnevents.ConfigurationChangeEventData, dbInfo *DatabaseInfo,
+	duration time.Duration, syncErr error) SynchronizationEventData {
+
+	data := SynchronizationEventData{
+		JobID:       jobID,
+		Project:     e.Project,
+		Stage:       e.Stage,
+		Service:     e.Service,
+		Collections: []string{},
+		Duration:    duration.String(),
+	}
+	if dbInfo != nil {
+		data.Source = DatabaseSummary{Host: dbInfo.sourceHost, Port: dbInfo.port, Database: dbInfo.sourceDB}
+		data.Target = DatabaseSummary{Host: dbInfo.targetHost, Port: dbInfo.getTargetPort(), Database: dbInfo.targetDB}
+		data.Collections = append(data.Collections, dbInfo.collections...)
+	}
+	if syncErr != nil {
+		data.Error = syncErr.Error()
+	}
+	return data
+}
+
+// sendSynchronizationEvent sends a synchronized event, or a synchronization failed
+// event if syncErr is set, to the event broker.
+func sendSynchronizationEvent(shkeptncontext string, jobID string, e *keptnevents.ConfigurationChangeEventData,
+	dbInfo *DatabaseInfo, duration time.Duration, syncErr error) error {
+
+	eventType := SynchronizedEventType
+	if syncErr != nil {
+		eventType = SynchronizationFailedEventType
+	}
+	return sendEvent(shkeptncontext, eventType, getSynchronizationEventData(jobID, e, dbInfo, duration, syncErr))
+}
+
+// sendEvent sends a cloud event with the given type and data to the event
+// broker. Sending fails if the broker does not respond within eventTimeout.
+func sendEvent(shkeptncontext string, eventType string, data interface{}) error {
+	source, _ := url.Parse(eventSource)
+	contentType := "application/json"
+
+	event := cloudevents.Event{
+		Context: cloudevents.EventContextV02{
+			ID:          uuid.New().String(),
+			Time:        &types.Timestamp{Time: time.Now()},
+			Type:        eventType,
+			Source:      types.URLRef{URL: *source},
+			ContentType: &contentType,
+			Extensions:  map[string]interface{}{"shkeptncontext": shkeptncontext},
+		}.AsV02(),
+		Data: data,
+	}
+
+	c, err := getEventClient()
+	if err != nil {
+		return err
+	}
+	// the event is also sent for cancelled jobs, so the timeout is not
+	// derived from the context of the job
+	ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+	defer cancel()
+	if _, _, err := c.Send(ctx, event); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("failed to send cloudevent: event broker did not respond within %s", eventTimeout)
+		}
+		return fmt.Errorf("failed to send cloudevent: %s", err.Error())
+	}
+	return nil
+}
+
+// getEventClient returns a client sending cloud events to the event broker
+// configured in the environment.
+func getEventClient() (client.Client, error) {
+	endpoint := os.Getenv(eventbroker)
+	if endpoint == "" {
+		return nil, errors.New("No event broker configured")
+	}
+
+	t, err := cloudeventshttp.New(
+		cloudeventshttp.WithTarget(endpoint),
+		cloudeventshttp.WithEncoding(cloudeventshttp.StructuredV02),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transport: %s", err.Error())
+	}
+	return client.New(t)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	keptnevents "github.com/keptn/go-utils/pkg/events"
+)
+
+// receivedEvent is the part of a structured cloud event checked by the tests.
+type receivedEvent struct {
+	Type           string                   `json:"type"`
+	Shkeptncontext string                   `json:"shkeptncontext"`
+	Data           SynchronizationEventData `json:"data"`
+}
+
+// startEventBroker starts a local stand-in for the event broker which passes
+// every received event to the returned channel.
+func startEventBroker(t *testing.T) (*httptest.Server, chan receivedEvent) {
+	events := make(chan receivedEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Error message: %s", err)
+		}
+		var event receivedEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("Error message: %s", err)
+		}
+		events <- event
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	os.Setenv(eventbroker, server.URL)
+	return server, events
+}
+
+// TestSendSynchronizedEvent sends a synchronized event to a local event broker.
+func TestSendSynchronizedEvent(t *testing.T) {
+	fmt.Println("\n>> TestSendSynchronizedEvent()")
+
+	server, events := startEventBroker(t)
+	defer server.Close()
+
+	e := &keptnevents.ConfigurationChangeEventData{Project: "sockshop", Stage: "dev", Service: "carts"}
+	dbInfo := &DatabaseInfo{
+		sourceDB:    "carts-db",
+		targetDB:    "carts-db-canary",
+		sourceHost:  "carts-db.sockshop-dev",
+		targetHost:  "carts-db-canary.sockshop-dev",
+		port:        "27017",
+		collections: []string{"items"},
+	}
+	if err := sendSynchronizationEvent("ctx-1", "job-1", e, dbInfo, 3*time.Second, nil); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+
+	event := <-events
+	if event.Type != SynchronizedEventType {
+		t.Errorf("unexpected event type, expected: %s, found: %s", SynchronizedEventType, event.Type)
+	}
+	if event.Shkeptncontext != "ctx-1" {
+		t.Errorf("unexpected shkeptncontext, expected: ctx-1, found: %s", event.Shkeptncontext)
+	}
+	if event.Data.Source.Database != "carts-db" || event.Data.Target.Host != "carts-db-canary.sockshop-dev" {
+		t.Errorf("unexpected database information: %+v", event.Data)
+	}
+	if len(event.Data.Collections) != 1 || event.Data.Collections[0] != "items" {
+		t.Errorf("unexpected collections: %v", event.Data.Collections)
+	}
+	if event.Data.JobID != "job-1" || event.Data.Duration != "3s" || event.Data.Error != "" {
+		t.Errorf("unexpected result: %+v", event.Data)
+	}
+}
+
+// TestSendSynchronizationFailedEvent sends a synchronization failed event
+// for a service without configuration.
+func TestSendSynchronizationFailedEvent(t *testing.T) {
+	fmt.Println("\n>> TestSendSynchronizationFailedEvent()")
+
+	server, events := startEventBroker(t)
+	defer server.Close()
+
+	e := &keptnevents.ConfigurationChangeEventData{Project: "sockshop", Stage: "dev", Service: "orders"}
+	syncErr := errors.New("No source database configured for ORDERS")
+	if err := sendSynchronizationEvent("ctx-2", "job-2", e, nil, time.Second, syncErr); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+
+	event := <-events
+	if event.Type != SynchronizationFailedEventType {
+		t.Errorf("unexpected event type, expected: %s, found: %s", SynchronizationFailedEventType, event.Type)
+	}
+	if event.Data.Error != syncErr.Error() {
+		t.Errorf("unexpected error, expected: %s, found: %s", syncErr, event.Data.Error)
+	}
+	if event.Data.Service != "orders" || event.Data.Project != "sockshop" {
+		t.Errorf("unexpected event data: %+v", event.Data)
+	}
+}
+
+// TestSendEventTimeout sends an event to an event broker which does not
+// respond.
+func TestSendEventTimeout(t *testing.T) {
+	fmt.Println("\n>> TestSendEventTimeout()")
+
+	defer func(timeout time.Duration) { eventTimeout = timeout }(eventTimeout)
+	eventTimeout = 100 * time.Millisecond
+	blocked := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blocked
+	}))
+	defer server.Close()
+	defer close(blocked)
+	os.Setenv(eventbroker, server.URL)
+
+	e := &keptnevents.ConfigurationChangeEventData{Project: "sockshop", Stage: "dev", Service: "carts"}
+	start := time.Now()
+	err := sendSynchronizationEvent("ctx-3", "job-3", e, nil, time.Second, nil)
+	assertError(t, "failed to send cloudevent: event broker did not respond within 100ms", err)
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("expected the event to time out, took %s", time.Since(start))
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// minSampleVersion is the first MongoDB version with $rand, which selects
+// the sampled documents.
+var minSampleVersion = []int{4, 4, 2}
+
+// CollectionFilter selects the documents of a collection which are
+// synchronized.
+type CollectionFilter struct {
+	// Query is a filter as extended JSON, e.g. {"status": "active"}
+	Query string `yaml:"query"`
+	// Limit is the maximum number of dumped documents
+	Limit int64 `yaml:"limit"`
+	// Sample is the percentage of randomly selected documents
+	Sample float64 `yaml:"sample"`
+
+	// maxID is the _id of the last document within the limit, which bounds
+	// the query of the dump
+	maxID interface{}
+}
+
+// validate checks the query, the limit and the sample percentage.
+func (f CollectionFilter) validate() error {
+	if _, err := f.getQuery(); err != nil {
+		return err
+	}
+	if f.Limit < 0 {
+		return fmt.Errorf("invalid limit %d", f.Limit)
+	}
+	if f.Sample < 0 || f.Sample > 100 {
+		return fmt.Errorf("invalid sample percentage %v", f.Sample)
+	}
+	return nil
+}
+
+// isSampled returns true if only a part of the matching documents is selected.
+func (f CollectionFilter) isSampled() bool {
+	return f.Sample > 0 && f.Sample < 100
+}
+
+// getQuery parses the query, an empty query matches all documents.
+func (f CollectionFilter) getQuery() (bson.D, error) {
+	query := bson.D{}
+	if f.Query == "" {
+		return query, nil
+	}
+	if err := bson.UnmarshalExtJSON([]byte(f.Query), false, &query); err != nil {
+		return nil, fmt.Errorf("invalid query %s: %s", f.Query, err.Error())
+	}
+	return query, nil
+}
+
+// getDumpQuery returns the query passed to mongodump. The limit adds a
+// condition on the _id of the last document within the limit, sampling a
+// condition on $rand, which requires MongoDB 4.4.2 or later. The result is
+// empty if all documents are dumped.
+func (f CollectionFilter) getDumpQuery() (string, error) {
+	if f.Query == "" && !f.isSampled() && f.maxID == nil {
+		return "", nil
+	}
+	query, err := f.getQuery()
+	if err != nil {
+		return "", err
+	}
+	conditions := bson.A{query}
+	if f.maxID != nil {
+		conditions = append(conditions, bson.D{{Key: "_id", Value: bson.D{{Key: "$lte", Value: f.maxID}}}})
+	}
+	if f.isSampled() {
+		conditions = append(conditions, bson.D{{Key: "$expr", Value: bson.D{{Key: "$lt", Value: bson.A{
+			bson.D{{Key: "$rand", Value: bson.D{}}}, f.Sample / 100,
+		}}}}})
+	}
+	if len(conditions) > 1 {
+		query = bson.D{{Key: "$and", Value: conditions}}
+	}
+	content, err := bson.MarshalExtJSON(query, true, false)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// getExpectedCount returns the number of dumped documents for count
+// matching documents. If the documents are sampled, the result is an upper
+// bound which is marked by isMax.
+func (f CollectionFilter) getExpectedCount(count int64) (expected int64, isMax bool) {
+	if f.Limit > 0 && count > f.Limit {
+		count = f.Limit
+	}
+	return count, f.isSampled()
+}
+
+// hasLimit returns true if one of the filters limits the documents.
+func hasLimit(filters map[string]CollectionFilter) bool {
+	for _, filter := range filters {
+		if filter.Limit > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// boundFilters prepares the filters of the dumped collections. mongodump
+// has no limit, so the _id of the last document within the limit of a
+// collection is looked up and added to the query of its dump, and the
+// documents above the limit are never dumped. With sampling, the limit
+// selects the documents which are sampled. Sampling fails if the source
+// database runs a MongoDB version without $rand.
+func boundFilters(ctx context.Context, dbInfo *DatabaseInfo) error {
+	if len(dbInfo.filters) == 0 {
+		return nil
+	}
+	db, err := getDatabase(ctx, dbInfo, "source")
+	if err != nil {
+		return err
+	}
+	defer db.Client().Disconnect(context.Background())
+
+	for _, filter := range dbInfo.filters {
+		if filter.isSampled() {
+			if err := checkSampleVersion(ctx, db); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	// the filters of the configuration are shared between the jobs
+	filters := make(map[string]CollectionFilter, len(dbInfo.filters))
+	for col, filter := range dbInfo.filters {
+		if filter.Limit > 0 {
+			maxID, err := getMaxID(ctx, db.Collection(col), filter)
+			if err != nil {
+				return fmt.Errorf("failed to find the last document within the limit of collection %s: %s", col, err.Error())
+			}
+			filter.maxID = maxID
+		}
+		filters[col] = filter
+	}
+	dbInfo.filters = filters
+	return nil
+}
+
+// getMaxID returns the _id of the last document within the limit of the
+// filter in the order of _id, or nil if fewer documents match the query.
+func getMaxID(ctx context.Context, col *mongo.Collection, filter CollectionFilter) (interface{}, error) {
+	query, err := filter.getQuery()
+	if err != nil {
+		return nil, err
+	}
+	opts := options.FindOne().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetSkip(filter.Limit - 1).
+		SetProjection(bson.D{{Key: "_id", Value: 1}})
+	var doc struct {
+		ID interface{} `bson:"_id"`
+	}
+	err = col.FindOne(ctx, query, opts).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc.ID, nil
+}
+
+// checkSampleVersion returns an error if the MongoDB version of db has no
+// $rand.
+func checkSampleVersion(ctx context.Context, db *mongo.Database) error {
+	var info struct {
+		Version      string `bson:"version"`
+		VersionArray []int  `bson:"versionArray"`
+	}
+	if err := db.RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&info); err != nil {
+		return fmt.Errorf("failed to get the version of the source database: %s", err.Error())
+	}
+	if !isVersionAtLeast(info.VersionArray, minSampleVersion) {
+		return fmt.Errorf("sampling requires MongoDB 4.4.2 or later, the source database runs %s", info.Version)
+	}
+	return nil
+}
+
+// isVersionAtLeast returns true if the version is equal to or later than
+// min.
+func isVersionAtLeast(version []int, min []int) bool {
+	for i, m := range min {
+		v := 0
+		if i < len(version) {
+			v = version[i]
+		}
+		if v != m {
+			return v > m
+		}
+	}
+	return true
+}
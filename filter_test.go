@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestCollectionFilterQuery checks the query passed to mongodump and the
+// expected number of documents.
+func TestCollectionFilterQuery(t *testing.T) {
+	fmt.Println("\n>> TestCollectionFilterQuery()")
+
+	filter := CollectionFilter{Query: `{"price": {"$gt": 10}}`, Limit: 100, Sample: 10}
+	query, err := filter.getDumpQuery()
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	expected := `{"$and":[{"price":{"$gt":{"$numberInt":"10"}}},{"$expr":{"$lt":[{"$rand":{}},{"$numberDouble":"0.1"}]}}]}`
+	if query != expected {
+		t.Errorf("unexpected query, expected: %s, found: %s", expected, query)
+	}
+	if count, isMax := filter.getExpectedCount(250); count != 100 || !isMax {
+		t.Errorf("unexpected expected count: %d, %v", count, isMax)
+	}
+
+	if query, _ := (CollectionFilter{Limit: 10}).getDumpQuery(); query != "" {
+		t.Errorf("expected no query, found: %s", query)
+	}
+	if count, isMax := (CollectionFilter{Sample: 100}).getExpectedCount(250); count != 250 || isMax {
+		t.Errorf("unexpected expected count: %d, %v", count, isMax)
+	}
+}
+
+// TestLimitDump bounds the dump query of a limited collection by the _id of
+// the last document within the limit and verifies the dump against a source
+// with more documents.
+func TestLimitDump(t *testing.T) {
+	fmt.Println("\n>> TestLimitDump()")
+
+	filter := CollectionFilter{Query: `{"price": {"$gt": 10}}`, Limit: 2, maxID: int32(7)}
+	query, err := filter.getDumpQuery()
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	expected := `{"$and":[{"price":{"$gt":{"$numberInt":"10"}}},{"_id":{"$lte":{"$numberInt":"7"}}}]}`
+	if query != expected {
+		t.Errorf("unexpected query, expected: %s, found: %s", expected, query)
+	}
+
+	dumpDir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(dumpDir)
+	dbInfo := &DatabaseInfo{
+		sourceDB:    "trades-db",
+		dumpDir:     dumpDir,
+		collections: []string{"trades"},
+		filters:     map[string]CollectionFilter{"trades": filter},
+	}
+	dir := filepath.Join(dumpDir, dbInfo.sourceDB)
+	os.MkdirAll(dir, 0755)
+	writeDumpFile(t, dir, "trades", 2, dumpMetadata{Indexes: []bson.D{}}, true)
+
+	dump, err := getDumpState(dbInfo)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	source := map[string]*collectionState{"trades": {Indexes: map[string]string{}}}
+	source["trades"].Count, source["trades"].MaxCount = dbInfo.filters["trades"].getExpectedCount(5)
+	report := compareStates("dump", "source", source, "dump", dump, dbInfo.collections, false)
+	if err := report.err(); err != nil {
+		t.Errorf("Error message: %s", err)
+	}
+}
+
+// TestLimitSampleVersion checks the minimum MongoDB version of sampling.
+func TestLimitSampleVersion(t *testing.T) {
+	fmt.Println("\n>> TestLimitSampleVersion()")
+
+	for _, c := range []struct {
+		version  []int
+		expected bool
+	}{
+		{[]int{4, 4, 2, 0}, true},
+		{[]int{4, 4, 10}, true},
+		{[]int{5, 0}, true},
+		{[]int{4, 4, 1, 0}, false},
+		{[]int{4, 2, 12}, false},
+		{[]int{}, false},
+	} {
+		if isVersionAtLeast(c.version, minSampleVersion) != c.expected {
+			t.Errorf("unexpected result for version %v, expected: %v", c.version, c.expected)
+		}
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/cloudevents/sdk-go v0.10.0
 	github.com/golang/groupcache v0.0.0-20191002201903-404acd9df4cc // indirect
 	github.com/golang/snappy v0.0.0-20190904063534-ff6b7dc882cf // indirect
+	github.com/google/uuid v1.1.1
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/keptn/go-utils v0.3.0
 	github.com/mongodb/mongo-tools v0.0.0-20191008165040-976b41822808
@@ -20,4 +21,5 @@ require (
 	go.uber.org/zap v1.11.0 // indirect
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e // indirect
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
+	gopkg.in/yaml.v2 v2.2.4
 )
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+
+	// checkTimeout limits each check of a dependency
+	checkTimeout = 5 * time.Second
+)
+
+// The status of a check.
+const (
+	CheckOK      = "ok"
+	CheckFailed  = "failed"
+	CheckSkipped = "skipped"
+)
+
+// started is the start time of the process.
+var started = time.Now()
+
+// DependencyStatus is the result of the check of a dependency.
+type DependencyStatus struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Message  string `json:"message,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// HealthReport is the body of the health and readiness endpoints. Its
+// status is failed if any dependency failed.
+type HealthReport struct {
+	Status       string             `json:"status"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// healthCheck checks a dependency, an error fails the check and
+// errCheckSkipped skips it.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) (string, error)
+}
+
+// errCheckSkipped is returned by checks which do not apply.
+var errCheckSkipped = errors.New("skipped")
+
+// handleHealth serves GET /healthz, which reports that the process is
+// alive. It does not check any dependency, so a failing database does not
+// restart the service.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Message: "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, HealthReport{Status: CheckOK, Dependencies: []DependencyStatus{
+		{Name: "process", Status: CheckOK, Message: "up since " + started.Format(time.RFC3339)},
+	}})
+}
+
+// handleReady serves GET /readyz, which checks that the service is not
+// shutting down, the configuration is loaded, the dump directories are
+// writable and the configuration service is reachable. With ?deep=true, every configured source and target database is
+// pinged as well. The status code is 503 if a check failed.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Message: "method not allowed"})
+		return
+	}
+	checks := []healthCheck{{name: "scheduler", check: checkScheduler}, {name: "config", check: checkConfig}}
+	dirs := getDumpDirs()
+	if len(dirs) == 0 {
+		checks = append(checks, healthCheck{name: "dumpDir", check: func(ctx context.Context) (string, error) {
+			return "", errors.New("DUMP_DIR is not set")
+		}})
+	}
+	for _, dir := range dirs {
+		dir := dir
+		checks = append(checks, healthCheck{name: "dumpDir " + dir, check: func(ctx context.Context) (string, error) {
+			return checkDumpDir(dir)
+		}})
+	}
+	checks = append(checks, healthCheck{name: "configurationService", check: func(ctx context.Context) (string, error) {
+		return checkURL(ctx, os.Getenv(configservice))
+	}})
+	if r.URL.Query().Get("deep") == "true" {
+		checks = append(checks, getDatabaseChecks(syncConfig.getServices())...)
+	}
+
+	report := runChecks(r.Context(), checks)
+	status := http.StatusOK
+	if report.Status != CheckOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// runChecks runs the checks concurrently, each limited by checkTimeout.
+func runChecks(ctx context.Context, checks []healthCheck) HealthReport {
+	report := HealthReport{Status: CheckOK, Dependencies: make([]DependencyStatus, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c healthCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+			start := time.Now()
+			message, err := c.check(ctx)
+			result := DependencyStatus{Name: c.name, Status: CheckOK, Message: message, Duration: time.Since(start).String()}
+			if err == errCheckSkipped {
+				result.Status = CheckSkipped
+			} else if err != nil {
+				result.Status, result.Message = CheckFailed, err.Error()
+			}
+			report.Dependencies[i] = result
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, result := range report.Dependencies {
+		if result.Status == CheckFailed {
+			report.Status = CheckFailed
+		}
+	}
+	return report
+}
+
+// checkScheduler checks that the scheduler accepts jobs, i.e. the service
+// is not shutting down.
+func checkScheduler(ctx context.Context) (string, error) {
+	if syncScheduler.isClosed() {
+		return "", errors.New("service is shutting down")
+	}
+	return "", nil
+}
+
+// checkConfig checks that the sync configuration is loaded. A failed reload
+// is reported, but the previous configuration is still used.
+func checkConfig(ctx context.Context) (string, error) {
+	syncConfig.mu.RLock()
+	defer syncConfig.mu.RUnlock()
+	if !syncConfig.loaded {
+		return "", errors.New("sync configuration is not loaded")
+	}
+	if syncConfig.reloadErr != nil {
+		return fmt.Sprintf("using the previous configuration, reload failed: %s", syncConfig.reloadErr.Error()), nil
+	}
+	if syncConfig.config == nil {
+		return "using environment variables", nil
+	}
+	return fmt.Sprintf("%d services configured in %s", len(syncConfig.config.Services), syncConfig.path), nil
+}
+
+// checkDumpDir checks that a file can be written into the dump directory.
+func checkDumpDir(dir string) (string, error) {
+	f, err := ioutil.TempFile(dir, ".healthz-")
+	if err != nil {
+		return "", fmt.Errorf("dump directory is not writable: %s", err.Error())
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return "", nil
+}
+
+// checkURL checks that a service answers requests. Any response except a
+// server error is accepted, as the root path of a service may not exist.
+func checkURL(ctx context.Context, rawURL string) (string, error) {
+	if rawURL == "" {
+		return "", fmt.Errorf("%s is not set", configservice)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return "", nil
+}
+
+// getDatabaseChecks returns a check per source and target database of the
+// configured services. The host of a database without namespace or
+// connection string depends on the project and stage of the event, so it is
+// skipped if the service is configured for any project or stage.
+func getDatabaseChecks(services []ServiceConfig) []healthCheck {
+	checks := []healthCheck{}
+	for _, sc := range services {
+		key := sc.Service
+		if sc.Project != "" || sc.Stage != "" {
+			key = sc.Project + "/" + sc.Stage + "/" + sc.Service
+		}
+		namespace := ""
+		if sc.Project != "" && sc.Stage != "" {
+			namespace = sc.Project + "-" + sc.Stage
+		}
+		checks = append(checks,
+			getDatabaseCheck("mongodb "+key+" source", sc.Source, namespace),
+			getDatabaseCheck("mongodb "+key+" target", sc.Target, namespace))
+	}
+	return checks
+}
+
+// getDatabaseCheck returns a check which pings a database. It is skipped if
+// the host of the database depends on the event.
+func getDatabaseCheck(name string, dc DatabaseConfig, namespace string) healthCheck {
+	return healthCheck{name: name, check: func(ctx context.Context) (string, error) {
+		if dc.URI == "" && dc.Namespace == "" && namespace == "" {
+			return "namespace depends on the project and stage of the event", errCheckSkipped
+		}
+		host, uri, err := getHostAndURI(dc, namespace)
+		if err != nil {
+			return "", err
+		}
+		return host, pingDatabase(ctx, uri)
+	}}
+}
+
+// pingDatabase connects to a database and pings it.
+func pingDatabase(ctx context.Context, uri string) error {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+	return client.Ping(ctx, nil)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// getHealthReport requests a health endpoint.
+func getHealthReport(t *testing.T, url string) (int, HealthReport) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer resp.Body.Close()
+	var report HealthReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	return resp.StatusCode, report
+}
+
+// TestHealthEndpoints checks the liveness and the readiness of the service.
+func TestHealthEndpoints(t *testing.T) {
+	fmt.Println("\n>> TestHealthEndpoints()")
+
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	configService := httptest.NewServer(http.NotFoundHandler())
+	defer configService.Close()
+
+	dumpDir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(dumpDir)
+	defer os.Setenv("DUMP_DIR", os.Getenv("DUMP_DIR"))
+	defer os.Setenv(configservice, os.Getenv(configservice))
+	os.Setenv("DUMP_DIR", dumpDir)
+	os.Setenv(configservice, configService.URL)
+	defer func(s *configStore) { syncConfig = s }(syncConfig)
+	syncConfig = &configStore{}
+
+	if status, report := getHealthReport(t, server.URL+healthPath); status != http.StatusOK || report.Status != CheckOK {
+		t.Errorf("unexpected health report %d: %+v", status, report)
+	}
+
+	// the configuration is not loaded yet
+	status, report := getHealthReport(t, server.URL+readyPath)
+	if status != http.StatusServiceUnavailable || report.Status != CheckFailed || report.Dependencies[1].Status != CheckFailed {
+		t.Errorf("unexpected readiness report %d: %+v", status, report)
+	}
+
+	syncConfig.init("")
+	status, report = getHealthReport(t, server.URL+readyPath)
+	if status != http.StatusOK || report.Status != CheckOK || len(report.Dependencies) != 4 {
+		t.Errorf("unexpected readiness report %d: %+v", status, report)
+	}
+
+	configService.Close()
+	status, report = getHealthReport(t, server.URL+readyPath)
+	if status != http.StatusServiceUnavailable || report.Dependencies[3].Name != "configurationService" || report.Dependencies[3].Status != CheckFailed {
+		t.Errorf("unexpected readiness report %d: %+v", status, report)
+	}
+
+	// the service is not ready while it is shutting down
+	defer func(s *scheduler) { syncScheduler = s }(syncScheduler)
+	syncScheduler = newScheduler(PolicyQueue)
+	syncScheduler.shutdown(context.Background())
+	status, report = getHealthReport(t, server.URL+readyPath)
+	if status != http.StatusServiceUnavailable || report.Dependencies[0].Name != "scheduler" || report.Dependencies[0].Status != CheckFailed {
+		t.Errorf("unexpected readiness report %d: %+v", status, report)
+	}
+}
+
+// TestDatabaseChecks pings the configured databases.
+func TestDatabaseChecks(t *testing.T) {
+	fmt.Println("\n>> TestDatabaseChecks()")
+
+	services := []ServiceConfig{
+		{Service: "carts", Source: DatabaseConfig{Host: "carts-db", Port: "27017"}, Target: DatabaseConfig{URI: "mongodb://127.0.0.1:1"}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	report := runChecks(ctx, getDatabaseChecks(services))
+
+	if report.Status != CheckFailed || len(report.Dependencies) != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if source := report.Dependencies[0]; source.Name != "mongodb carts source" || source.Status != CheckSkipped {
+		t.Errorf("unexpected status: %+v", source)
+	}
+	if target := report.Dependencies[1]; target.Name != "mongodb carts target" || target.Status != CheckFailed {
+		t.Errorf("unexpected status: %+v", target)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	historyPath = "/history"
+
+	// historyFileName is the name of the history file in DUMP_DIR
+	historyFileName = "job-history.jsonl"
+
+	// defaultHistoryLimit and maxHistoryLimit limit the records of a query
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// HistoryRecord is the record of a finished job: the job with its phases,
+// verification reports and errors, and the databases it synchronized.
+type HistoryRecord struct {
+	Job `bson:",inline"`
+	// Source is the database the data was dumped from, or the database of
+	// the restored snapshot
+	Source DatabaseSummary `json:"source"`
+	// Target is the database the data was restored to
+	Target DatabaseSummary `json:"target"`
+	// Collections are the synchronized collections, empty if all collections
+	// were synchronized
+	Collections []string `json:"collections"`
+}
+
+// HistoryQuery selects history records. Empty fields match every record,
+// From and To limit the time the jobs finished.
+type HistoryQuery struct {
+	Project string
+	Stage   string
+	Service string
+	State   JobState
+	// Target is the name of the target database
+	Target string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+// matches checks if a record is selected by the query.
+func (q *HistoryQuery) matches(record *HistoryRecord) bool {
+	if (q.Project != "" && record.Project != q.Project) ||
+		(q.Stage != "" && record.Stage != q.Stage) ||
+		(q.Service != "" && record.Service != q.Service) ||
+		(q.State != "" && record.State != q.State) ||
+		(q.Target != "" && record.Target.Database != q.Target) {
+		return false
+	}
+	if record.Finished == nil {
+		return q.From.IsZero() && q.To.IsZero()
+	}
+	return (q.From.IsZero() || !record.Finished.Before(q.From)) && (q.To.IsZero() || record.Finished.Before(q.To))
+}
+
+// HistoryStore persists the records of finished jobs.
+type HistoryStore interface {
+	// Append adds the record of a finished job.
+	Append(ctx context.Context, record *HistoryRecord) error
+	// Query returns the records selected by the query, the most recently
+	// finished job first.
+	Query(ctx context.Context, query HistoryQuery) ([]HistoryRecord, error)
+}
+
+// jobHistory is the history store, it is nil if no store is configured.
+var jobHistory HistoryStore
+
+// newHistoryStore returns the history store of the environment: a MongoDB
+// collection if HISTORY_MONGODB_URI is set, otherwise the history file,
+// which defaults to job-history.jsonl in DUMP_DIR. It is nil if neither is
+// set.
+func newHistoryStore(ctx context.Context, env envConfig) (HistoryStore, error) {
+	if env.HistoryMongoURI != "" {
+		return newMongoHistory(ctx, env.HistoryMongoURI, env.HistoryMongoDatabase, env.HistoryMongoCollection)
+	}
+	path := env.HistoryFile
+	if path == "" {
+		dumpDir := os.Getenv("DUMP_DIR")
+		if dumpDir == "" {
+			return nil, nil
+		}
+		path = filepath.Join(dumpDir, historyFileName)
+	}
+	return &fileHistory{path: path}, nil
+}
+
+// recordJob appends the record of a finished job to the history. Errors are
+// logged, as they do not affect the job.
+func recordJob(stdLogger *Logger, jobID string, dbInfo *DatabaseInfo) {
+	if jobHistory == nil {
+		return
+	}
+	job, ok := jobs.get(jobID)
+	if !ok {
+		return
+	}
+	record := &HistoryRecord{Job: job, Collections: []string{}}
+	if dbInfo != nil {
+		record.Source = DatabaseSummary{Host: dbInfo.sourceHost, Port: dbInfo.port, Database: dbInfo.sourceDB}
+		record.Target = DatabaseSummary{Host: dbInfo.targetHost, Port: dbInfo.getTargetPort(), Database: dbInfo.targetDB}
+		record.Collections = append(record.Collections, dbInfo.collections...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := jobHistory.Append(ctx, record); err != nil {
+		stdLogger.Error(fmt.Sprintf("Failed to record job in history: %s", err.Error()))
+	}
+}
+
+// fileHistory appends the records as JSON lines to a file.
+type fileHistory struct {
+	mu   sync.Mutex
+	path string
+}
+
+// Append writes the record as a line at the end of the file.
+func (h *fileHistory) Append(ctx context.Context, record *HistoryRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Query reads the whole file. Lines which can not be parsed, e.g. a line
+// cut off by a crash, are skipped.
+func (h *fileHistory) Query(ctx context.Context, query HistoryQuery) ([]HistoryRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	records := []HistoryRecord{}
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			record := HistoryRecord{}
+			if json.Unmarshal(line, &record) == nil && query.matches(&record) {
+				records = append(records, record)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Finished != nil && (records[j].Finished == nil || records[i].Finished.After(*records[j].Finished))
+	})
+	if len(records) > query.Limit {
+		records = records[:query.Limit]
+	}
+	return records, nil
+}
+
+// mongoHistory stores the records as documents of a MongoDB collection.
+type mongoHistory struct {
+	collection *mongo.Collection
+}
+
+// newMongoHistory connects to the database of the history.
+func newMongoHistory(ctx context.Context, uri string, database string, collection string) (*mongoHistory, error) {
+	if database == "" || collection == "" {
+		return nil, errors.New("the history database and collection must be set")
+	}
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the history database: %s", err.Error())
+	}
+	return &mongoHistory{collection: client.Database(database).Collection(collection)}, nil
+}
+
+// Append inserts the record as document.
+func (h *mongoHistory) Append(ctx context.Context, record *HistoryRecord) error {
+	_, err := h.collection.InsertOne(ctx, record)
+	return err
+}
+
+// Query finds the selected documents, sorted by the time the jobs finished.
+func (h *mongoHistory) Query(ctx context.Context, query HistoryQuery) ([]HistoryRecord, error) {
+	filter := bson.M{}
+	for field, value := range map[string]string{
+		"project": query.Project, "stage": query.Stage, "service": query.Service,
+		"state": string(query.State), "target.database": query.Target,
+	} {
+		if value != "" {
+			filter[field] = value
+		}
+	}
+	finished := bson.M{}
+	if !query.From.IsZero() {
+		finished["$gte"] = query.From
+	}
+	if !query.To.IsZero() {
+		finished["$lt"] = query.To
+	}
+	if len(finished) > 0 {
+		filter["finished"] = finished
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "finished", Value: -1}}).SetLimit(int64(query.Limit))
+	cursor, err := h.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	records := []HistoryRecord{}
+	for cursor.Next(ctx) {
+		record := HistoryRecord{}
+		if err := cursor.Decode(&record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, cursor.Err()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// newHistoryRecord returns the record of a job of a service finished at the
+// given time.
+func newHistoryRecord(id string, service string, state JobState, finished time.Time) *HistoryRecord {
+	return &HistoryRecord{
+		Job:         Job{ID: id, Project: "sockshop", Stage: "dev", Service: service, State: state, Finished: &finished},
+		Target:      DatabaseSummary{Host: service + "-db-canary", Port: "27017", Database: service + "-db-canary"},
+		Collections: []string{},
+	}
+}
+
+// TestHistoryFile appends records to the history file and queries them.
+func TestHistoryFile(t *testing.T) {
+	fmt.Println("\n>> TestHistoryFile()")
+
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	history := &fileHistory{path: filepath.Join(dir, historyFileName)}
+	ctx := context.Background()
+
+	if records, err := history.Query(ctx, HistoryQuery{Limit: 10}); err != nil || len(records) != 0 {
+		t.Errorf("expected an empty history, found: %v, %v", records, err)
+	}
+
+	start := time.Date(2019, 11, 4, 10, 0, 0, 0, time.UTC)
+	for i, record := range []*HistoryRecord{
+		newHistoryRecord("1", "carts", JobDone, start),
+		newHistoryRecord("2", "orders", JobFailed, start.Add(time.Hour)),
+		newHistoryRecord("3", "carts", JobFailed, start.Add(2*time.Hour)),
+	} {
+		if err := history.Append(ctx, record); err != nil {
+			t.Fatalf("Error message: %s", err)
+		}
+		// a line cut off by a crash is skipped
+		if i == 1 {
+			f, _ := os.OpenFile(history.path, os.O_APPEND|os.O_WRONLY, 0600)
+			f.WriteString(`{"id":"4","serv` + "\n")
+			f.Close()
+		}
+	}
+
+	tests := []struct {
+		query    HistoryQuery
+		expected string
+	}{
+		{HistoryQuery{Limit: 10}, "[3 2 1]"},
+		{HistoryQuery{Limit: 2}, "[3 2]"},
+		{HistoryQuery{Service: "carts", Limit: 10}, "[3 1]"},
+		{HistoryQuery{State: JobFailed, Limit: 10}, "[3 2]"},
+		{HistoryQuery{Target: "orders-db-canary", Limit: 10}, "[2]"},
+		{HistoryQuery{From: start.Add(time.Hour), Limit: 10}, "[3 2]"},
+		{HistoryQuery{From: start, To: start.Add(time.Hour), Limit: 10}, "[1]"},
+		{HistoryQuery{Stage: "prod", Limit: 10}, "[]"},
+	}
+	for _, test := range tests {
+		records, err := history.Query(ctx, test.query)
+		if err != nil {
+			t.Fatalf("Error message: %s", err)
+		}
+		ids := []string{}
+		for _, record := range records {
+			ids = append(ids, record.ID)
+		}
+		if fmt.Sprint(ids) != test.expected {
+			t.Errorf("unexpected records of %+v, expected: %s, found: %v", test.query, test.expected, ids)
+		}
+	}
+}
+
+// TestHistoryRecordBSON checks that the fields of the job are stored at the
+// top level of a history document, so they can be filtered.
+func TestHistoryRecordBSON(t *testing.T) {
+	fmt.Println("\n>> TestHistoryRecordBSON()")
+
+	record := newHistoryRecord("1", "carts", JobDone, time.Now().UTC().Truncate(time.Millisecond))
+	record.Phases = []JobPhase{{State: JobDumping, Started: record.Finished.Add(-time.Second), Duration: "1s"}}
+	doc, err := bson.Marshal(record)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	raw := bson.Raw(doc)
+	if service, ok := raw.Lookup("service").StringValueOK(); !ok || service != "carts" {
+		t.Errorf("expected the service at the top level: %s", raw)
+	}
+	if database, ok := raw.Lookup("target", "database").StringValueOK(); !ok || database != "carts-db-canary" {
+		t.Errorf("expected the target database: %s", raw)
+	}
+
+	decoded := HistoryRecord{}
+	if err := bson.Unmarshal(doc, &decoded); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if decoded.ID != "1" || !decoded.Finished.Equal(*record.Finished) || len(decoded.Phases) != 1 || decoded.State != JobDone {
+		t.Errorf("unexpected record: %+v", decoded)
+	}
+}
+
+// TestHistoryAPI queries the history through the REST endpoint.
+func TestHistoryAPI(t *testing.T) {
+	fmt.Println("\n>> TestHistoryAPI()")
+
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	defer func(h HistoryStore) { jobHistory = h }(jobHistory)
+	jobHistory = nil
+	if resp, err := http.Get(server.URL + historyPath); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected the history not to be configured: %v, %v", resp, err)
+	}
+
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	jobHistory = &fileHistory{path: filepath.Join(dir, historyFileName)}
+
+	defer func(r *jobRegistry) { jobs = r }(jobs)
+	jobs = newJobRegistry()
+	job := jobs.create("ctx-1", "event-1")
+	jobs.setService(job.ID, "sockshop", "dev", "carts")
+	jobs.setSnapshot(job.ID, "snapshot-1")
+	jobs.finish(job.ID, time.Second, nil)
+	recordJob(defaultLogger, job.ID, &DatabaseInfo{targetHost: "carts-db-canary", targetDB: "carts-db-canary", port: "27017"})
+
+	resp, err := http.Get(server.URL + historyPath + "?service=carts&status=done&target=carts-db-canary&from=2019-01-01T00:00:00Z")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	var records []HistoryRecord
+	json.NewDecoder(resp.Body).Decode(&records)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(records) != 1 || records[0].ID != job.ID || records[0].Snapshot != "snapshot-1" {
+		t.Errorf("unexpected records %d: %+v", resp.StatusCode, records)
+	}
+
+	for _, query := range []string{"?from=yesterday", "?limit=0", "?limit=abc"} {
+		resp, err := http.Get(server.URL + historyPath + query)
+		if err != nil {
+			t.Fatalf("Error message: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("unexpected status code of %s, expected: %d, found: %d", query, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
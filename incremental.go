@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+const (
+	// SyncFull is the mode of a job which dumps and restores the database
+	SyncFull = "full"
+	// SyncIncremental is the mode of a job which replays the changes since
+	// the last synchronization
+	SyncIncremental = "incremental"
+
+	// changeStreamIdle is the time without changes after which the replay
+	// is finished
+	changeStreamIdle = 5 * time.Second
+
+	checkpointDir = "checkpoints"
+)
+
+// errFullSyncRequired is returned if the changes since the checkpoint can
+// not be replayed.
+var errFullSyncRequired = errors.New("changes since the last synchronization can not be replayed")
+
+// codes of the errors of a change stream which can not be resumed
+var expiredChangeStreamCodes = map[int32]bool{
+	136: true, // CappedPositionLost
+	280: true, // ChangeStreamFatalError
+	286: true, // ChangeStreamHistoryLost
+}
+
+// checkpoint is the position in the change stream of the source database up
+// to which the target database is synchronized.
+type checkpoint struct {
+	// Source and Collections identify the synchronized data, a checkpoint
+	// of a different configuration is ignored
+	Source      string   `json:"source"`
+	Collections []string `json:"collections"`
+	// ResumeToken is the extended JSON of the last replayed change, if it
+	// is empty the changes since OperationTime are replayed
+	ResumeToken   string              `json:"resumeToken,omitempty"`
+	OperationTime primitive.Timestamp `json:"operationTime"`
+	Created       time.Time           `json:"created"`
+}
+
+// changeEvent is the part of a change stream event which is replayed.
+type changeEvent struct {
+	OperationType string              `bson:"operationType"`
+	ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+	Ns            struct {
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	DocumentKey  bson.D        `bson:"documentKey"`
+	FullDocument bson.RawValue `bson:"fullDocument"`
+}
+
+// incrementalSync replays the changes of the source database since the last
+// synchronization onto the target database. Without a usable checkpoint, a
+// full synchronization is done and the operation time of its start becomes
+// the next checkpoint.
+func incrementalSync(ctx context.Context, jobID string, dbInfo *DatabaseInfo) error {
+	stdLogger := loggerFrom(ctx)
+	cp, err := loadCheckpoint(dbInfo)
+	if err != nil {
+		stdLogger.Error(fmt.Sprintf("Failed to load checkpoint, starting full synchronization: %s", err.Error()))
+	}
+
+	if cp != nil {
+		jobs.setMode(jobID, SyncIncremental, 0)
+		jobs.setState(jobID, JobReplaying)
+		stdLogger.Debug(fmt.Sprintf("start replaying changes since %s", cp.Created))
+		var next *checkpoint
+		var changes int64
+		err := runPhase(ctx, "replay", dbInfo.timeouts.Restore, func(ctx context.Context) (err error) {
+			next, changes, err = replayChanges(ctx, dbInfo, cp)
+			return err
+		})
+		jobs.setMode(jobID, SyncIncremental, changes)
+		switch {
+		case err == nil:
+			stdLogger.Debug(fmt.Sprintf("%d changes replayed", changes))
+			if err := saveCheckpoint(dbInfo, next); err != nil {
+				return fmt.Errorf("Failed to save checkpoint: %s", err.Error())
+			}
+			return recordDocumentCounts(ctx, jobID, dbInfo)
+		case err == errFullSyncRequired:
+			stdLogger.Info(fmt.Sprintf("%s, starting full synchronization", err.Error()))
+		default:
+			return err
+		}
+	}
+
+	jobs.setMode(jobID, SyncFull, 0)
+	start, err := getOperationTime(ctx, dbInfo)
+	if err != nil {
+		return fmt.Errorf("Failed to get operation time of database %s: %s", dbInfo.sourceDB, err.Error())
+	}
+	if err := fullSync(ctx, jobID, dbInfo); err != nil {
+		return err
+	}
+	if err := saveCheckpoint(dbInfo, newCheckpoint(dbInfo, start)); err != nil {
+		return fmt.Errorf("Failed to save checkpoint: %s", err.Error())
+	}
+	return nil
+}
+
+// newCheckpoint returns a checkpoint at the given operation time.
+func newCheckpoint(dbInfo *DatabaseInfo, operationTime primitive.Timestamp) *checkpoint {
+	return &checkpoint{
+		Source:        getCheckpointSource(dbInfo),
+		Collections:   append([]string{}, dbInfo.collections...),
+		OperationTime: operationTime,
+		Created:       time.Now(),
+	}
+}
+
+// getCheckpointSource identifies the source database of a checkpoint by its
+// hosts, replica set and database. The credentials of the connection string
+// are left out, so they are not written to the dump directory and a changed
+// password keeps the checkpoint.
+func getCheckpointSource(dbInfo *DatabaseInfo) string {
+	cs, err := connstring.Parse(dbInfo.getURI("source"))
+	if err != nil {
+		return dbInfo.sourceHost + ":" + dbInfo.port + "/" + dbInfo.sourceDB
+	}
+	source := strings.Join(cs.Hosts, ",") + "/" + dbInfo.sourceDB
+	if cs.ReplicaSet != "" {
+		source += "?replicaSet=" + cs.ReplicaSet
+	}
+	return source
+}
+
+// loadCheckpoint returns the checkpoint of the target database, or nil if
+// there is none or it belongs to a different source or collections.
+func loadCheckpoint(dbInfo *DatabaseInfo) (*checkpoint, error) {
+	content, err := ioutil.ReadFile(dbInfo.checkpointFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := &checkpoint{}
+	if err := json.Unmarshal(content, cp); err != nil {
+		return nil, err
+	}
+	expected := newCheckpoint(dbInfo, cp.OperationTime)
+	if cp.Source != expected.Source || !reflect.DeepEqual(cp.Collections, expected.Collections) {
+		return nil, nil
+	}
+	return cp, nil
+}
+
+// saveCheckpoint writes the checkpoint of the target database.
+func saveCheckpoint(dbInfo *DatabaseInfo, cp *checkpoint) error {
+	content, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dbInfo.checkpointFile), 0755); err != nil {
+		return err
+	}
+	tmp := dbInfo.checkpointFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dbInfo.checkpointFile)
+}
+
+// getOperationTime returns the current operation time of the source
+// database, which is only available on replica sets.
+func getOperationTime(ctx context.Context, dbInfo *DatabaseInfo) (primitive.Timestamp, error) {
+	db, err := getDatabase(ctx, dbInfo, "source")
+	if err != nil {
+		return primitive.Timestamp{}, err
+	}
+	defer db.Client().Disconnect(context.Background())
+
+	var result struct {
+		OperationTime primitive.Timestamp `bson:"operationTime"`
+	}
+	if err := db.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&result); err != nil {
+		return primitive.Timestamp{}, err
+	}
+	if result.OperationTime.T == 0 {
+		return primitive.Timestamp{}, errors.New("incremental synchronization requires a replica set")
+	}
+	return result.OperationTime, nil
+}
+
+// replayChanges applies the changes of the source database since the
+// checkpoint to the target database until the changes of the start of the
+// replay are reached or no change arrives for changeStreamIdle. It returns
+// the next checkpoint and the number of replayed changes.
+func replayChanges(ctx context.Context, dbInfo *DatabaseInfo, cp *checkpoint) (*checkpoint, int64, error) {
+	until, err := getOperationTime(ctx, dbInfo)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	source, err := getDatabase(ctx, dbInfo, "source")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer source.Client().Disconnect(context.Background())
+	target, err := getDatabase(ctx, dbInfo, "target")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer target.Client().Disconnect(context.Background())
+
+	stream, err := watchChanges(ctx, source, dbInfo.collections, cp)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer stream.Close(context.Background())
+
+	var changes int64
+	for {
+		nextCtx, cancel := context.WithTimeout(ctx, changeStreamIdle)
+		hasNext := stream.Next(nextCtx)
+		idle := nextCtx.Err() != nil
+		cancel()
+
+		if !hasNext {
+			switch {
+			case ctx.Err() != nil:
+				return nil, changes, ctx.Err()
+			case idle:
+				// all changes up to now are replayed
+				return newCheckpoint(dbInfo, until), changes, nil
+			default:
+				return nil, changes, checkExpired(stream.Err())
+			}
+		}
+
+		event := changeEvent{}
+		if err := stream.Decode(&event); err != nil {
+			return nil, changes, err
+		}
+		if err := applyChange(ctx, target, dbInfo, event); err != nil {
+			return nil, changes, err
+		}
+		changes++
+
+		if timestampBefore(event.ClusterTime, until) {
+			continue
+		}
+		next := newCheckpoint(dbInfo, event.ClusterTime)
+		if next.ResumeToken, err = getResumeToken(stream); err != nil {
+			return nil, changes, err
+		}
+		return next, changes, nil
+	}
+}
+
+// timestampBefore returns true if a is before b.
+func timestampBefore(a primitive.Timestamp, b primitive.Timestamp) bool {
+	return a.T < b.T || (a.T == b.T && a.I < b.I)
+}
+
+// watchChanges opens a change stream on the source database which resumes
+// after the checkpoint. Only the synchronized collections are watched.
+func watchChanges(ctx context.Context, db *mongo.Database, collections []string, cp *checkpoint) (*mongo.ChangeStream, error) {
+	pipeline := bson.A{}
+	if len(collections) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.D{
+			{Key: "ns.coll", Value: bson.D{{Key: "$in", Value: collections}}},
+		}}})
+	}
+
+	streamOptions := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if cp.ResumeToken != "" {
+		token := bson.D{}
+		if err := bson.UnmarshalExtJSON([]byte(cp.ResumeToken), true, &token); err != nil {
+			return nil, err
+		}
+		streamOptions.SetResumeAfter(token)
+	} else {
+		streamOptions.SetStartAtOperationTime(&cp.OperationTime)
+	}
+
+	stream, err := db.Watch(ctx, pipeline, streamOptions)
+	if err != nil {
+		return nil, checkExpired(err)
+	}
+	return stream, nil
+}
+
+// getResumeToken returns the resume token of the last change as extended
+// JSON.
+func getResumeToken(stream *mongo.ChangeStream) (string, error) {
+	token := bson.D{}
+	if err := bson.Unmarshal(stream.ResumeToken(), &token); err != nil {
+		return "", err
+	}
+	content, err := bson.MarshalExtJSON(token, true, false)
+	return string(content), err
+}
+
+// checkExpired returns errFullSyncRequired if the change stream can not
+// be resumed from the checkpoint.
+func checkExpired(err error) error {
+	if cmdErr, ok := err.(mongo.CommandError); ok && expiredChangeStreamCodes[cmdErr.Code] {
+		return errFullSyncRequired
+	}
+	return err
+}
+
+// applyChange replays an insert, update, replace or delete on the target
+// database. Inserted and updated documents are replaced by the current
+// version of the document, which is masked by the rules of its collection.
+// Other changes, e.g. a dropped or renamed collection, require a full
+// synchronization.
+func applyChange(ctx context.Context, db *mongo.Database, dbInfo *DatabaseInfo, event changeEvent) error {
+	col := db.Collection(event.Ns.Coll)
+	switch event.OperationType {
+	case "insert", "update", "replace":
+		if event.FullDocument.Type != bsontype.EmbeddedDocument {
+			// the document was deleted after the change
+			_, err := col.DeleteOne(ctx, event.DocumentKey)
+			return err
+		}
+		doc := primitive.D{}
+		if err := event.FullDocument.Unmarshal(&doc); err != nil {
+			return err
+		}
+		if rules, ok := dbInfo.masking[event.Ns.Coll]; ok {
+			doc, _ = maskDocument(doc, rules)
+		}
+		_, err := col.ReplaceOne(ctx, event.DocumentKey, doc, options.Replace().SetUpsert(true))
+		return err
+	case "delete":
+		_, err := col.DeleteOne(ctx, event.DocumentKey)
+		return err
+	}
+	return errFullSyncRequired
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// JobState is the state of a synchronization job.
+type JobState string
+
+const (
+	// JobQueued is the state of a job which has not been started yet
+	JobQueued JobState = "queued"
+	// JobPlanning is the state of a dry run while the databases are inspected
+	JobPlanning JobState = "planning"
+	// JobDumping is the state of a job while the source database is dumped
+	JobDumping JobState = "dumping"
+	// JobMasking is the state of a job while the dump is masked
+	JobMasking JobState = "masking"
+	// JobRestoring is the state of a job while the dump is restored
+	JobRestoring JobState = "restoring"
+	// JobReplaying is the state of a job while the changes since the last
+	// synchronization are replayed
+	JobReplaying JobState = "replaying"
+	// JobVerifying is the state of a job while the target database is checked
+	JobVerifying JobState = "verifying"
+	// JobDone is the state of a successfully finished job
+	JobDone JobState = "done"
+	// JobFailed is the state of a failed job
+	JobFailed JobState = "failed"
+	// JobCancelled is the state of a job stopped in favor of a newer one or
+	// on request
+	JobCancelled JobState = "cancelled"
+	// JobInterrupted is the state of a job stopped by the shutdown of the
+	// service
+	JobInterrupted JobState = "interrupted"
+
+	// maxFinishedJobs is the number of finished jobs kept in the registry
+	maxFinishedJobs = 100
+)
+
+// Job describes a synchronization run triggered by an event.
+type Job struct {
+	ID             string           `json:"id"`
+	KeptnContext   string           `json:"shkeptncontext"`
+	EventID        string           `json:"eventId"`
+	Project        string           `json:"project"`
+	Stage          string           `json:"stage"`
+	Service        string           `json:"service"`
+	State          JobState         `json:"state"`
+	Mode           string           `json:"mode,omitempty"`
+	Created        time.Time        `json:"created"`
+	Started        *time.Time       `json:"started,omitempty"`
+	Finished       *time.Time       `json:"finished,omitempty"`
+	Duration       string           `json:"duration,omitempty"`
+	Error          string           `json:"error,omitempty"`
+	DocumentCounts map[string]int64 `json:"documentCounts,omitempty"`
+	// Verification holds the reports of the dump and restore verification
+	Verification []VerificationReport `json:"verification,omitempty"`
+	// Masking holds the number of masked documents and fields per collection
+	Masking map[string]MaskingStats `json:"masking,omitempty"`
+	// Changes is the number of changes replayed by an incremental job
+	Changes int64 `json:"changes,omitempty"`
+	// Snapshot is the id of the snapshot of the dump, or of the restored
+	// snapshot
+	Snapshot string `json:"snapshot,omitempty"`
+	// InterruptedIn is the state in which a cancelled or timed out job was
+	// stopped, which tells the state of the target database
+	InterruptedIn JobState `json:"interruptedIn,omitempty"`
+	// Attempts are the failed attempts of retried operations and their
+	// successful retries
+	Attempts []Attempt `json:"attempts,omitempty"`
+	// ResumedFrom is the id of the interrupted job which is resumed by this
+	// job
+	ResumedFrom string `json:"resumedFrom,omitempty"`
+	// Phases are the states the job passed through with their start time
+	// and duration
+	Phases []JobPhase `json:"phases,omitempty"`
+	// Plan is the result of a dry run
+	Plan *SyncPlan `json:"plan,omitempty"`
+}
+
+// JobPhase is a state of a job after it was started.
+type JobPhase struct {
+	State    JobState  `json:"state"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration,omitempty"`
+}
+
+// endPhase records the duration of the current phase of the job.
+func (j *Job) endPhase(now time.Time) {
+	if n := len(j.Phases); n > 0 && j.Phases[n-1].Duration == "" {
+		j.Phases[n-1].Duration = now.Sub(j.Phases[n-1].Started).String()
+	}
+}
+
+// clone returns a deep copy of the job, which shares no slice, map or
+// pointer with the job, so it can be read while the job is updated.
+func (j *Job) clone() Job {
+	c := *j
+	if j.Started != nil {
+		started := *j.Started
+		c.Started = &started
+	}
+	if j.Finished != nil {
+		finished := *j.Finished
+		c.Finished = &finished
+	}
+	c.DocumentCounts = cloneCounts(j.DocumentCounts)
+	if j.Verification != nil {
+		c.Verification = make([]VerificationReport, len(j.Verification))
+		for i, report := range j.Verification {
+			report.Mismatches = append([]Mismatch(nil), report.Mismatches...)
+			report.Warnings = append([]string(nil), report.Warnings...)
+			c.Verification[i] = report
+		}
+	}
+	if j.Masking != nil {
+		c.Masking = make(map[string]MaskingStats, len(j.Masking))
+		for col, stats := range j.Masking {
+			c.Masking[col] = stats
+		}
+	}
+	c.Attempts = append([]Attempt(nil), j.Attempts...)
+	c.Phases = append([]JobPhase(nil), j.Phases...)
+	if j.Plan != nil {
+		plan := *j.Plan
+		plan.Collections = append([]CollectionPlan(nil), j.Plan.Collections...)
+		plan.Dropped = append([]string(nil), j.Plan.Dropped...)
+		plan.Warnings = append([]string(nil), j.Plan.Warnings...)
+		c.Plan = &plan
+	}
+	return c
+}
+
+// cloneCounts returns a copy of counts per collection.
+func cloneCounts(counts map[string]int64) map[string]int64 {
+	if counts == nil {
+		return nil
+	}
+	c := make(map[string]int64, len(counts))
+	for col, count := range counts {
+		c[col] = count
+	}
+	return c
+}
+
+// isFinished returns true if the job is done, failed, cancelled or
+// interrupted.
+func (j *Job) isFinished() bool {
+	return j.State == JobDone || j.State == JobFailed || j.State == JobCancelled || j.State == JobInterrupted
+}
+
+// jobRegistry keeps track of the synchronization jobs.
+type jobRegistry struct {
+	mu   sync.RWMutex
+	jobs map[string]*Job
+}
+
+var jobs = newJobRegistry()
+
+// newJobRegistry returns an empty job registry.
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{jobs: map[string]*Job{}}
+}
+
+// create registers a new queued job.
+func (r *jobRegistry) create(shkeptncontext string, eventID string) *Job {
+	job := &Job{
+		ID:           uuid.New().String(),
+		KeptnContext: shkeptncontext,
+		EventID:      eventID,
+		State:        JobQueued,
+		Created:      time.Now(),
+	}
+
+	r.mu.Lock()
+	r.jobs[job.ID] = job
+	r.prune()
+	r.mu.Unlock()
+
+	return job
+}
+
+// prune removes the oldest finished jobs if there are more than
+// maxFinishedJobs. The caller must hold the lock.
+func (r *jobRegistry) prune() {
+	finished := []*Job{}
+	for _, job := range r.jobs {
+		if job.isFinished() {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].Created.Before(finished[j].Created) })
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(r.jobs, job.ID)
+	}
+}
+
+// update applies fn to the job with the given id.
+func (r *jobRegistry) update(id string, fn func(job *Job)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if job, ok := r.jobs[id]; ok {
+		fn(job)
+	}
+}
+
+// setService records the project, stage and service of a job.
+func (r *jobRegistry) setService(id string, project string, stage string, service string) {
+	r.update(id, func(job *Job) {
+		job.Project, job.Stage, job.Service = project, stage, service
+	})
+}
+
+// setState changes the state of a job. The start time is recorded when the
+// job leaves the queued state, every new state starts a phase.
+func (r *jobRegistry) setState(id string, state JobState) {
+	r.update(id, func(job *Job) {
+		now := time.Now()
+		if job.Started == nil && state != JobQueued {
+			job.Started = &now
+		}
+		if state != job.State && state != JobQueued {
+			job.endPhase(now)
+			job.Phases = append(job.Phases, JobPhase{State: state, Started: now})
+		}
+		job.State = state
+	})
+}
+
+// setMode records whether a job is a full or an incremental synchronization
+// or a restore and the number of replayed changes.
+func (r *jobRegistry) setMode(id string, mode string, changes int64) {
+	r.update(id, func(job *Job) {
+		job.Mode, job.Changes = mode, changes
+	})
+}
+
+// setSnapshot records the id of the snapshot of the dump.
+func (r *jobRegistry) setSnapshot(id string, snapshot string) {
+	r.update(id, func(job *Job) {
+		job.Snapshot = snapshot
+	})
+}
+
+// setDocumentCounts records the number of documents per collection.
+func (r *jobRegistry) setDocumentCounts(id string, counts map[string]int64) {
+	r.update(id, func(job *Job) {
+		job.DocumentCounts = counts
+	})
+}
+
+// addVerification appends a verification report to a job.
+func (r *jobRegistry) addVerification(id string, report *VerificationReport) {
+	r.update(id, func(job *Job) {
+		job.Verification = append(job.Verification, *report)
+	})
+}
+
+// addAttempt appends an attempt of an operation to a job.
+func (r *jobRegistry) addAttempt(id string, attempt Attempt) {
+	r.update(id, func(job *Job) {
+		job.Attempts = append(job.Attempts, attempt)
+	})
+}
+
+// setMasking records the changes of the masking.
+func (r *jobRegistry) setMasking(id string, stats map[string]MaskingStats) {
+	r.update(id, func(job *Job) {
+		job.Masking = stats
+	})
+}
+
+// finish marks a job as done, as cancelled if err is errCancelled or
+// errCancelRequested, as interrupted if err is errShutdown or as failed if
+// err is set. The state of an interrupted
+// job is recorded in InterruptedIn.
+func (r *jobRegistry) finish(id string, duration time.Duration, err error) {
+	r.update(id, func(job *Job) {
+		now := time.Now()
+		job.Finished = &now
+		job.Duration = duration.String()
+		job.endPhase(now)
+		if isInterrupted(err) {
+			job.InterruptedIn = job.State
+		}
+		job.State = JobDone
+		if err == errCancelled || err == errCancelRequested {
+			job.State = JobCancelled
+			job.Error = err.Error()
+		} else if err == errShutdown {
+			job.State = JobInterrupted
+			job.Error = err.Error()
+		} else if err != nil {
+			job.State = JobFailed
+			job.Error = err.Error()
+		}
+	})
+}
+
+// add registers a copy of a job, e.g. of a job of a previous process.
+func (r *jobRegistry) add(job Job) {
+	c := job.clone()
+	r.mu.Lock()
+	r.jobs[job.ID] = &c
+	r.prune()
+	r.mu.Unlock()
+}
+
+// get returns a deep copy of the job with the given id.
+func (r *jobRegistry) get(id string) (Job, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	job, ok := r.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.clone(), true
+}
+
+// list returns deep copies of all jobs, the most recent job first. If
+// shkeptncontext is set, only the jobs of this context are returned.
+func (r *jobRegistry) list(shkeptncontext string) []Job {
+	r.mu.RLock()
+	result := []Job{}
+	for _, job := range r.jobs {
+		if shkeptncontext == "" || job.KeptnContext == shkeptncontext {
+			result = append(result, job.clone())
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Created.After(result[j].Created) })
+	return result
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestJobRegistry runs a job through its states.
+func TestJobRegistry(t *testing.T) {
+	fmt.Println("\n>> TestJobRegistry()")
+
+	registry := newJobRegistry()
+	job := registry.create("ctx-1", "event-1")
+	registry.setService(job.ID, "sockshop", "dev", "carts")
+
+	found, ok := registry.get(job.ID)
+	if !ok || found.State != JobQueued || found.Started != nil {
+		t.Fatalf("unexpected job: %+v", found)
+	}
+
+	registry.setState(job.ID, JobDumping)
+	registry.setState(job.ID, JobRestoring)
+	registry.setDocumentCounts(job.ID, map[string]int64{"items": 3})
+	registry.finish(job.ID, time.Second, nil)
+
+	found, _ = registry.get(job.ID)
+	if found.State != JobDone || found.Started == nil || found.Finished == nil || found.Duration != "1s" {
+		t.Errorf("unexpected job: %+v", found)
+	}
+	if found.DocumentCounts["items"] != 3 || found.Service != "carts" {
+		t.Errorf("unexpected job: %+v", found)
+	}
+	if len(found.Phases) != 2 || found.Phases[0].State != JobDumping || found.Phases[1].State != JobRestoring || found.Phases[1].Duration == "" {
+		t.Errorf("unexpected phases: %+v", found.Phases)
+	}
+
+	failed := registry.create("ctx-2", "event-2")
+	registry.finish(failed.ID, time.Second, errors.New("mongo dump failed"))
+	found, _ = registry.get(failed.ID)
+	if found.State != JobFailed || found.Error != "mongo dump failed" {
+		t.Errorf("unexpected job: %+v", found)
+	}
+
+	timedOut := registry.create("ctx-3", "event-3")
+	registry.setState(timedOut.ID, JobRestoring)
+	registry.finish(timedOut.ID, time.Second, &timeoutError{phase: "restore", timeout: time.Minute})
+	found, _ = registry.get(timedOut.ID)
+	if found.State != JobFailed || found.InterruptedIn != JobRestoring {
+		t.Errorf("unexpected job: %+v", found)
+	}
+	cancelled := registry.create("ctx-4", "event-4")
+	registry.finish(cancelled.ID, 0, errCancelRequested)
+	found, _ = registry.get(cancelled.ID)
+	if found.State != JobCancelled || found.InterruptedIn != JobQueued {
+		t.Errorf("unexpected job: %+v", found)
+	}
+
+	if jobs := registry.list("ctx-2"); len(jobs) != 1 || jobs[0].ID != failed.ID {
+		t.Errorf("unexpected jobs: %+v", jobs)
+	}
+	if jobs := registry.list(""); len(jobs) != 4 || jobs[0].ID != cancelled.ID {
+		t.Errorf("unexpected jobs: %+v", jobs)
+	}
+}
+
+// TestJobRegistryPrune checks that only the most recent finished jobs are kept.
+func TestJobRegistryPrune(t *testing.T) {
+	fmt.Println("\n>> TestJobRegistryPrune()")
+
+	registry := newJobRegistry()
+	running := registry.create("ctx-running", "event")
+	for i := 0; i < maxFinishedJobs+5; i++ {
+		job := registry.create("ctx", "event")
+		registry.finish(job.ID, time.Second, nil)
+	}
+	registry.create("ctx", "event")
+
+	if _, ok := registry.get(running.ID); !ok {
+		t.Error("expected running job to be kept")
+	}
+	if n := len(registry.list("ctx")); n != maxFinishedJobs+1 {
+		t.Errorf("unexpected number of jobs, expected: %d, found: %d", maxFinishedJobs+1, n)
+	}
+}
+
+// TestJobsAPI requests jobs from the REST endpoints.
+func TestJobsAPI(t *testing.T) {
+	fmt.Println("\n>> TestJobsAPI()")
+
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	job := jobs.create("ctx-api", "event-api")
+
+	resp, err := http.Get(server.URL + "/jobs?shkeptncontext=ctx-api")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	var list []Job
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 1 || list[0].ID != job.ID {
+		t.Errorf("unexpected jobs: %+v", list)
+	}
+
+	resp, err = http.Get(server.URL + "/jobs/" + job.ID)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	var found Job
+	json.NewDecoder(resp.Body).Decode(&found)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || found.KeptnContext != "ctx-api" || found.State != JobQueued {
+		t.Errorf("unexpected job: %+v", found)
+	}
+
+	resp, err = http.Get(server.URL + "/jobs/unknown")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status code, expected: %d, found: %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+// TestCancelAPI cancels a running job through the REST endpoint.
+func TestCancelAPI(t *testing.T) {
+	fmt.Println("\n>> TestCancelAPI()")
+
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	defer func(s *scheduler) { syncScheduler = s }(syncScheduler)
+	syncScheduler = newScheduler(PolicyQueue)
+	syncScheduler.start(1)
+
+	job := jobs.create("ctx-cancel", "event-cancel")
+	stopped := make(chan error, 1)
+	syncScheduler.submit(&syncTask{
+		jobID:  job.ID,
+		target: "cancel-api",
+		run: func(ctx context.Context) {
+			<-ctx.Done()
+			stopped <- cancelled(ctx)
+		},
+		drop: func(err error) { stopped <- err },
+	})
+
+	resp, err := http.Post(server.URL+"/jobs/"+job.ID+"/cancel", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("unexpected status code, expected: %d, found: %d", http.StatusAccepted, resp.StatusCode)
+	}
+	if err := <-stopped; err != errCancelRequested {
+		t.Errorf("unexpected error, expected: %s, found: %v", errCancelRequested, err)
+	}
+
+	jobs.finish(job.ID, 0, errCancelRequested)
+	for path, status := range map[string]int{job.ID: http.StatusConflict, "unknown": http.StatusNotFound} {
+		resp, err := http.Post(server.URL+"/jobs/"+path+"/cancel", "application/json", nil)
+		if err != nil {
+			t.Fatalf("Error message: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("unexpected status code, expected: %d, found: %d", status, resp.StatusCode)
+		}
+	}
+}
+
+// TestJobCopies encodes the jobs returned by list and get while their phases,
+// attempts and reports are updated. Run with -race, a copy sharing data with
+// the registry is reported as data race.
+func TestJobCopies(t *testing.T) {
+	fmt.Println("\n>> TestJobCopies()")
+
+	registry := newJobRegistry()
+	job := registry.create("ctx-1", "event-1")
+	registry.setState(job.ID, JobDumping)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			registry.setState(job.ID, JobRestoring)
+			registry.addAttempt(job.ID, Attempt{Operation: "restore", Attempt: i})
+			registry.addVerification(job.ID, &VerificationReport{Phase: "restore", Mismatches: []Mismatch{{Collection: "items"}}})
+			registry.update(job.ID, func(job *Job) {
+				job.endPhase(time.Now())
+				job.Phases[len(job.Phases)-1].Duration = fmt.Sprintf("%dms", i)
+				job.Verification[0].Mismatches[0].Found = fmt.Sprintf("%d", i)
+			})
+			registry.setState(job.ID, JobDumping)
+		}
+		registry.finish(job.ID, time.Second, nil)
+	}()
+
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		if _, err := json.Marshal(registry.list("")); err != nil {
+			t.Fatalf("Error message: %s", err)
+		}
+		found, _ := registry.get(job.ID)
+		if _, err := json.Marshal(found); err != nil {
+			t.Fatalf("Error message: %s", err)
+		}
+	}
+
+	found, _ := registry.get(job.ID)
+	found.Phases[0].Duration = "changed"
+	found.Attempts[0].Error = "changed"
+	if again, _ := registry.get(job.ID); again.Phases[0].Duration == "changed" || again.Attempts[0].Error == "changed" {
+		t.Errorf("expected the copy of the job not to share its phases and attempts")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	toollog "github.com/mongodb/mongo-tools-common/log"
+	"github.com/mongodb/mongo-tools-common/progress"
+)
+
+const (
+	// serviceName is the keptnService of the log lines
+	serviceName = "mongodb-service"
+
+	// progressInterval is the time between the progress lines of a running
+	// mongodump or mongorestore
+	progressInterval = 10 * time.Second
+	progressBarWidth = 24
+)
+
+// defaultLogOutput is the writer of the log lines, logOutput the writer
+// currently used.
+var (
+	defaultLogOutput io.Writer = os.Stdout
+	logOutput                  = defaultLogOutput
+)
+
+// logMu serializes the log lines of concurrent jobs.
+var logMu sync.Mutex
+
+// defaultLogger logs messages which do not belong to a job.
+var defaultLogger = &Logger{}
+
+// logFields are the correlation fields of a log line.
+type logFields struct {
+	KeptnContext string `json:"shkeptncontext,omitempty"`
+	EventID      string `json:"eventId,omitempty"`
+	JobID        string `json:"jobId,omitempty"`
+	Project      string `json:"project,omitempty"`
+	Stage        string `json:"stage,omitempty"`
+	Service      string `json:"service,omitempty"`
+	Phase        string `json:"phase,omitempty"`
+	Collection   string `json:"collection,omitempty"`
+	// Source is mongo-tools for lines forwarded from mongodump and
+	// mongorestore
+	Source string `json:"source,omitempty"`
+}
+
+// logLine is a log line in the format of the Keptn logger with the
+// correlation fields of the job.
+type logLine struct {
+	Timestamp    time.Time `json:"timestamp"`
+	LogLevel     string    `json:"logLevel"`
+	Message      string    `json:"message"`
+	KeptnService string    `json:"keptnService"`
+	logFields
+}
+
+// Logger writes log lines as JSON, tagged with the fields of a job. The
+// with* methods return a copy with an additional field, so a logger can be
+// shared by the collections of a job.
+type Logger struct {
+	fields logFields
+}
+
+// newLogger returns the logger of an event.
+func newLogger(shkeptncontext string, eventID string) *Logger {
+	return &Logger{fields: logFields{KeptnContext: shkeptncontext, EventID: eventID}}
+}
+
+// withJob returns a copy of the logger tagged with a job.
+func (l *Logger) withJob(jobID string) *Logger {
+	c := *l
+	c.fields.JobID = jobID
+	return &c
+}
+
+// withService returns a copy of the logger tagged with the project, stage
+// and service of a job.
+func (l *Logger) withService(project string, stage string, service string) *Logger {
+	c := *l
+	c.fields.Project, c.fields.Stage, c.fields.Service = project, stage, service
+	return &c
+}
+
+// withPhase returns a copy of the logger tagged with a phase.
+func (l *Logger) withPhase(phase string) *Logger {
+	c := *l
+	c.fields.Phase = phase
+	return &c
+}
+
+// withCollection returns a copy of the logger tagged with a collection.
+func (l *Logger) withCollection(col string) *Logger {
+	c := *l
+	c.fields.Collection = col
+	return &c
+}
+
+// Debug logs a debug message.
+func (l *Logger) Debug(message string) {
+	l.log("DEBUG", message)
+}
+
+// Info logs an info message.
+func (l *Logger) Info(message string) {
+	l.log("INFO", message)
+}
+
+// Warning logs a warning message.
+func (l *Logger) Warning(message string) {
+	l.log("WARNING", message)
+}
+
+// Error logs an error message.
+func (l *Logger) Error(message string) {
+	l.log("ERROR", message)
+}
+
+func (l *Logger) log(level string, message string) {
+	line, err := json.Marshal(logLine{
+		Timestamp:    time.Now(),
+		LogLevel:     level,
+		Message:      message,
+		KeptnService: serviceName,
+		logFields:    l.fields,
+	})
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"logLevel":"ERROR","message":"could not log message: %s"}`, err.Error()))
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	fmt.Fprintln(logOutput, string(line))
+}
+
+// loggerKey is the context key of the logger of a job.
+type loggerKey struct{}
+
+// withLogger returns a copy of ctx carrying logger.
+func withLogger(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger of ctx, or the default logger.
+func loggerFrom(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return logger
+	}
+	return defaultLogger
+}
+
+// toolWriter logs the lines written by mongo-tools with a logger.
+type toolWriter struct {
+	logger *Logger
+}
+
+// Write logs every non-empty line of p as info message. The timestamp the
+// tool logger prepends is removed.
+func (w *toolWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(string(p), "\n") {
+		if i := strings.Index(line, "\t"); i >= 0 {
+			if _, err := time.Parse(toollog.ToolTimeFormat, line[:i]); err == nil {
+				line = line[i+1:]
+			}
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			w.logger.Info(line)
+		}
+	}
+	return len(p), nil
+}
+
+// startProgress starts a progress manager which logs the progress of a
+// mongodump or mongorestore with the logger of ctx. It has to be stopped
+// when the tool has finished.
+func startProgress(ctx context.Context, isBytes bool) *progress.BarWriter {
+	logger := loggerFrom(ctx)
+	l := *logger
+	l.fields.Source = "mongo-tools"
+	bars := progress.NewBarWriter(&toolWriter{logger: &l}, progressInterval, progressBarWidth, isBytes)
+	bars.Start()
+	return bars
+}
+
+// toolLoggers are the loggers of the running mongodump and mongorestore
+// operations. The log package of mongo-tools is global, so its lines are
+// assigned to an operation by the collection in their namespace.
+var toolLoggers = struct {
+	sync.Mutex
+	running map[*Logger]*toolLogger
+}{running: map[*Logger]*toolLogger{}}
+
+// toolLogger counts the registrations of a logger and holds the pattern of
+// the namespace of its collection, which is nil without collection.
+type toolLogger struct {
+	count     int
+	namespace *regexp.Regexp
+}
+
+// registerToolLogger adds the logger of a running operation. The returned
+// function removes it.
+func registerToolLogger(logger *Logger) func() {
+	toolLoggers.Lock()
+	registered, ok := toolLoggers.running[logger]
+	if !ok {
+		registered = &toolLogger{}
+		if col := logger.fields.Collection; col != "" {
+			registered.namespace = regexp.MustCompile(`\.` + regexp.QuoteMeta(col) + `\b`)
+		}
+		toolLoggers.running[logger] = registered
+	}
+	registered.count++
+	toolLoggers.Unlock()
+	return func() {
+		toolLoggers.Lock()
+		if registered.count--; registered.count == 0 {
+			delete(toolLoggers.running, logger)
+		}
+		toolLoggers.Unlock()
+	}
+}
+
+// findToolLogger returns the logger of the only running operation, or of
+// the only one whose collection is contained in line as namespace. Lines
+// which can not be assigned are logged with the default logger.
+func findToolLogger(line string) *Logger {
+	toolLoggers.Lock()
+	defer toolLoggers.Unlock()
+	var found *Logger
+	for logger, registered := range toolLoggers.running {
+		if len(toolLoggers.running) == 1 {
+			return logger
+		}
+		if registered.namespace == nil || !registered.namespace.MatchString(line) {
+			continue
+		}
+		if found != nil {
+			return defaultLogger
+		}
+		found = logger
+	}
+	if found == nil {
+		return defaultLogger
+	}
+	return found
+}
+
+// globalToolWriter logs the lines of the global log of mongo-tools with the
+// logger of the running operation they belong to.
+type globalToolWriter struct{}
+
+func (globalToolWriter) Write(p []byte) (int, error) {
+	logger := *findToolLogger(string(p))
+	logger.fields.Source = "mongo-tools"
+	return (&toolWriter{logger: &logger}).Write(p)
+}
+
+// forwardToolLogs forwards the log output of mongo-tools, which is written
+// to stderr by default, to the structured log.
+func forwardToolLogs() {
+	toollog.SetWriter(globalToolWriter{})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	toollog "github.com/mongodb/mongo-tools-common/log"
+)
+
+// captureLog redirects the log into a buffer until the returned function
+// is called.
+func captureLog() (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	logMu.Lock()
+	logOutput = &buf
+	logMu.Unlock()
+	return &buf, func() {
+		logMu.Lock()
+		logOutput = defaultLogOutput
+		logMu.Unlock()
+	}
+}
+
+// readLogLines parses the JSON log lines of a buffer.
+func readLogLines(t *testing.T, buf *bytes.Buffer) []map[string]string {
+	logMu.Lock()
+	defer logMu.Unlock()
+	lines := []map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		fields := map[string]string{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("Error message: %s", err)
+		}
+		lines = append(lines, fields)
+	}
+	return lines
+}
+
+// TestLogger tags the log lines of a job with the phase and the collection.
+func TestLogger(t *testing.T) {
+	fmt.Println("\n>> TestLogger()")
+
+	buf, restore := captureLog()
+	defer restore()
+
+	logger := newLogger("ctx-log", "event-log").withJob("job-log").withService("sockshop", "dev", "carts")
+	ctx := withLogger(context.Background(), logger)
+	dbInfo := &DatabaseInfo{retry: RetryPolicy{MaxAttempts: 1}}
+	runPhase(ctx, "dump", time.Minute, func(ctx context.Context) error {
+		return withRetry(ctx, dbInfo, "dump", "items", func(ctx context.Context) error {
+			loggerFrom(ctx).Error("mongo dump failed")
+			return nil
+		})
+	})
+	logger.Info("done")
+
+	lines := readLogLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("unexpected log lines: %v", lines)
+	}
+	expected := map[string]string{"shkeptncontext": "ctx-log", "eventId": "event-log", "jobId": "job-log", "project": "sockshop",
+		"stage": "dev", "service": "carts", "phase": "dump", "collection": "items", "logLevel": "ERROR", "message": "mongo dump failed",
+		"keptnService": "mongodb-service"}
+	for key, value := range expected {
+		if lines[0][key] != value {
+			t.Errorf("unexpected %s, expected: %s, found: %s", key, value, lines[0][key])
+		}
+	}
+	if lines[1]["phase"] != "" || lines[1]["collection"] != "" || lines[1]["jobId"] != "job-log" {
+		t.Errorf("unexpected log line: %v", lines[1])
+	}
+}
+
+// TestToolLogs assigns the lines of the global mongo-tools log to the
+// running operations.
+func TestToolLogs(t *testing.T) {
+	fmt.Println("\n>> TestToolLogs()")
+
+	buf, restore := captureLog()
+	defer restore()
+	forwardToolLogs()
+	defer toollog.SetWriter(os.Stderr)
+
+	items := newLogger("ctx-tools", "").withJob("job-1").withCollection("items")
+	users := newLogger("ctx-tools", "").withJob("job-2").withCollection("users")
+	defer registerToolLogger(items)()
+	defer registerToolLogger(users)()
+
+	toollog.Logv(toollog.Always, "finished restoring carts-db.users (2 documents, 0 failures)")
+	toollog.Logv(toollog.Always, "preparing collections to restore from")
+
+	lines := readLogLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("unexpected log lines: %v", lines)
+	}
+	if lines[0]["jobId"] != "job-2" || lines[0]["source"] != "mongo-tools" || lines[0]["message"] != "finished restoring carts-db.users (2 documents, 0 failures)" {
+		t.Errorf("unexpected log line: %v", lines[0])
+	}
+	if lines[1]["jobId"] != "" || lines[1]["source"] != "mongo-tools" {
+		t.Errorf("unexpected log line: %v", lines[1])
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
-	"reflect"
-	"sort"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
@@ -26,14 +28,31 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"gopkg.in/mgo.v2/bson"
-
-	mr "github.com/mongodb/mongo-tools/mongorestore"
 )
 
 type envConfig struct {
 	// Port on which to listen for cloudevents
 	Port int    `envconfig:"RCV_PORT" default:"8080"`
 	Path string `envconfig:"RCV_PATH" default:"/"`
+	// Path of the sync configuration file, the <SERVICE>_* variables are used if it does not exist
+	ConfigPath           string        `envconfig:"SYNC_CONFIG" default:"/config/sync.yaml"`
+	ConfigReloadInterval time.Duration `envconfig:"SYNC_CONFIG_RELOAD_INTERVAL" default:"30s"`
+	// Number of synchronizations running at the same time and the default
+	// policy for events of a target database which is being synchronized
+	Workers       int    `envconfig:"SYNC_WORKERS" default:"2"`
+	OverlapPolicy string `envconfig:"SYNC_OVERLAP_POLICY" default:"queue"`
+	// Time the running jobs may finish after SIGTERM, the file the
+	// interrupted jobs are persisted in (default: DUMP_DIR/interrupted-jobs.json)
+	// and whether they are resumed after a restart
+	ShutdownGracePeriod time.Duration `envconfig:"SHUTDOWN_GRACE_PERIOD" default:"60s"`
+	StateFile           string        `envconfig:"SHUTDOWN_STATE_FILE"`
+	ResumeInterrupted   bool          `envconfig:"RESUME_INTERRUPTED_JOBS" default:"true"`
+	// History of the finished jobs, a JSON lines file (default:
+	// DUMP_DIR/job-history.jsonl) or a collection if a MongoDB is set
+	HistoryFile            string `envconfig:"HISTORY_FILE"`
+	HistoryMongoURI        string `envconfig:"HISTORY_MONGODB_URI"`
+	HistoryMongoDatabase   string `envconfig:"HISTORY_MONGODB_DATABASE" default:"mongodb-service"`
+	HistoryMongoCollection string `envconfig:"HISTORY_MONGODB_COLLECTION" default:"jobs"`
 }
 
 var (
@@ -49,11 +68,10 @@ var (
 )
 
 const (
-	errorNotAllCollsDumped  = "not all collections were dumped/restored"
-	errorDumpedFiles        = "unable to get dumped files"
-	errorCollectionNotFound = "could not find collection %s in dump directory"
+	errorDumpedFiles = "unable to get dumped files"
 
 	configservice = "CONFIGURATION_SERVICE"
+	eventbroker   = "EVENTBROKER"
 )
 
 // DatabaseInfo groups information from a database.
@@ -62,10 +80,71 @@ type DatabaseInfo struct {
 	targetDB    string
 	sourceHost  string
 	targetHost  string
+	sourceURI   string
+	targetURI   string
 	port        string
+	targetPort  string
 	dumpDir     string
 	collections []string
 	args        []string
+	streaming   bool
+	// skipVerification disables the comparison of the collections, document
+	// counts and indexes after the dump and the restore
+	skipVerification bool
+	// deepVerification compares the documents of the source and the target
+	// after the restore
+	deepVerification bool
+	// masking maps collection names to the rules applied to the dump
+	masking map[string][]MaskRule
+	// filters select the synchronized documents of a collection
+	filters map[string]CollectionFilter
+	// incremental replays the changes since the checkpoint stored in
+	// checkpointFile instead of dumping the whole database
+	incremental    bool
+	checkpointFile string
+	// snapshots keeps the dump in snapshotDir, the catalog of the source
+	// database, if it is set
+	snapshots   *SnapshotOptions
+	snapshotDir string
+	// safeRestore restores into staging collections, which replace the
+	// target collections after they are verified
+	safeRestore bool
+	// storage keeps the dump as archives below archivePrefix instead of
+	// the dump directory, if it is set
+	storage       Storage
+	archivePrefix string
+	// gzip compresses the dump, archive writes it as archives into the dump
+	// directory
+	gzip    bool
+	archive bool
+	// parallelCollections is the number of collections dumped and restored
+	// at the same time, insertionWorkers the number of insertion workers per
+	// restored collection
+	parallelCollections int
+	insertionWorkers    int
+	// encryption encrypts the archives with its current key,
+	// if it is set
+	encryption *encryptionKeys
+	// timeouts limit the synchronization and its phases
+	timeouts Timeouts
+	// retry is the retry policy of the operations of a collection, whose
+	// attempts are recorded in the job jobID
+	retry RetryPolicy
+	jobID string
+}
+
+// getTargetPort returns the port of the target database, which defaults to
+// the port of the source database.
+func (dbInfo *DatabaseInfo) getTargetPort() string {
+	if dbInfo.targetPort == "" {
+		return dbInfo.port
+	}
+	return dbInfo.targetPort
+}
+
+// getTargetKey identifies the target database across services.
+func (dbInfo *DatabaseInfo) getTargetKey() string {
+	return dbInfo.targetHost + "/" + dbInfo.targetDB
 }
 
 func main() {
@@ -80,100 +159,305 @@ func gotEvent(ctx context.Context, event cloudevents.Event) error {
 	var shkeptncontext string
 	event.Context.ExtensionAs("shkeptncontext", &shkeptncontext)
 
-	if event.Type() != keptnevents.ConfigurationChangeEventType {
+	// events are rejected during the shutdown, so they are not lost with
+	// the process
+	if syncScheduler.isClosed() {
+		return errors.New("service is shutting down")
+	}
+
+	switch event.Type() {
+	case keptnevents.ConfigurationChangeEventType:
+		// malformed options are rejected, so a dry run is never mistaken
+		// for a synchronization
+		options := &syncEventOptions{}
+		if err := event.DataAs(options); err != nil {
+			return fmt.Errorf("invalid options in event %s: %s", event.Context.GetID(), err.Error())
+		}
+		job := jobs.create(shkeptncontext, event.Context.GetID())
+		go syncTestDB(event, shkeptncontext, job.ID, options)
+	case RestoreEventType:
+		job := jobs.create(shkeptncontext, event.Context.GetID())
+		go restoreTestDB(event, shkeptncontext, job.ID)
+	default:
 		const errorMsg = "Received unexpected keptn event"
 		return errors.New(errorMsg)
 	}
 
-	go syncTestDB(event, shkeptncontext)
-
 	return nil
 }
 
-func syncTestDB(event cloudevents.Event, shkeptncontext string) {
+func syncTestDB(event cloudevents.Event, shkeptncontext string, jobID string, options *syncEventOptions) {
 
-	stdLogger := keptnutils.NewLogger(shkeptncontext, event.Context.GetID(), "mongodb-service")
-	stdLogger.Debug("Database synchronization started")
+	stdLogger := newLogger(shkeptncontext, event.Context.GetID()).withJob(jobID)
 
 	e := &keptnevents.ConfigurationChangeEventData{}
 	if err := event.DataAs(e); err != nil {
 		stdLogger.Error(fmt.Sprintf("Got Data Error: %s", err.Error()))
 	}
+	startSync(stdLogger, shkeptncontext, jobID, e, options.DryRun)
+}
 
-	service := strings.ToUpper(e.Service) // in our demo example, this will be carts --> toUpper: CARTS
-
-	var namespace string
+// startSync queues the synchronization of the target database of a service,
+// or a dry run if dryRun is set or configured for the service. Errors before
+// the synchronization is queued finish the job.
+func startSync(stdLogger *Logger, shkeptncontext string, jobID string, e *keptnevents.ConfigurationChangeEventData, dryRun bool) {
 	if e.Stage == "" {
-		stage, _ := getFirstStage(e.Project)
-		namespace = e.Project + "-" + stage
-	} else {
-		namespace = e.Project + "-" + e.Stage
+		e.Stage, _ = getFirstStage(e.Project)
 	}
+	jobs.setService(jobID, e.Project, e.Stage, e.Service)
+	stdLogger = stdLogger.withService(e.Project, e.Stage, e.Service)
 
-	sourceDB := os.Getenv(service + "_SOURCEDB")
-	if sourceDB == "" {
-		stdLogger.Error(fmt.Sprintf("No source database configured for %s", service))
+	sc, err := syncConfig.get(e.Project, e.Stage, e.Service)
+	if err != nil {
+		finishSync(stdLogger, shkeptncontext, jobID, e, nil, 0, err)
 		return
 	}
-	targetDB := os.Getenv(service + "_TARGETDB")
-	if targetDB == "" {
-		stdLogger.Error(fmt.Sprintf("No target database configured for %s", service))
+	dbInfo, err := newDatabaseInfo(sc, e.Project+"-"+e.Stage)
+	if err != nil {
+		finishSync(stdLogger, shkeptncontext, jobID, e, nil, 0, err)
 		return
 	}
-	sourceHost := os.Getenv(service + "_SOURCE_HOST")
-	if sourceHost == "" {
-		stdLogger.Error(fmt.Sprintf("No source host configured for %s", service))
-		return
+	dbInfo.jobID = jobID
+	// the checkpoint of incremental synchronizations is kept per target database
+	dbInfo.checkpointFile = filepath.Join(dbInfo.dumpDir, checkpointDir, url.PathEscape(dbInfo.getTargetKey())+".json")
+	// every job dumps into its own directory, which is removed afterwards
+	// unless the dump is kept as snapshot
+	if dbInfo.snapshots != nil {
+		dbInfo.snapshotDir = getSnapshotDir(dbInfo.dumpDir, dbInfo)
+		dbInfo.dumpDir = getPendingSnapshotDir(dbInfo.snapshotDir, jobID)
+	} else {
+		dbInfo.dumpDir = filepath.Join(dbInfo.dumpDir, jobID)
 	}
-	targetHost := os.Getenv(service + "_TARGET_HOST")
-	if targetHost == "" {
-		stdLogger.Error(fmt.Sprintf("No target host configured for %s", service))
+	if dbInfo.storage != nil {
+		dbInfo.archivePrefix = url.PathEscape(dbInfo.getTargetKey()) + "/" + jobID
+	}
+
+	if dryRun || sc.Options.DryRun {
+		startDryRun(stdLogger, jobID, dbInfo, e.Project+"-"+e.Stage)
 		return
 	}
-	defaultPort := os.Getenv(service + "_PORT")
-	//if isValidPort(defaultPort) { //TODO: check isValidPort?
-	//	stdLogger.Error(fmt.Sprintf("Invalid port \"%s\" configured for %s", defaultPort, service))
-	//	return
-	//}
-
-	dbInfo := &DatabaseInfo{
-		sourceDB:    sourceDB,
-		targetDB:    targetDB,
-		sourceHost:  sourceHost + "." + namespace,
-		targetHost:  targetHost + "." + namespace,
-		port:        defaultPort,
-		dumpDir:     os.Getenv("DUMP_DIR"),
-		collections: getCollections(os.Getenv(service + "_COLLECTIONS")),
-		args: []string{
-			mr.DropOption,
-			"--host=" + targetHost + "." + namespace + ":" + defaultPort,
+
+	stdLogger.Debug(fmt.Sprintf("Database synchronization of %s queued", dbInfo.getTargetKey()))
+	syncScheduler.submit(&syncTask{
+		jobID:  jobID,
+		target: dbInfo.getTargetKey(),
+		policy: sc.Options.OverlapPolicy,
+		run: func(ctx context.Context) {
+			ctx = withLogger(ctx, stdLogger)
+			stdLogger.Debug("Database synchronization started")
+			start := time.Now()
+			err := runPhase(ctx, "synchronization", dbInfo.timeouts.Total, func(ctx context.Context) error {
+				return synchronize(ctx, jobID, dbInfo)
+			})
+			finishSync(stdLogger, shkeptncontext, jobID, e, dbInfo, time.Since(start), err)
+		},
+		drop: func(err error) {
+			finishSync(stdLogger, shkeptncontext, jobID, e, dbInfo, 0, err)
 		},
+	})
+}
+
+// finishSync records the result of a synchronization in the job and sends
+// the synchronized or synchronization failed event.
+func finishSync(stdLogger *Logger, shkeptncontext string, jobID string,
+	e *keptnevents.ConfigurationChangeEventData, dbInfo *DatabaseInfo, duration time.Duration, err error) {
+
+	if err != nil {
+		stdLogger.Error(err.Error())
+	} else {
+		stdLogger.Debug(fmt.Sprintf("Duration of snapshot synchronization: %s", duration))
 	}
+	jobs.finish(jobID, duration, err)
+	recordJob(stdLogger, jobID, dbInfo)
 
-	fmt.Println("target host: " + dbInfo.args[1])
+	if err := sendSynchronizationEvent(shkeptncontext, jobID, e, dbInfo, duration, err); err != nil {
+		stdLogger.Error(fmt.Sprintf("Failed to send synchronization event: %s", err.Error()))
+	}
+}
 
-	StartTimer()
+// synchronize synchronizes the target database with the source database,
+// incrementally if this is configured for the service.
+func synchronize(ctx context.Context, jobID string, dbInfo *DatabaseInfo) error {
+	stdLogger := loggerFrom(ctx)
+	stdLogger.Debug("target host: " + dbInfo.targetHost)
 
+	if dbInfo.incremental {
+		return incrementalSync(ctx, jobID, dbInfo)
+	}
+	return fullSync(ctx, jobID, dbInfo)
+}
+
+// fullSync dumps the source database and restores it into the target
+// database. The state of the job is updated after each phase. If ctx is
+// cancelled, the running phase is aborted and the next phase is not started.
+func fullSync(ctx context.Context, jobID string, dbInfo *DatabaseInfo) error {
+	stdLogger := loggerFrom(ctx)
+	if err := boundFilters(ctx, dbInfo); err != nil {
+		return fmt.Errorf("Failed to apply the filters of database %s: %s", dbInfo.sourceDB, err.Error())
+	}
+	if dbInfo.streaming {
+		// dump and restore run at the same time, the job is restoring
+		jobs.setState(jobID, JobRestoring)
+		stdLogger.Debug(fmt.Sprintf("start mongo dump streamed into mongo restore"))
+		err := runPhase(ctx, "restore", dbInfo.timeouts.Restore, func(ctx context.Context) error {
+			return executeMongoStream(ctx, dbInfo)
+		})
+		if isInterrupted(err) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to stream database %s into %s: %s", dbInfo.sourceDB, dbInfo.targetDB, err.Error())
+		}
+		stdLogger.Debug(fmt.Sprintf("mongo dump streamed into mongo restore done"))
+		return verifyTarget(ctx, jobID, dbInfo)
+	}
+	if dbInfo.storage != nil {
+		return archiveSync(ctx, jobID, dbInfo)
+	}
+	// a dump kept as snapshot is not removed
+	removeDump := true
+	defer func(dumpDir string) {
+		if removeDump {
+			os.RemoveAll(dumpDir)
+		}
+	}(dbInfo.dumpDir)
+
+	jobs.setState(jobID, JobDumping)
 	stdLogger.Debug(fmt.Sprintf("start mongo dump"))
-	if err := executeMongoDump(dbInfo); err != nil {
-		stdLogger.Error(fmt.Sprintf("Failed to execute mongo dump on database  %s: %s", dbInfo.sourceDB, err.Error()))
-		return
+	err := runPhase(ctx, "dump", dbInfo.timeouts.Dump, func(ctx context.Context) error {
+		return executeMongoDump(ctx, dbInfo)
+	})
+	if isInterrupted(err) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to execute mongo dump on database  %s: %s", dbInfo.sourceDB, err.Error())
 	}
 	stdLogger.Debug(fmt.Sprintf("mongo dump done"))
+	if err := runVerification(ctx, jobID, dbInfo, verifyDump); err != nil {
+		return err
+	}
+
+	if len(dbInfo.masking) > 0 {
+		jobs.setState(jobID, JobMasking)
+		stdLogger.Debug(fmt.Sprintf("start masking"))
+		stats, err := maskDump(dbInfo)
+		if err != nil {
+			return fmt.Errorf("Failed to mask dump of database %s: %s", dbInfo.sourceDB, err.Error())
+		}
+		jobs.setMasking(jobID, stats)
+		stdLogger.Debug(fmt.Sprintf("masking done: %v", stats))
+		if ctx.Err() != nil {
+			return cancelled(ctx)
+		}
+	}
+
+	if dbInfo.snapshots != nil {
+		snapshot, err := saveSnapshot(jobID, dbInfo)
+		if err != nil {
+			return fmt.Errorf("Failed to save snapshot of database %s: %s", dbInfo.sourceDB, err.Error())
+		}
+		removeDump = false
+		jobs.setSnapshot(jobID, snapshot.ID)
+		stdLogger.Debug(fmt.Sprintf("snapshot version %d saved in %s", snapshot.Version, dbInfo.dumpDir))
+	}
+	if ctx.Err() != nil {
+		return cancelled(ctx)
+	}
 
+	jobs.setState(jobID, JobRestoring)
 	stdLogger.Debug(fmt.Sprintf("start mongo restore"))
-	if err := executeMongoRestore(dbInfo); err != nil {
-		stdLogger.Error(fmt.Sprintf("Failed to execute mongo restore on database  %s: %s", dbInfo.targetDB, err.Error()))
-		return
+	err = runPhase(ctx, "restore", dbInfo.timeouts.Restore, func(ctx context.Context) error {
+		return restoreTarget(ctx, jobID, dbInfo)
+	})
+	if isInterrupted(err) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to execute mongo restore on database  %s: %s", dbInfo.targetDB, err.Error())
 	}
 	stdLogger.Debug(fmt.Sprintf("mongo restore done"))
 
-	stdLogger.Debug(fmt.Sprintf("Duration of snapshot synchronization: %s", GetDuration()))
+	return verifyTarget(ctx, jobID, dbInfo)
+}
+
+// verifyTarget compares the target database with the dump or the source
+// database and records the number of documents per collection of the target
+// database in the job.
+func verifyTarget(ctx context.Context, jobID string, dbInfo *DatabaseInfo) error {
+	jobs.setState(jobID, JobVerifying)
+	if err := runVerification(ctx, jobID, dbInfo, verifyRestore); err != nil {
+		return err
+	}
+	if dbInfo.deepVerification {
+		if err := runVerification(ctx, jobID, dbInfo, verifyChecksums); err != nil {
+			return err
+		}
+	}
+	return recordDocumentCounts(ctx, jobID, dbInfo)
+}
+
+// recordDocumentCounts records the number of documents per collection of
+// the target database in the job.
+func recordDocumentCounts(ctx context.Context, jobID string, dbInfo *DatabaseInfo) error {
+	jobs.setState(jobID, JobVerifying)
+	counts, err := getDocumentCounts(ctx, dbInfo, "target")
+	if err != nil {
+		return fmt.Errorf("Failed to count documents in database %s: %s", dbInfo.targetDB, err.Error())
+	}
+	jobs.setDocumentCounts(jobID, counts)
+	return nil
+}
+
+// runVerification executes a verification unless it is switched off for the
+// service and records its report in the job. Mismatches fail the
+// synchronization. The verification is limited by the verify timeout.
+func runVerification(ctx context.Context, jobID string, dbInfo *DatabaseInfo,
+	verify func(context.Context, *DatabaseInfo) (*VerificationReport, error)) error {
+	if dbInfo.skipVerification {
+		return nil
+	}
+	var report *VerificationReport
+	err := runPhase(ctx, "verification", dbInfo.timeouts.Verify, func(ctx context.Context) (err error) {
+		report, err = verify(ctx, dbInfo)
+		return err
+	})
+	if isInterrupted(err) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to verify database %s: %s", dbInfo.targetDB, err.Error())
+	}
+	for _, warning := range report.Warnings {
+		loggerFrom(ctx).Warning(fmt.Sprintf("Verification of the %s: %s", report.Phase, warning))
+	}
+	jobs.addVerification(jobID, report)
+	return report.err()
 }
 
 func _main(args []string, env envConfig) int {
 
 	ctx := context.Background()
+	forwardToolLogs()
+
+	if err := syncConfig.init(env.ConfigPath); err != nil {
+		log.Fatalf("failed to load sync configuration, %v", err)
+	}
+	go syncConfig.watch(env.ConfigReloadInterval)
+
+	if policy := OverlapPolicy(env.OverlapPolicy); !policy.isValid() {
+		log.Fatalf("invalid overlap policy %s", env.OverlapPolicy)
+	}
+	syncScheduler.policy = OverlapPolicy(env.OverlapPolicy)
+	if err := syncScheduler.start(env.Workers); err != nil {
+		log.Fatalf("failed to start workers, %v", err)
+	}
+
+	history, err := newHistoryStore(ctx, env)
+	if err != nil {
+		log.Fatalf("failed to open job history, %v", err)
+	}
+	jobHistory = history
 
 	t, err := cloudeventshttp.New(
 		cloudeventshttp.WithPort(env.Port),
@@ -183,35 +467,67 @@ func _main(args []string, env envConfig) int {
 	if err != nil {
 		log.Fatalf("failed to create transport, %v", err)
 	}
+	// the REST endpoints are served next to the cloudevents receiver
+	t.Handler = http.NewServeMux()
+	registerHandlers(t.Handler)
+
 	c, err := client.New(t)
 	if err != nil {
 		log.Fatalf("failed to create client, %v", err)
 	}
 
-	log.Fatalf("failed to start receiver: %s", c.StartReceiver(ctx, gotEvent))
+	if err := restoreInterruptedJobs(getStateFile(env), env.ResumeInterrupted); err != nil {
+		defaultLogger.Error(fmt.Sprintf("Failed to restore interrupted jobs: %s", err.Error()))
+	}
+
+	// on SIGTERM, new events are rejected and the jobs are drained before
+	// the receiver is stopped
+	receiverCtx, stopReceiver := context.WithCancel(ctx)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		defaultLogger.Info(fmt.Sprintf("Received %s", sig))
+		shutdown(env)
+		stopReceiver()
+	}()
+
+	if err := c.StartReceiver(receiverCtx, gotEvent); err != nil {
+		log.Fatalf("failed to start receiver: %s", err)
+	}
 
 	return 0
 }
 
 // getDatabase returns a Database instance.
 func getDatabase(ctx context.Context, dbInfo *DatabaseInfo, host string) (*mongo.Database, error) {
-	var hostURL string
-	var db string
+	db := dbInfo.targetDB
 	if host == "source" {
-		hostURL = dbInfo.sourceHost
 		db = dbInfo.sourceDB
-	} else {
-		hostURL = dbInfo.targetHost
-		db = dbInfo.targetDB
 	}
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+hostURL+":"+dbInfo.port)) //mongodb://carts-db:27017/carts-db
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(dbInfo.getURI(host))) //mongodb://carts-db:27017/carts-db
 	if err != nil {
 		return nil, err
 	}
 	return client.Database(db), nil
 }
 
+// getURI returns the connection string of the source or target database,
+// which defaults to mongodb://<host>:<port>.
+func (dbInfo *DatabaseInfo) getURI(host string) string {
+	if host == "source" {
+		if dbInfo.sourceURI != "" {
+			return dbInfo.sourceURI
+		}
+		return "mongodb://" + dbInfo.sourceHost + ":" + dbInfo.port
+	}
+	if dbInfo.targetURI != "" {
+		return dbInfo.targetURI
+	}
+	return "mongodb://" + dbInfo.targetHost + ":" + dbInfo.getTargetPort()
+}
+
 // getCollections converts a string with collection names to a string array.
 func getCollections(collections string) []string {
 	if collections == "" {
@@ -225,71 +541,43 @@ func getCollections(collections string) []string {
 	return colArr
 }
 
-// assertDatabaseConsistency checks if all collections in the directory are
-// available also in the database.
-func assertDatabaseConsistency(dbInfo *DatabaseInfo, host string) error {
-	collectionNamesDB, err := getCollectionNames(dbInfo, host)
-	if err != nil {
-		return err
-	}
-
-	files, err := getDumpedFiles(dbInfo)
+//getCollectionNames returns the collection names from a database.
+func getCollectionNames(ctx context.Context, dbInfo *DatabaseInfo, host string) ([]string, error) {
+	db, err := getDatabase(ctx, dbInfo, host)
 	if err != nil {
-		return fmt.Errorf(errorDumpedFiles)
-	}
-	collectionNamesDump := make([]string, len(files)/2)
-
-	for i, file := range files {
-		if i%2 != 0 {
-			bsonFile := files[i-1].Name()
-			jsonFile := file.Name()
-			containsBSON := false
-			containsJSON := false
-
-			for _, name := range collectionNamesDB {
-				if bsonFile == (name + ".bson") {
-					containsBSON = true
-				}
-				if jsonFile == (name + ".metadata.json") {
-					containsJSON = true
-				}
-			}
-
-			if containsBSON && containsJSON {
-				collection := bsonFile[:strings.LastIndex(bsonFile, ".bson")]
-				collectionNamesDump[i/2] = collection
-			}
-		}
+		return nil, err
 	}
+	defer db.Client().Disconnect(context.Background())
+	return db.ListCollectionNames(ctx, bson.M{})
+}
 
-	sort.Strings(collectionNamesDump)
-	sort.Strings(collectionNamesDB)
-
-	if len(dbInfo.collections) == 0 {
-		if !reflect.DeepEqual(collectionNamesDump, collectionNamesDB) {
-			return fmt.Errorf(errorNotAllCollsDumped)
-		}
-	} else {
-		for _, col := range dbInfo.collections {
-			if !contains(collectionNamesDump, col) {
-				return fmt.Errorf(errorCollectionNotFound, col)
-			}
+// getDocumentCounts returns the number of documents of the synchronized
+// collections, or of all collections if none are configured.
+func getDocumentCounts(ctx context.Context, dbInfo *DatabaseInfo, host string) (map[string]int64, error) {
+	collections := dbInfo.collections
+	if len(collections) == 0 {
+		names, err := getCollectionNames(ctx, dbInfo, host)
+		if err != nil {
+			return nil, err
 		}
+		collections = names
 	}
-	return nil
-}
 
-//getCollectionNames returns the collection names from a database.
-func getCollectionNames(dbInfo *DatabaseInfo, host string) ([]string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	db, err := getDatabase(ctx, dbInfo, host)
 	if err != nil {
-		cancel()
 		return nil, err
 	}
-	collections, err := db.ListCollectionNames(ctx, bson.M{})
-	cancel()
-	return collections, err
+	defer db.Client().Disconnect(context.Background())
+
+	counts := map[string]int64{}
+	for _, col := range collections {
+		count, err := db.Collection(col).CountDocuments(ctx, bson.M{})
+		if err != nil {
+			return nil, err
+		}
+		counts[col] = count
+	}
+	return counts, nil
 }
 
 // getFiles returns the files from a dump directory.
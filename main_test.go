@@ -6,6 +6,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	mr "github.com/mongodb/mongo-tools/mongorestore"
@@ -48,6 +49,22 @@ func assertError(t *testing.T, expectedMsg string, actualError error) {
 	}
 }
 
+// assertMissingInDump checks that the verification of the dump reports the
+// collection as missing.
+func assertMissingInDump(t *testing.T, dbInfo *DatabaseInfo, collection string) {
+	report, err := verifyDump(context.Background(), dbInfo)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if report.err() == nil {
+		t.Fatal("expected a mismatch, but the dump was verified.")
+	}
+	m := report.Mismatches[0]
+	if m.Collection != collection || m.Check != CheckCollection || m.Found != "missing in dump" {
+		t.Errorf("unexpected mismatch: %s", m)
+	}
+}
+
 func TestMain(m *testing.M) {
 	setEnvironmentVariables()
 	m.Run()
@@ -95,7 +112,7 @@ func TestMongoDumpAllCollections(t *testing.T) {
 		dumpDir:     os.Getenv("DUMP_DIR_ALL_COLLECTIONS"),
 		collections: getCollections(os.Getenv("CARTS_COLLECTIONS")),
 	}
-	if err := executeMongoDump(dbInfo); err != nil {
+	if err := executeMongoDump(context.Background(), dbInfo); err != nil {
 		t.Errorf("Error message: %s", err)
 	}
 	fmt.Printf("Duration: %s", GetDuration())
@@ -115,7 +132,7 @@ func TestMongoDumpOneCollection(t *testing.T) {
 		dumpDir:     os.Getenv("DUMP_DIR_ONE_COLLECTION"),
 		collections: getCollections(os.Getenv("CARTS_COLLECTIONS_2")),
 	}
-	if err := executeMongoDump(dbInfo); err != nil {
+	if err := executeMongoDump(context.Background(), dbInfo); err != nil {
 		t.Errorf("Error message: %s", err)
 	}
 	fmt.Printf("Duration: %s", GetDuration())
@@ -135,7 +152,7 @@ func TestMongoDumpMultipleCollections(t *testing.T) {
 		dumpDir:     os.Getenv("DUMP_DIR_MULTIPLE_COLLECTIONS"),
 		collections: getCollections(os.Getenv("CARTS_COLLECTIONS_3")),
 	}
-	if err := executeMongoDump(dbInfo); err != nil {
+	if err := executeMongoDump(context.Background(), dbInfo); err != nil {
 		t.Errorf("Error message: %s", err)
 	}
 	fmt.Printf("Duration: %s", GetDuration())
@@ -159,7 +176,7 @@ func TestMongoRestoreAllCollections(t *testing.T) {
 			mr.DropOption,
 		},
 	}
-	if err := executeMongoRestore(dbInfo); err != nil {
+	if err := executeMongoRestore(context.Background(), dbInfo); err != nil {
 		t.Errorf("Error message: %s", err)
 	}
 	fmt.Printf("Duration: %s", GetDuration())
@@ -183,7 +200,7 @@ func TestMongoRestoreOneCollection(t *testing.T) {
 			mr.DropOption,
 		},
 	}
-	if err := executeMongoRestore(dbInfo); err != nil {
+	if err := executeMongoRestore(context.Background(), dbInfo); err != nil {
 		t.Errorf("Error message: %s", err)
 	}
 	fmt.Printf("Duration: %s", GetDuration())
@@ -205,7 +222,7 @@ func TestMongoRestoreMultipleCollections(t *testing.T) {
 		collections: getCollections(os.Getenv("CARTS_COLLECTIONS_3")),
 		args:        []string{},
 	}
-	if err := executeMongoRestore(dbInfo); err != nil {
+	if err := executeMongoRestore(context.Background(), dbInfo); err != nil {
 		t.Errorf("Error message: %s", err)
 	}
 	fmt.Printf("Duration: %s", GetDuration())
@@ -229,15 +246,169 @@ func TestDatabaseSync(t *testing.T) {
 			mr.DropOption,
 		},
 	}
-	if err := executeMongoDump(dbInfo); err != nil {
+	if err := executeMongoDump(context.Background(), dbInfo); err != nil {
 		t.Errorf("Error message: %s", err)
 	}
-	if err := executeMongoRestore(dbInfo); err != nil {
+	if err := executeMongoRestore(context.Background(), dbInfo); err != nil {
 		t.Errorf("Error message: %s", err)
 	}
 	fmt.Printf("Duration: %s", GetDuration())
 }
 
+// TestDatabaseSyncSafeRestore restores a dump into staging collections
+// and swaps them into the target database.
+func TestDatabaseSyncSafeRestore(t *testing.T) {
+	fmt.Println("\n>> TestDatabaseSyncSafeRestore()")
+
+	dbInfo := &DatabaseInfo{
+		sourceDB:    os.Getenv("CARTS_SOURCEDB"),
+		targetDB:    os.Getenv("CARTS_TARGETDB"),
+		sourceHost:  os.Getenv("CARTS_SOURCE_HOST"),
+		targetHost:  os.Getenv("CARTS_TARGET_HOST"),
+		port:        os.Getenv("CARTS_PORT"),
+		dumpDir:     os.Getenv("DUMP_DIR_MULTIPLE_COLLECTIONS"),
+		collections: getCollections(os.Getenv("CARTS_COLLECTIONS_3")),
+		args: []string{
+			mr.DropOption,
+		},
+		safeRestore: true,
+	}
+	if err := executeMongoDump(context.Background(), dbInfo); err != nil {
+		t.Errorf("Error message: %s", err)
+	}
+	jobID := jobs.create("ctx-safe-restore", "event-safe-restore").ID
+	if err := restoreTarget(context.Background(), jobID, dbInfo); err != nil {
+		t.Errorf("Error message: %s", err)
+	}
+	report, err := verifyRestore(context.Background(), dbInfo)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if err := report.err(); err != nil {
+		t.Errorf("Error message: %s", err)
+	}
+}
+
+// TestDatabaseSyncStreaming executes a synchronization of two databases
+// without writing the dump to the dump directory.
+func TestDatabaseSyncStreaming(t *testing.T) {
+	fmt.Println("\n>> TestDatabaseSyncStreaming()")
+	StartTimer()
+
+	dbInfo := &DatabaseInfo{
+		sourceDB:    os.Getenv("CARTS_SOURCEDB"),
+		targetDB:    os.Getenv("CARTS_TARGETDB"),
+		sourceHost:  os.Getenv("CARTS_SOURCE_HOST"),
+		targetHost:  os.Getenv("CARTS_TARGET_HOST"),
+		port:        os.Getenv("CARTS_PORT"),
+		collections: getCollections(os.Getenv("CARTS_COLLECTIONS_3")),
+		args: []string{
+			mr.DropOption,
+		},
+		streaming: true,
+	}
+	if err := executeMongoStream(context.Background(), dbInfo); err != nil {
+		t.Errorf("Error message: %s", err)
+	}
+	fmt.Printf("Duration: %s", GetDuration())
+}
+
+// TestDatabaseSyncStorage dumps the collections as archives into an
+// in-memory storage and restores them from the storage.
+func TestDatabaseSyncStorage(t *testing.T) {
+	fmt.Println("\n>> TestDatabaseSyncStorage()")
+
+	dbInfo := &DatabaseInfo{
+		sourceDB:    os.Getenv("CARTS_SOURCEDB"),
+		targetDB:    os.Getenv("CARTS_TARGETDB"),
+		sourceHost:  os.Getenv("CARTS_SOURCE_HOST"),
+		targetHost:  os.Getenv("CARTS_TARGET_HOST"),
+		port:        os.Getenv("CARTS_PORT"),
+		collections: getCollections(os.Getenv("CARTS_COLLECTIONS_3")),
+		args: []string{
+			mr.DropOption,
+		},
+		storage:       newMemStorage(),
+		archivePrefix: "carts-db-canary/job",
+	}
+	ctx := context.Background()
+	for _, col := range getArchiveCollections(dbInfo) {
+		if err := dumpArchive(ctx, dbInfo, col); err != nil {
+			t.Fatalf("Error message: %s", err)
+		}
+	}
+	keys, _ := dbInfo.storage.List(ctx, "")
+	if len(keys) != 2 || keys[1] != "carts-db-canary/job/carts-db.items.archive" {
+		t.Errorf("unexpected archives: %v", keys)
+	}
+	for _, col := range getArchiveCollections(dbInfo) {
+		if err := restoreArchive(ctx, dbInfo, col); err != nil {
+			t.Errorf("Error message: %s", err)
+		}
+	}
+	if err := removeArchives(ctx, dbInfo); err != nil {
+		t.Errorf("Error message: %s", err)
+	}
+}
+
+// TestDatabaseSyncDryRun plans the synchronization of two collections of
+// the carts database.
+func TestDatabaseSyncDryRun(t *testing.T) {
+	fmt.Println("\n>> TestDatabaseSyncDryRun()")
+
+	dbInfo := &DatabaseInfo{
+		sourceDB:    os.Getenv("CARTS_SOURCEDB"),
+		targetDB:    os.Getenv("CARTS_TARGETDB"),
+		sourceHost:  os.Getenv("CARTS_SOURCE_HOST"),
+		targetHost:  os.Getenv("CARTS_TARGET_HOST"),
+		port:        os.Getenv("CARTS_PORT"),
+		dumpDir:     os.Getenv("DUMP_DIR_MULTIPLE_COLLECTIONS"),
+		collections: append(getCollections(os.Getenv("CARTS_COLLECTIONS_3")), "unknown"),
+		args: []string{
+			mr.DropOption,
+		},
+	}
+	plan, err := planSync(context.Background(), dbInfo, "")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if len(plan.Collections) != 2 || plan.Collections[0].Collection != "items" || plan.Collections[0].SourceDocuments == 0 {
+		t.Errorf("unexpected plan: %+v", plan)
+	}
+	if len(plan.Warnings) != 1 || plan.DumpDir != dbInfo.dumpDir {
+		t.Errorf("unexpected plan: %+v", plan)
+	}
+}
+
+// TestChecksumVerification synchronizes the carts database and compares
+// the documents of the source and the target.
+func TestChecksumVerification(t *testing.T) {
+	fmt.Println("\n>> TestChecksumVerification()")
+
+	dbInfo := &DatabaseInfo{
+		sourceDB:    os.Getenv("CARTS_SOURCEDB"),
+		targetDB:    os.Getenv("CARTS_TARGETDB"),
+		sourceHost:  os.Getenv("CARTS_SOURCE_HOST"),
+		targetHost:  os.Getenv("CARTS_TARGET_HOST"),
+		port:        os.Getenv("CARTS_PORT"),
+		collections: getCollections(os.Getenv("CARTS_COLLECTIONS_3")),
+		args: []string{
+			mr.DropOption,
+		},
+		streaming: true,
+	}
+	if err := executeMongoStream(context.Background(), dbInfo); err != nil {
+		t.Errorf("Error message: %s", err)
+	}
+	report, err := verifyChecksums(context.Background(), dbInfo)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if err := report.err(); err != nil {
+		t.Errorf("Error message: %s", err)
+	}
+}
+
 // TestLargeDatabase executes a synchronization of two large databases.
 func TestLargeDatabase(t *testing.T) {
 	fmt.Println("\n>> TestLargeDatabase()")
@@ -255,10 +426,10 @@ func TestLargeDatabase(t *testing.T) {
 			mr.DropOption,
 		},
 	}
-	if err := executeMongoDump(dbInfo); err != nil {
+	if err := executeMongoDump(context.Background(), dbInfo); err != nil {
 		t.Errorf("Error message: %s", err)
 	}
-	if err := executeMongoRestore(dbInfo); err != nil {
+	if err := executeMongoRestore(context.Background(), dbInfo); err != nil {
 		t.Errorf("Error message: %s", err)
 	}
 	fmt.Printf("Duration: %s", GetDuration())
@@ -277,12 +448,15 @@ func TestNotExistingSourceDB(t *testing.T) {
 		dumpDir:     os.Getenv("DUMP_DIR_ALL_COLLECTIONS"),
 		collections: getCollections(os.Getenv("CARTS_COLLECTIONS")),
 	}
-	err := executeMongoDump(dbInfo)
+	if err := executeMongoDump(context.Background(), dbInfo); err != nil {
+		t.Errorf("Error message: %s", err)
+	}
+	_, err := verifyDump(context.Background(), dbInfo)
 	assertError(t, errorDumpedFiles, err)
 }
 
 // TestNotAllCollectionsDumped1 executes a mongo dump of all collections,
-// deletes a dumped file and checks the expected error.
+// deletes a dumped file and checks the reported mismatch.
 func TestNotAllCollectionsDumped1(t *testing.T) {
 	fmt.Println("\n>> TestNotAllCollectionsDumped1()")
 
@@ -298,16 +472,15 @@ func TestNotAllCollectionsDumped1(t *testing.T) {
 			mr.DropOption,
 		},
 	}
-	if err := executeMongoDump(dbInfo); err != nil {
+	if err := executeMongoDump(context.Background(), dbInfo); err != nil {
 		t.Errorf("error message: %s", err)
 	}
-	os.Remove(dbInfo.dumpDir + "\\" + dbInfo.sourceDB + "\\items.metadata.json")
-	err := executeMongoRestore(dbInfo)
-	assertError(t, errorNotAllCollsDumped, err)
+	os.Remove(filepath.Join(dbInfo.dumpDir, dbInfo.sourceDB, "items.metadata.json"))
+	assertMissingInDump(t, dbInfo, "items")
 }
 
 // TestNotAllCollectionsDumped2 executes a mongo dump of a specific collection,
-// deletes a dumped file and checks the expected error.
+// deletes a dumped file and checks the reported mismatch.
 func TestNotAllCollectionsDumped2(t *testing.T) {
 	fmt.Println("\n>> TestNotAllCollectionsDumped2()")
 
@@ -323,11 +496,9 @@ func TestNotAllCollectionsDumped2(t *testing.T) {
 			mr.DropOption,
 		},
 	}
-	if err := executeMongoDump(dbInfo); err != nil {
+	if err := executeMongoDump(context.Background(), dbInfo); err != nil {
 		t.Errorf("error message: %s", err)
 	}
-	os.Remove(dbInfo.dumpDir + "\\" + dbInfo.sourceDB + "\\items.metadata.json")
-	err := executeMongoRestore(dbInfo)
-	expected := fmt.Sprintf(errorCollectionNotFound, os.Getenv("CARTS_COLLECTIONS_2"))
-	assertError(t, expected, err)
+	os.Remove(filepath.Join(dbInfo.dumpDir, dbInfo.sourceDB, "items.metadata.json"))
+	assertMissingInDump(t, dbInfo, os.Getenv("CARTS_COLLECTIONS_2"))
 }
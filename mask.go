@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// MaskHash replaces a value by its HMAC-SHA256 with the masking key
+	MaskHash = "hash"
+	// MaskRedact replaces a value by a fixed value
+	MaskRedact = "redact"
+	// MaskFake replaces a value by a fake value derived from it
+	MaskFake = "fake"
+	// MaskDrop removes a field
+	MaskDrop = "drop"
+
+	redacted = "REDACTED"
+)
+
+// MaskRule describes how a field of the documents of a collection is masked.
+type MaskRule struct {
+	// Field is the dotted path of the field, arrays on the path are traversed
+	Field string `yaml:"field"`
+	// Action is hash, redact, fake or drop
+	Action string `yaml:"action"`
+	// Value replaces redacted values, default: REDACTED
+	Value string `yaml:"value"`
+	// Fake is the kind of fake value: email, name, phone, address or text
+	Fake string `yaml:"fake"`
+
+	// key is the masking key of the service, which is hashed with the value
+	// by the hash and fake actions
+	key []byte
+}
+
+// MaskingStats counts the changes of the masking of a collection.
+type MaskingStats struct {
+	Documents int64 `json:"documents"`
+	Fields    int64 `json:"fields"`
+}
+
+// maskFunc returns the masked value of a field.
+type maskFunc func(value interface{}, rule MaskRule) interface{}
+
+// maskFuncs holds the actions replacing a value. New actions are added here,
+// the drop action is handled by the document traversal.
+var maskFuncs = map[string]maskFunc{
+	MaskHash:   hashValue,
+	MaskRedact: redactValue,
+	MaskFake:   fakeValue,
+}
+
+// fakers generate a fake value of a kind from a seed.
+var fakers = map[string]func(seed uint32) string{
+	"email": func(seed uint32) string {
+		return fmt.Sprintf("user%08x@example.com", seed)
+	},
+	"name": func(seed uint32) string {
+		return fakeFirstNames[seed%uint32(len(fakeFirstNames))] + " " + fakeLastNames[(seed/7)%uint32(len(fakeLastNames))]
+	},
+	"phone": func(seed uint32) string {
+		return fmt.Sprintf("+1-555-%04d", seed%10000)
+	},
+	"address": func(seed uint32) string {
+		return fmt.Sprintf("%d %s", seed%999+1, fakeStreets[seed%uint32(len(fakeStreets))])
+	},
+	"text": func(seed uint32) string {
+		return fmt.Sprintf("text-%08x", seed)
+	},
+}
+
+var (
+	fakeFirstNames = []string{"Alex", "Chris", "Jamie", "Kim", "Robin", "Sam", "Taylor", "Quinn"}
+	fakeLastNames  = []string{"Miller", "Smith", "Johnson", "Brown", "Garcia", "Lee", "Walker", "Young"}
+	fakeStreets    = []string{"Main Street", "Oak Avenue", "Park Road", "Elm Street", "Lake Drive"}
+)
+
+// validate checks that the action and the kind of fake value are known.
+func (rule MaskRule) validate() error {
+	if rule.Field == "" {
+		return fmt.Errorf("masking rule without field")
+	}
+	if _, ok := maskFuncs[rule.Action]; !ok && rule.Action != MaskDrop {
+		return fmt.Errorf("unknown masking action %s for field %s", rule.Action, rule.Field)
+	}
+	if rule.Action == MaskFake {
+		if _, ok := fakers[rule.fakeKind()]; !ok {
+			return fmt.Errorf("unknown fake value %s for field %s", rule.Fake, rule.Field)
+		}
+	}
+	return nil
+}
+
+// fakeKind returns the kind of fake value, which defaults to text.
+func (rule MaskRule) fakeKind() string {
+	if rule.Fake == "" {
+		return "text"
+	}
+	return rule.Fake
+}
+
+// hashValue returns the hex encoded HMAC-SHA256 of the value with the
+// masking key. Equal values get equal hashes, so masked fields can still be
+// joined, but without the key, values can not be found by hashing guesses.
+func hashValue(value interface{}, rule MaskRule) interface{} {
+	mac := hmac.New(sha256.New, rule.key)
+	mac.Write([]byte(valueString(value)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// loadMaskingKey reads the masking key from the file of a mounted secret.
+// Surrounding whitespace is removed.
+func loadMaskingKey(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read masking key: %s", err.Error())
+	}
+	key := []byte(strings.TrimSpace(string(content)))
+	if len(key) == 0 {
+		return nil, errors.New("masking key " + path + " is empty")
+	}
+	return key, nil
+}
+
+// withMaskingKey returns a copy of the rules of the collections which hash
+// with key.
+func withMaskingKey(masking map[string][]MaskRule, key []byte) map[string][]MaskRule {
+	keyed := make(map[string][]MaskRule, len(masking))
+	for col, rules := range masking {
+		keyed[col] = make([]MaskRule, len(rules))
+		for i, rule := range rules {
+			rule.key = key
+			keyed[col][i] = rule
+		}
+	}
+	return keyed
+}
+
+// redactValue returns the configured value or REDACTED.
+func redactValue(value interface{}, rule MaskRule) interface{} {
+	if rule.Value == "" {
+		return redacted
+	}
+	return rule.Value
+}
+
+// fakeValue returns a fake value which is derived from the HMAC-SHA256 of
+// the original value with the masking key, so equal values get equal fake
+// values, but the fake values of guessed values can not be computed without
+// the key.
+func fakeValue(value interface{}, rule MaskRule) interface{} {
+	mac := hmac.New(sha256.New, rule.key)
+	mac.Write([]byte(valueString(value)))
+	return fakers[rule.fakeKind()](binary.BigEndian.Uint32(mac.Sum(nil)))
+}
+
+// valueString returns a string representation of a BSON value.
+func valueString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	content, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: value}}, true, false)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(content)
+}
+
+// maskDocument applies the rules to a document and returns the number of
+// changed fields.
+func maskDocument(doc primitive.D, rules []MaskRule) (primitive.D, int) {
+	changed := 0
+	for _, rule := range rules {
+		var n int
+		doc, n = maskPath(doc, strings.Split(rule.Field, "."), rule)
+		changed += n
+	}
+	return doc, changed
+}
+
+// maskPath applies a rule to the field at path below doc. Documents in
+// arrays on the path are masked as well.
+func maskPath(doc primitive.D, path []string, rule MaskRule) (primitive.D, int) {
+	for i, e := range doc {
+		if e.Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			if rule.Action == MaskDrop {
+				return append(doc[:i:i], doc[i+1:]...), 1
+			}
+			doc[i].Value = maskFuncs[rule.Action](e.Value, rule)
+			return doc, 1
+		}
+		var n int
+		doc[i].Value, n = maskValue(e.Value, path[1:], rule)
+		return doc, n
+	}
+	return doc, 0
+}
+
+// maskValue applies a rule to a nested document or to the documents of an
+// array.
+func maskValue(value interface{}, path []string, rule MaskRule) (interface{}, int) {
+	switch v := value.(type) {
+	case primitive.D:
+		return maskPath(v, path, rule)
+	case primitive.A:
+		changed := 0
+		for i := range v {
+			var n int
+			v[i], n = maskValue(v[i], path, rule)
+			changed += n
+		}
+		return v, changed
+	}
+	return value, 0
+}
+
+// maskBSON reads the documents of a .bson stream, applies the rules and
+// writes the documents to w. Unchanged documents are copied as they are.
+func maskBSON(r io.Reader, w io.Writer, rules []MaskRule) (MaskingStats, error) {
+	stats := MaskingStats{}
+	for {
+		raw, err := readBSONDocument(r)
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+
+		doc := primitive.D{}
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return stats, err
+		}
+		doc, changed := maskDocument(doc, rules)
+		if changed > 0 {
+			if raw, err = bson.Marshal(doc); err != nil {
+				return stats, err
+			}
+			stats.Documents++
+			stats.Fields += int64(changed)
+		}
+		if _, err := w.Write(raw); err != nil {
+			return stats, err
+		}
+	}
+}
+
+// maskDump rewrites the dumped documents of every collection with masking
+// rules and returns the changes per collection.
+func maskDump(dbInfo *DatabaseInfo) (map[string]MaskingStats, error) {
+	files, err := getDumpedFiles(dbInfo)
+	if err != nil {
+		return nil, fmt.Errorf(errorDumpedFiles)
+	}
+	dir := filepath.Join(dbInfo.dumpDir, dbInfo.sourceDB)
+
+	result := map[string]MaskingStats{}
+	for _, file := range files {
+		name, kind := splitDumpFileName(file.Name())
+		rules, ok := dbInfo.masking[name]
+		if kind != ".bson" || !ok {
+			continue
+		}
+		var stats MaskingStats
+		err := rewriteDumpFile(filepath.Join(dir, file.Name()), func(r io.Reader, w io.Writer) (err error) {
+			stats, err = maskBSON(r, w, rules)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to mask collection %s: %s", name, err.Error())
+		}
+		result[name] = stats
+	}
+	return result, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestMaskBSON masks a stream of user documents with nested fields and
+// arrays and checks the changed documents and fields.
+func TestMaskBSON(t *testing.T) {
+	fmt.Println("\n>> TestMaskBSON()")
+
+	docs := []bson.D{
+		{
+			{Key: "_id", Value: 1},
+			{Key: "email", Value: "jane@example.org"},
+			{Key: "name", Value: "Jane Doe"},
+			{Key: "password", Value: "secret"},
+			{Key: "addresses", Value: bson.A{
+				bson.D{{Key: "street", Value: "1 Real Street"}, {Key: "city", Value: "Linz"}},
+				bson.D{{Key: "street", Value: "2 Real Street"}, {Key: "city", Value: "Graz"}},
+			}},
+		},
+		{{Key: "_id", Value: 2}, {Key: "cart", Value: bson.D{{Key: "items", Value: 3}}}},
+	}
+	var in bytes.Buffer
+	for _, doc := range docs {
+		in.Write(mustMarshal(t, doc))
+	}
+
+	rules := []MaskRule{
+		{Field: "email", Action: MaskFake, Fake: "email"},
+		{Field: "name", Action: MaskHash},
+		{Field: "password", Action: MaskDrop},
+		{Field: "addresses.street", Action: MaskRedact},
+		{Field: "phone", Action: MaskRedact},
+	}
+	var out bytes.Buffer
+	stats, err := maskBSON(&in, &out, rules)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if stats.Documents != 1 || stats.Fields != 5 {
+		t.Errorf("unexpected masking stats: %+v", stats)
+	}
+
+	masked, err := readBSONDocument(&out)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	user := primitive.D{}
+	if err := bson.Unmarshal(masked, &user); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	fields := user.Map()
+	if _, ok := fields["password"]; ok {
+		t.Error("expected the password to be dropped")
+	}
+	if fields["email"] != fakeValue("jane@example.org", rules[0]) || fields["email"] == "jane@example.org" {
+		t.Errorf("unexpected email: %v", fields["email"])
+	}
+	if fields["name"] != hashValue("Jane Doe", rules[1]) {
+		t.Errorf("unexpected name: %v", fields["name"])
+	}
+	for _, address := range fields["addresses"].(primitive.A) {
+		if street := address.(primitive.D).Map()["street"]; street != redacted {
+			t.Errorf("unexpected street: %v", street)
+		}
+	}
+
+	if !bytes.Equal(out.Bytes(), mustMarshal(t, docs[1])) {
+		t.Error("expected the document without masked fields to be copied unchanged")
+	}
+}
+
+// mustMarshal returns the BSON encoding of a document.
+func mustMarshal(t *testing.T, doc bson.D) []byte {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	return raw
+}
+
+// TestMaskingKey hashes and fakes values with the masking key of a mounted
+// secret.
+func TestMaskingKey(t *testing.T) {
+	fmt.Println("\n>> TestMaskingKey()")
+
+	dir, err := ioutil.TempDir("", "masking")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key")
+	ioutil.WriteFile(path, []byte("c2VjcmV0IG1hc2tpbmcga2V5\n"), 0600)
+
+	key, err := loadMaskingKey(path)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if string(key) != "c2VjcmV0IG1hc2tpbmcga2V5" {
+		t.Errorf("unexpected masking key: %s", key)
+	}
+	ioutil.WriteFile(path, []byte("\n"), 0600)
+	assertError(t, "masking key "+path+" is empty", func() error { _, err := loadMaskingKey(path); return err }())
+
+	masking := map[string][]MaskRule{"users": {{Field: "email", Action: MaskHash}}}
+	keyed := withMaskingKey(masking, key)
+	if masking["users"][0].key != nil {
+		t.Error("expected the configured rules to be kept without key")
+	}
+	hashed := hashValue("jane@example.org", keyed["users"][0])
+	unsalted := sha256.Sum256([]byte("jane@example.org"))
+	if hashed == hex.EncodeToString(unsalted[:]) {
+		t.Error("expected the hash to depend on the masking key")
+	}
+	if hashed != hashValue("jane@example.org", keyed["users"][0]) {
+		t.Error("expected equal values to get equal hashes")
+	}
+	other := withMaskingKey(masking, []byte("another key"))
+	if hashed == hashValue("jane@example.org", other["users"][0]) {
+		t.Error("expected different keys to give different hashes")
+	}
+
+	fakes := map[string][]MaskRule{"users": {{Field: "email", Action: MaskFake, Fake: "email"}}}
+	faked := fakeValue("jane@example.org", withMaskingKey(fakes, key)["users"][0])
+	if faked != fakeValue("jane@example.org", withMaskingKey(fakes, key)["users"][0]) {
+		t.Error("expected equal values to get equal fake values")
+	}
+	if faked == fakeValue("jane@example.org", withMaskingKey(fakes, []byte("another key"))["users"][0]) {
+		t.Error("expected different keys to give different fake values")
+	}
+}
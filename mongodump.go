@@ -1,73 +1,103 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 
-	commonopts "github.com/mongodb/mongo-tools-common/options"
 	md "github.com/mongodb/mongo-tools/mongodump"
 )
 
-// getMongoDump returns an initialized MongoDump object.
-func getMongoDump(dbInfo *DatabaseInfo) *md.MongoDump {
-	connection := &commonopts.Connection{
-		Host: dbInfo.sourceHost,
-		Port: dbInfo.port,
+// getMongoDump returns an initialized MongoDump object for a collection, or
+// for all collections if col is empty. The query of the collection filter,
+// bounded by its limit, is passed to mongodump.
+func getMongoDump(dbInfo *DatabaseInfo, col string) (*md.MongoDump, error) {
+	toolOptions, err := getToolOptions(dbInfo.getURI("source"), dbInfo.sourceDB)
+	if err != nil {
+		return nil, err
 	}
+	toolOptions.Collection = col
 
-	toolOptions := &commonopts.ToolOptions{
-		Connection: connection,
-		Namespace:  &commonopts.Namespace{DB: dbInfo.sourceDB},
-		Auth: &commonopts.Auth{
-			Username: "",
-			Password: "",
-		},
-		URI: &commonopts.URI{},
+	query, err := dbInfo.filters[col].getDumpQuery()
+	if err != nil {
+		return nil, err
 	}
-
-	inputOptions := &md.InputOptions{}
+	inputOptions := &md.InputOptions{Query: query}
 	outputOptions := &md.OutputOptions{
-		NumParallelCollections: 1,
+		NumParallelCollections: dbInfo.getParallelCollections(),
 		Out:                    dbInfo.dumpDir,
+		Gzip:                   dbInfo.gzip,
 	}
 
 	return &md.MongoDump{
 		ToolOptions:   toolOptions,
 		InputOptions:  inputOptions,
 		OutputOptions: outputOptions,
+	}, nil
+}
+
+// getArchiveDump returns a MongoDump object which writes a collection, or
+// all collections if col is empty, as archive to w.
+func getArchiveDump(dbInfo *DatabaseInfo, col string, w io.Writer) (*md.MongoDump, error) {
+	mongoDump, err := getMongoDump(dbInfo, col)
+	if err != nil {
+		return nil, err
 	}
+	mongoDump.OutputOptions.Out = ""
+	mongoDump.OutputOptions.Archive = archiveStdio
+	mongoDump.OutputWriter = w
+	return mongoDump, nil
+}
+
+// runDump runs an initialized dump, which is aborted if ctx is done. The
+// progress is logged with the logger of ctx.
+func runDump(ctx context.Context, mongoDump *md.MongoDump) error {
+	bars := startProgress(ctx, false)
+	defer bars.Stop()
+	mongoDump.ProgressManager = bars
+
+	return runTool(ctx, mongoDump.SessionProvider, mongoDump.Dump)
 }
 
-// initAndDump initializes a MongoDump Object and restores collections.
-func initAndDump(dbInfo *DatabaseInfo, col string) error {
-	mongoDump := getMongoDump(dbInfo)
-	mongoDump.ToolOptions.Collection = col
+// initAndDump initializes a MongoDump Object and dumps collections. The dump
+// is aborted if ctx is done.
+func initAndDump(ctx context.Context, dbInfo *DatabaseInfo, col string) error {
+	mongoDump, err := getMongoDump(dbInfo, col)
+	if err != nil {
+		loggerFrom(ctx).Error(fmt.Sprintf("mongo dump initialization failed: %s", err))
+		return err
+	}
 
 	if err := mongoDump.Init(); err != nil {
-		fmt.Printf("mongo dump initialization failed: %s", err)
+		loggerFrom(ctx).Error(fmt.Sprintf("mongo dump initialization failed: %s", err))
 		return err
 	}
-	if err := mongoDump.Dump(); err != nil {
-		fmt.Printf("mongo dump failed: %s", err)
+	if err := runDump(ctx, mongoDump); err != nil {
+		loggerFrom(ctx).Error(fmt.Sprintf("mongo dump failed: %s", err))
 		return err
 	}
 	return nil
 }
 
-// executeMongoDump processes a mongodump operation.
-func executeMongoDump(dbInfo *DatabaseInfo) error {
+// executeMongoDump processes a mongodump operation. The collections are
+// dumped in parallel until ctx is done, the dump of a collection is retried
+// after transient errors.
+func executeMongoDump(ctx context.Context, dbInfo *DatabaseInfo) error {
+	if dbInfo.archive {
+		return forEachCollection(ctx, getArchiveCollections(dbInfo), dbInfo.getParallelCollections(), func(ctx context.Context, col string) error {
+			return withRetry(ctx, dbInfo, "dump", col, func(ctx context.Context) error {
+				return dumpArchive(ctx, dbInfo, col)
+			})
+		})
+	}
 	if len(dbInfo.collections) == 0 { //dump all collections
-		if err := initAndDump(dbInfo, ""); err != nil {
-			return err
-		}
-	} else {
-		for _, col := range dbInfo.collections {
-			if err := initAndDump(dbInfo, col); err != nil {
-				return err
-			}
-		}
+		return withRetry(ctx, dbInfo, "dump", "", func(ctx context.Context) error {
+			return initAndDump(ctx, dbInfo, "")
+		})
 	}
-	//if err := assertDatabaseConsistency(dbInfo, "source"); err != nil {
-	//	return err
-	//}
-	return nil
+	return forEachCollection(ctx, dbInfo.collections, dbInfo.getParallelCollections(), func(ctx context.Context, col string) error {
+		return withRetry(ctx, dbInfo, "dump", col, func(ctx context.Context) error {
+			return initAndDump(ctx, dbInfo, col)
+		})
+	})
 }
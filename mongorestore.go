@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 
-	commonopts "github.com/mongodb/mongo-tools-common/options"
+	"github.com/mongodb/mongo-tools-common/progress"
 	mr "github.com/mongodb/mongo-tools/mongorestore"
+	"github.com/mongodb/mongo-tools/mongorestore/ns"
 )
 
 // getMongoRestore returns an initialized MongoRestore object.
@@ -14,17 +17,16 @@ func getMongoRestore(dbInfo *DatabaseInfo, targetDir string) (*mr.MongoRestore,
 		return nil, err
 	}
 
-	connection := &commonopts.Connection{
-		Host: dbInfo.targetHost,
-		Port: dbInfo.port,
+	opts.ToolOptions, err = getToolOptions(dbInfo.getURI("target"), "")
+	if err != nil {
+		return nil, err
 	}
-
-	opts.ToolOptions = &commonopts.ToolOptions{
-		Connection: connection,
-		Auth: &commonopts.Auth{
-			Username: "",
-			Password: "",
-		},
+	opts.InputOptions.Gzip = dbInfo.gzip
+	if dbInfo.parallelCollections > 0 {
+		opts.OutputOptions.NumParallelCollections = dbInfo.parallelCollections
+	}
+	if dbInfo.insertionWorkers > 0 {
+		opts.OutputOptions.NumInsertionWorkers = dbInfo.insertionWorkers
 	}
 
 	restore, err := mr.New(opts)
@@ -37,37 +39,86 @@ func getMongoRestore(dbInfo *DatabaseInfo, targetDir string) (*mr.MongoRestore,
 	return restore, nil
 }
 
+// getArchiveRestore returns a MongoRestore object which restores the
+// archive read from r into the target database.
+func getArchiveRestore(dbInfo *DatabaseInfo, r io.Reader) (*mr.MongoRestore, error) {
+	restore, err := getMongoRestore(dbInfo, "")
+	if err != nil {
+		return nil, err
+	}
+	restore.InputOptions.Archive = archiveStdio
+	restore.InputReader = r
+	restore.NSOptions.DB = ""
+	restore.NSOptions.NSFrom = []string{ns.Escape(dbInfo.sourceDB) + ".$collection$"}
+	restore.NSOptions.NSTo = []string{ns.Escape(dbInfo.targetDB) + ".$collection$"}
+	return restore, nil
+}
+
+// runRestore runs a restore, which is aborted if ctx is done. The progress
+// is logged with the logger of ctx instead of the global log of mongo-tools.
+func runRestore(ctx context.Context, restore *mr.MongoRestore) error {
+	if bars, ok := restore.ProgressManager.(*progress.BarWriter); ok {
+		bars.Stop()
+	}
+	bars := startProgress(ctx, true)
+	defer bars.Stop()
+	restore.ProgressManager = bars
+
+	err := runTool(ctx, restore.SessionProvider, func() error {
+		return restore.Restore().Err
+	})
+	if err != nil {
+		loggerFrom(ctx).Error(fmt.Sprintf("mongo restore failed: %s", err))
+	}
+	return err
+}
+
 // initAndRestore initializes a MongoRestore Object and restores collections.
-func initAndRestore(dbInfo *DatabaseInfo, targetDir string) error {
+func initAndRestore(ctx context.Context, dbInfo *DatabaseInfo, targetDir string) error {
 	restore, err := getMongoRestore(dbInfo, targetDir)
 	if err != nil {
-		fmt.Printf("mongo restore initialization failed: %s", err)
+		loggerFrom(ctx).Error(fmt.Sprintf("mongo restore initialization failed: %s", err))
 		return err
 	}
-	if result := restore.Restore(); result.Err != nil {
-		fmt.Printf("mongo restore failed: %s", result.Err)
-		return result.Err
+	return runRestore(ctx, restore)
+}
+
+// restoreCollection restores the data file of a collection into the given
+// collection of the target database.
+func restoreCollection(ctx context.Context, dbInfo *DatabaseInfo, path string, collection string) error {
+	restore, err := getMongoRestore(dbInfo, path)
+	if err != nil {
+		loggerFrom(ctx).Error(fmt.Sprintf("mongo restore initialization failed: %s", err))
+		return err
 	}
-	return nil
+	restore.NSOptions.Collection = collection
+	return runRestore(ctx, restore)
 }
 
-// executeMongoRestore processes a restore operation.
-func executeMongoRestore(dbInfo *DatabaseInfo) error {
+// executeMongoRestore processes a restore operation. The collections are
+// restored in parallel until ctx is done, the restore of a collection is
+// retried after transient errors.
+func executeMongoRestore(ctx context.Context, dbInfo *DatabaseInfo) error {
+	if dbInfo.archive {
+		return forEachCollection(ctx, getArchiveCollections(dbInfo), dbInfo.getParallelCollections(), func(ctx context.Context, col string) error {
+			return withRetry(ctx, dbInfo, "restore", col, func(ctx context.Context) error {
+				return restoreArchive(ctx, dbInfo, col)
+			})
+		})
+	}
 	if len(dbInfo.collections) == 0 {
 		targetDir := dbInfo.dumpDir + "/" + dbInfo.sourceDB
-		if err := initAndRestore(dbInfo, targetDir); err != nil {
+		return withRetry(ctx, dbInfo, "restore", "", func(ctx context.Context) error {
+			return initAndRestore(ctx, dbInfo, targetDir)
+		})
+	}
+	return forEachCollection(ctx, dbInfo.collections, dbInfo.getParallelCollections(), func(ctx context.Context, col string) error {
+		targetDir, err := getDumpDataFile(dbInfo, col)
+		if err != nil {
 			return err
 		}
-	} else {
-		for _, col := range dbInfo.collections {
-			targetDir := dbInfo.dumpDir + "/" + dbInfo.sourceDB + "/" + col + ".bson"
-			if err := initAndRestore(dbInfo, targetDir); err != nil {
-				return err
-			}
-		}
-	}
-	//if err := assertDatabaseConsistency(dbInfo, "target"); err != nil {
-	//	return err
-	//}
-	return nil
+		return withRetry(ctx, dbInfo, "restore", col, func(ctx context.Context) error {
+			return initAndRestore(ctx, dbInfo, targetDir)
+		})
+	})
 }
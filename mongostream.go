@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// archiveStdio is the archive path mongodump and mongorestore use for
+// writing to OutputWriter and reading from InputReader.
+const archiveStdio = "-"
+
+// initAndStream dumps a collection, or all collections if col is empty, as
+// archive into a pipe and restores the archive from the other end of the pipe.
+// Both are aborted if ctx is done.
+func initAndStream(ctx context.Context, dbInfo *DatabaseInfo, col string) error {
+	reader, writer := io.Pipe()
+
+	restore, err := getArchiveRestore(dbInfo, reader)
+	if err != nil {
+		loggerFrom(ctx).Error(fmt.Sprintf("mongo restore initialization failed: %s", err))
+		return err
+	}
+
+	mongoDump, err := getArchiveDump(dbInfo, col, writer)
+	if err != nil {
+		loggerFrom(ctx).Error(fmt.Sprintf("mongo dump initialization failed: %s", err))
+		return err
+	}
+
+	dumpErr := make(chan error, 1)
+	go func() {
+		err := mongoDump.Init()
+		if err == nil {
+			err = runDump(ctx, mongoDump)
+		}
+		if err != nil {
+			loggerFrom(ctx).Error(fmt.Sprintf("mongo dump failed: %s", err))
+		}
+		// a nil error closes the pipe with io.EOF, which ends the restore
+		writer.CloseWithError(err)
+		dumpErr <- err
+	}()
+
+	restoreErr := runRestore(ctx, restore)
+	// unblocks the dump if the restore stopped reading
+	reader.CloseWithError(restoreErr)
+
+	err = <-dumpErr
+	switch {
+	case err != nil && restoreErr != nil:
+		// one side failed and closed the pipe, which also failed the other side
+		return fmt.Errorf("mongo dump failed: %s, mongo restore failed: %s", err, restoreErr)
+	case err != nil:
+		return err
+	}
+	return restoreErr
+}
+
+// executeMongoStream processes a mongodump and a mongorestore operation
+// without writing the dump to the dump directory. The collections are
+// streamed in parallel until ctx is done, the stream of a collection is
+// retried after transient errors.
+func executeMongoStream(ctx context.Context, dbInfo *DatabaseInfo) error {
+	if len(dbInfo.collections) == 0 { //stream all collections
+		return withRetry(ctx, dbInfo, "stream", "", func(ctx context.Context) error {
+			return initAndStream(ctx, dbInfo, "")
+		})
+	}
+	return forEachCollection(ctx, dbInfo.collections, dbInfo.getParallelCollections(), func(ctx context.Context, col string) error {
+		return withRetry(ctx, dbInfo, "stream", col, func(ctx context.Context) error {
+			return initAndStream(ctx, dbInfo, col)
+		})
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// collectionError is the error of a collection processed in parallel.
+type collectionError struct {
+	Collection string
+	Err        error
+}
+
+// collectionErrors are the errors of all failed collections, in the order of
+// the collections.
+type collectionErrors []collectionError
+
+// Error lists the failed collections with their errors.
+func (e collectionErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, ce := range e {
+		messages[i] = fmt.Sprintf("collection %s: %s", ce.Collection, ce.Err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// getParallelCollections returns the number of collections which are
+// dumped and restored at the same time.
+func (dbInfo *DatabaseInfo) getParallelCollections() int {
+	if dbInfo.parallelCollections < 1 {
+		return 1
+	}
+	return dbInfo.parallelCollections
+}
+
+// forEachCollection calls fn for every collection, at most parallel calls
+// run at the same time. After the first failure, ctx of the running calls
+// is cancelled, which aborts them, and no further collections are started.
+// The errors of all collections which failed before are returned together,
+// the errors of the aborted calls are not reported.
+func forEachCollection(ctx context.Context, collections []string, parallel int, fn func(ctx context.Context, col string) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := map[string]error{}
+	slots := make(chan struct{}, parallel)
+
+	for _, col := range collections {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(col string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if err := fn(ctx, col); err != nil {
+				mu.Lock()
+				if ctx.Err() == nil {
+					failed[col] = err
+				}
+				mu.Unlock()
+				cancel()
+			}
+		}(col)
+	}
+	wg.Wait()
+
+	errs := collectionErrors{}
+	for _, col := range collections {
+		if err, ok := failed[col]; ok {
+			errs = append(errs, collectionError{Collection: col, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return ctx.Err()
+}
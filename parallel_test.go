@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestForEachCollection processes collections in parallel, bounded by the
+// number of parallel collections, and stops after a failure.
+func TestForEachCollection(t *testing.T) {
+	fmt.Println("\n>> TestForEachCollection()")
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	processed := []string{}
+	collections := []string{"items", "categories", "users", "orders", "carts"}
+	err := forEachCollection(context.Background(), collections, 2, func(ctx context.Context, col string) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		processed = append(processed, col)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Error message: %s", err)
+	}
+	if len(processed) != len(collections) || maxRunning != 2 {
+		t.Errorf("unexpected processing, processed: %v, max. running: %d", processed, maxRunning)
+	}
+
+	processed = []string{}
+	err = forEachCollection(context.Background(), collections, 2, func(ctx context.Context, col string) error {
+		switch col {
+		case "items":
+			<-ctx.Done()
+			return errors.New("dump interrupted")
+		case "categories":
+			return errors.New("no such collection")
+		}
+		mu.Lock()
+		processed = append(processed, col)
+		mu.Unlock()
+		return nil
+	})
+	// items is aborted by the failure of categories
+	expected := "collection categories: no such collection"
+	if err == nil || err.Error() != expected {
+		t.Errorf("unexpected error, expected: %s, found: %v", expected, err)
+	}
+	if len(processed) != 0 {
+		t.Errorf("expected no collections to be started after the failure, processed: %v", processed)
+	}
+}
+
+// TestParallelArchivePhases checks that a job whose archives are dumped and
+// restored in parallel is in a single restoring phase.
+func TestParallelArchivePhases(t *testing.T) {
+	fmt.Println("\n>> TestParallelArchivePhases()")
+
+	defer func(r *jobRegistry) { jobs = r }(jobs)
+	jobs = newJobRegistry()
+	job := jobs.create("ctx-parallel", "event-1")
+
+	dbInfo := &DatabaseInfo{
+		sourceDB:            "carts-db",
+		targetDB:            "carts-db-canary",
+		collections:         []string{"items", "categories", "users"},
+		parallelCollections: 2,
+		storage:             newMemStorage(),
+		archivePrefix:       "carts-db-canary/job",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := archiveSync(ctx, job.ID, dbInfo); err == nil {
+		t.Error("expected an error, but no error was thrown.")
+	}
+	found, _ := jobs.get(job.ID)
+	if len(found.Phases) != 1 || found.Phases[0].State != JobRestoring {
+		t.Errorf("unexpected phases: %+v", found.Phases)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	mr "github.com/mongodb/mongo-tools/mongorestore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// SyncDryRun is the mode of a job which plans a synchronization without
+	// dumping or restoring anything
+	SyncDryRun = "dryRun"
+)
+
+// The actions of a planned synchronization on a target collection.
+const (
+	// PlanCreate restores a collection which does not exist in the target
+	PlanCreate = "create"
+	// PlanReplace drops the target collection and restores it
+	PlanReplace = "replace"
+	// PlanReplaceStaged restores into a staging collection, which replaces
+	// the target collection after it is verified
+	PlanReplaceStaged = "replaceStaged"
+	// PlanInsert inserts the documents into the existing target collection,
+	// documents with an existing _id are kept
+	PlanInsert = "insert"
+	// PlanReplay replays the changes since the checkpoint
+	PlanReplay = "replay"
+)
+
+// syncEventOptions are the options of a configuration change event besides
+// the Keptn fields.
+type syncEventOptions struct {
+	// DryRun plans the synchronization without running it
+	DryRun bool `json:"dryRun"`
+}
+
+// SyncPlan describes what a synchronization would do.
+type SyncPlan struct {
+	// Namespace is the namespace of the hosts, <project>-<stage>
+	Namespace string          `json:"namespace"`
+	Source    DatabaseSummary `json:"source"`
+	Target    DatabaseSummary `json:"target"`
+	// Mode is full or incremental
+	Mode string `json:"mode"`
+	// DumpDir is the directory the dump would be written to, empty if the
+	// dump is streamed or stored as archives
+	DumpDir     string           `json:"dumpDir,omitempty"`
+	Collections []CollectionPlan `json:"collections"`
+	// Dropped are the target collections which would be dropped or replaced
+	Dropped []string `json:"dropped"`
+	// Documents and Size are the number of documents and the estimated size
+	// in bytes which would be written into the target database
+	Documents int64 `json:"documents"`
+	Size      int64 `json:"size"`
+	// Warnings are problems the synchronization would run into
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// CollectionPlan describes what a synchronization would do with a
+// collection.
+type CollectionPlan struct {
+	Collection string `json:"collection"`
+	// Action is create, replace, replaceStaged, insert or replay
+	Action string `json:"action"`
+	// SourceDocuments is the number of documents selected by the filter of
+	// the collection, SourceSize their estimated size in bytes. Both are
+	// estimated if the collection is sampled.
+	SourceDocuments int64 `json:"sourceDocuments"`
+	SourceSize      int64 `json:"sourceSize"`
+	// TargetDocuments and TargetSize describe the existing target collection
+	TargetExists    bool  `json:"targetExists"`
+	TargetDocuments int64 `json:"targetDocuments,omitempty"`
+	TargetSize      int64 `json:"targetSize,omitempty"`
+	Filtered        bool  `json:"filtered,omitempty"`
+	Sampled         bool  `json:"sampled,omitempty"`
+	Masked          bool  `json:"masked,omitempty"`
+}
+
+// startDryRun queues the dry run of a job on the scheduler, so it can be
+// cancelled and is stopped by the shutdown like a synchronization. Dry runs
+// only read the databases, so they are queued apart from the
+// synchronizations of their target database.
+func startDryRun(stdLogger *Logger, jobID string, dbInfo *DatabaseInfo, namespace string) {
+	jobs.setMode(jobID, SyncDryRun, 0)
+	stdLogger.Debug(fmt.Sprintf("Dry run of the synchronization of %s queued", dbInfo.getTargetKey()))
+	syncScheduler.submit(&syncTask{
+		jobID:  jobID,
+		target: dbInfo.getTargetKey() + "#" + SyncDryRun,
+		policy: PolicyQueue,
+		run: func(ctx context.Context) {
+			runDryRun(withLogger(ctx, stdLogger), jobID, dbInfo, namespace)
+		},
+		drop: func(err error) {
+			jobs.finish(jobID, 0, err)
+			recordJob(stdLogger, jobID, dbInfo)
+		},
+	})
+}
+
+// runDryRun plans the synchronization of a job and records the plan in the
+// job. No event is sent, as nothing is synchronized.
+func runDryRun(ctx context.Context, jobID string, dbInfo *DatabaseInfo, namespace string) {
+	stdLogger := loggerFrom(ctx)
+	jobs.setState(jobID, JobPlanning)
+	stdLogger.Debug(fmt.Sprintf("Dry run of the synchronization of %s started", dbInfo.getTargetKey()))
+
+	start := time.Now()
+	var plan *SyncPlan
+	err := runPhase(ctx, "dry run", dbInfo.timeouts.Total, func(ctx context.Context) (err error) {
+		plan, err = planSync(ctx, dbInfo, namespace)
+		return err
+	})
+	if err != nil {
+		stdLogger.Error(fmt.Sprintf("Dry run failed: %s", err.Error()))
+	} else {
+		jobs.update(jobID, func(job *Job) {
+			job.Plan = plan
+		})
+		stdLogger.Info(fmt.Sprintf("Dry run done: %d collections, %d documents (%d bytes) would be written, %d target collections dropped",
+			len(plan.Collections), plan.Documents, plan.Size, len(plan.Dropped)))
+	}
+	jobs.finish(jobID, time.Since(start), err)
+	recordJob(stdLogger, jobID, dbInfo)
+}
+
+// planSync connects to the source and target database and plans the
+// synchronization of the collections.
+func planSync(ctx context.Context, dbInfo *DatabaseInfo, namespace string) (*SyncPlan, error) {
+	plan := &SyncPlan{
+		Namespace:   namespace,
+		Source:      DatabaseSummary{Host: dbInfo.sourceHost, Port: dbInfo.port, Database: dbInfo.sourceDB},
+		Target:      DatabaseSummary{Host: dbInfo.targetHost, Port: dbInfo.getTargetPort(), Database: dbInfo.targetDB},
+		Mode:        SyncFull,
+		Collections: []CollectionPlan{},
+		Dropped:     []string{},
+	}
+	if dbInfo.incremental {
+		cp, err := loadCheckpoint(dbInfo)
+		if err != nil {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("checkpoint can not be loaded, a full synchronization is done: %s", err.Error()))
+		}
+		if cp != nil {
+			plan.Mode = SyncIncremental
+		}
+	}
+	if plan.Mode == SyncFull && !dbInfo.streaming && dbInfo.storage == nil {
+		plan.DumpDir = dbInfo.dumpDir
+	}
+
+	source, err := getDatabase(ctx, dbInfo, "source")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to source database %s: %s", dbInfo.sourceDB, err.Error())
+	}
+	defer source.Client().Disconnect(context.Background())
+	target, err := getDatabase(ctx, dbInfo, "target")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to target database %s: %s", dbInfo.targetDB, err.Error())
+	}
+	defer target.Client().Disconnect(context.Background())
+
+	sourceNames, err := listCollections(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list collections of source database %s: %s", dbInfo.sourceDB, err.Error())
+	}
+	targetNames, err := listCollections(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list collections of target database %s: %s", dbInfo.targetDB, err.Error())
+	}
+
+	collections := dbInfo.collections
+	if len(collections) == 0 {
+		collections = sourceNames
+	}
+	for _, col := range collections {
+		if !contains(sourceNames, col) {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("collection %s does not exist in the source database", col))
+			continue
+		}
+		cp, err := planCollection(ctx, dbInfo, plan.Mode, source, target, col, contains(targetNames, col))
+		if err != nil {
+			return nil, err
+		}
+		plan.Collections = append(plan.Collections, *cp)
+		if cp.Action == PlanReplace || cp.Action == PlanReplaceStaged {
+			plan.Dropped = append(plan.Dropped, col)
+		}
+		if cp.Action != PlanReplay {
+			plan.Documents += cp.SourceDocuments
+			plan.Size += cp.SourceSize
+		}
+	}
+	return plan, nil
+}
+
+// planCollection counts the documents of a source collection and of the
+// target collection, if it exists, and decides the action.
+func planCollection(ctx context.Context, dbInfo *DatabaseInfo, mode string, source *mongo.Database,
+	target *mongo.Database, col string, targetExists bool) (*CollectionPlan, error) {
+
+	filter := dbInfo.filters[col]
+	cp := &CollectionPlan{
+		Collection:   col,
+		Action:       getPlanAction(dbInfo, mode, targetExists),
+		TargetExists: targetExists,
+		Filtered:     filter.Query != "" || filter.Limit > 0,
+		Sampled:      filter.isSampled(),
+		Masked:       len(dbInfo.masking[col]) > 0,
+	}
+
+	query, err := filter.getQuery()
+	if err != nil {
+		return nil, err
+	}
+	count, err := source.Collection(col).CountDocuments(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to count documents of source collection %s: %s", col, err.Error())
+	}
+	cp.SourceDocuments, _ = filter.getExpectedCount(count)
+	if cp.Sampled {
+		cp.SourceDocuments = int64(float64(cp.SourceDocuments) * filter.Sample / 100)
+	}
+	size, total, err := getCollectionSize(ctx, source, col)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get size of source collection %s: %s", col, err.Error())
+	}
+	cp.SourceSize = estimateSize(size, total, cp.SourceDocuments)
+
+	if targetExists {
+		if cp.TargetSize, cp.TargetDocuments, err = getCollectionSize(ctx, target, col); err != nil {
+			return nil, fmt.Errorf("Failed to get size of target collection %s: %s", col, err.Error())
+		}
+	}
+	return cp, nil
+}
+
+// getPlanAction returns what the synchronization does with a target
+// collection.
+func getPlanAction(dbInfo *DatabaseInfo, mode string, targetExists bool) string {
+	switch {
+	case mode == SyncIncremental:
+		return PlanReplay
+	case !targetExists:
+		return PlanCreate
+	case dbInfo.safeRestore:
+		return PlanReplaceStaged
+	case contains(dbInfo.args, mr.DropOption):
+		return PlanReplace
+	}
+	return PlanInsert
+}
+
+// getCollectionSize returns the size in bytes and the number of documents of
+// a collection from its statistics.
+func getCollectionSize(ctx context.Context, db *mongo.Database, col string) (int64, int64, error) {
+	var stats struct {
+		Size  int64 `bson:"size,truncate"`
+		Count int64 `bson:"count,truncate"`
+	}
+	if err := db.RunCommand(ctx, bson.D{{Key: "collStats", Value: col}}).Decode(&stats); err != nil {
+		return 0, 0, err
+	}
+	return stats.Size, stats.Count, nil
+}
+
+// estimateSize estimates the size of documents of a collection from its
+// size and its number of documents.
+func estimateSize(size int64, count int64, documents int64) int64 {
+	if count == 0 || documents >= count {
+		return size
+	}
+	return int64(float64(size) / float64(count) * float64(documents))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go"
+	keptnevents "github.com/keptn/go-utils/pkg/events"
+	mr "github.com/mongodb/mongo-tools/mongorestore"
+)
+
+// TestPlanActions checks the planned action on a target collection.
+func TestPlanActions(t *testing.T) {
+	fmt.Println("\n>> TestPlanActions()")
+
+	drop := &DatabaseInfo{args: []string{mr.DropOption}}
+	keep := &DatabaseInfo{args: []string{}}
+	safe := &DatabaseInfo{args: []string{mr.DropOption}, safeRestore: true}
+
+	tests := []struct {
+		name         string
+		dbInfo       *DatabaseInfo
+		mode         string
+		targetExists bool
+		expected     string
+	}{
+		{"new collection", drop, SyncFull, false, PlanCreate},
+		{"drop", drop, SyncFull, true, PlanReplace},
+		{"keep existing", keep, SyncFull, true, PlanInsert},
+		{"safe restore", safe, SyncFull, true, PlanReplaceStaged},
+		{"safe restore of a new collection", safe, SyncFull, false, PlanCreate},
+		{"incremental", drop, SyncIncremental, true, PlanReplay},
+	}
+	for _, test := range tests {
+		if action := getPlanAction(test.dbInfo, test.mode, test.targetExists); action != test.expected {
+			t.Errorf("%s: unexpected action, expected: %s, found: %s", test.name, test.expected, action)
+		}
+	}
+
+	if size := estimateSize(1000, 10, 4); size != 400 {
+		t.Errorf("unexpected estimated size, expected: 400, found: %d", size)
+	}
+	if size := estimateSize(1000, 10, 20); size != 1000 {
+		t.Errorf("unexpected estimated size, expected: 1000, found: %d", size)
+	}
+	if size := estimateSize(0, 0, 0); size != 0 {
+		t.Errorf("unexpected estimated size of an empty collection: %d", size)
+	}
+}
+
+// TestDryRunUnreachable runs a dry run against a database which is not
+// reachable, which fails the job without synchronizing anything.
+func TestDryRunUnreachable(t *testing.T) {
+	fmt.Println("\n>> TestDryRunUnreachable()")
+
+	defer func(r *jobRegistry) { jobs = r }(jobs)
+	jobs = newJobRegistry()
+	defer func(h HistoryStore) { jobHistory = h }(jobHistory)
+	jobHistory = nil
+
+	defer func(s *scheduler) { syncScheduler = s }(syncScheduler)
+	syncScheduler = newScheduler(PolicyQueue)
+	syncScheduler.start(1)
+
+	uri := "mongodb://127.0.0.1:1/?serverSelectionTimeoutMS=200&connectTimeoutMS=200"
+	dbInfo := &DatabaseInfo{sourceDB: "carts-db", targetDB: "carts-db-canary", sourceURI: uri, targetURI: uri,
+		timeouts: Timeouts{Total: 10 * time.Second}}
+	job := jobs.create("ctx-1", "event-1")
+	startDryRun(defaultLogger, job.ID, dbInfo, "sockshop-dev")
+	found := waitForJob(t, job.ID)
+	if found.Mode != SyncDryRun || found.State != JobFailed || found.Plan != nil || found.Error == "" {
+		t.Errorf("unexpected job: %+v", found)
+	}
+	if len(found.Phases) != 1 || found.Phases[0].State != JobPlanning {
+		t.Errorf("unexpected phases: %+v", found.Phases)
+	}
+
+	// a dry run is interrupted by the shutdown like a synchronization
+	dbInfo.sourceURI = "mongodb://127.0.0.1:1/"
+	dbInfo.targetURI = dbInfo.sourceURI
+	job = jobs.create("ctx-2", "event-2")
+	startDryRun(defaultLogger, job.ID, dbInfo, "sockshop-dev")
+	for found, _ := jobs.get(job.ID); found.State != JobPlanning; found, _ = jobs.get(job.ID) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	syncScheduler.shutdown(ctx)
+	if found, _ := jobs.get(job.ID); found.State != JobInterrupted || found.InterruptedIn != JobPlanning {
+		t.Errorf("unexpected job: %+v", found)
+	}
+}
+
+// waitForJob waits until a job is finished.
+func waitForJob(t *testing.T, jobID string) Job {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		job, _ := jobs.get(jobID)
+		if job.isFinished() {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s not finished: %+v", jobID, job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestDryRunOptions rejects a configuration change event with malformed
+// options without creating a job.
+func TestDryRunOptions(t *testing.T) {
+	fmt.Println("\n>> TestDryRunOptions()")
+
+	defer func(r *jobRegistry) { jobs = r }(jobs)
+	jobs = newJobRegistry()
+
+	event := cloudevents.NewEvent()
+	event.SetID("event-1")
+	event.SetType(keptnevents.ConfigurationChangeEventType)
+	event.SetSource("test")
+	event.SetDataContentType(cloudevents.ApplicationJSON)
+	event.SetData(map[string]interface{}{"project": "sockshop", "service": "carts", "dryRun": "yes"})
+
+	if err := gotEvent(context.Background(), event); err == nil {
+		t.Errorf("expected the event with malformed options to be rejected")
+	}
+	if len(jobs.list("")) != 0 {
+		t.Errorf("unexpected jobs: %+v", jobs.list(""))
+	}
+}
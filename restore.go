@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudevents/sdk-go/pkg/cloudevents"
+	keptnevents "github.com/keptn/go-utils/pkg/events"
+)
+
+const (
+	// RestoreEventType is a CloudEvent for restoring a snapshot into the target database of a service
+	RestoreEventType = "sh.keptn.event.mongodb.restore"
+
+	// SyncRestore is the mode of a job which restores a snapshot without
+	// dumping the source database
+	SyncRestore = "restore"
+)
+
+// RestoreEventData represents the data for a restore event
+type RestoreEventData struct {
+	// Project is the name of the project
+	Project string `json:"project"`
+	// Stage is the name of the stage, the first stage of the project if empty
+	Stage string `json:"stage"`
+	// Service is the name of the service whose target database is restored
+	Service string `json:"service"`
+	// Snapshot is the id of the restored snapshot
+	Snapshot string `json:"snapshot"`
+}
+
+// restoreTestDB restores the snapshot of a restore event.
+func restoreTestDB(event cloudevents.Event, shkeptncontext string, jobID string) {
+	stdLogger := newLogger(shkeptncontext, event.Context.GetID()).withJob(jobID)
+
+	data := &RestoreEventData{}
+	if err := event.DataAs(data); err != nil {
+		stdLogger.Error(fmt.Sprintf("Got Data Error: %s", err.Error()))
+	}
+	startRestore(stdLogger, shkeptncontext, jobID, data)
+}
+
+// startRestore queues the restore of a snapshot into the target database of
+// a service. Errors before the restore is queued finish the job.
+func startRestore(stdLogger *Logger, shkeptncontext string, jobID string, data *RestoreEventData) {
+	e := &keptnevents.ConfigurationChangeEventData{Project: data.Project, Stage: data.Stage, Service: data.Service}
+	if e.Stage == "" {
+		e.Stage, _ = getFirstStage(e.Project)
+	}
+	jobs.setService(jobID, e.Project, e.Stage, e.Service)
+	stdLogger = stdLogger.withService(e.Project, e.Stage, e.Service)
+	jobs.setMode(jobID, SyncRestore, 0)
+	jobs.setSnapshot(jobID, data.Snapshot)
+
+	sc, err := syncConfig.get(e.Project, e.Stage, e.Service)
+	if err != nil {
+		finishSync(stdLogger, shkeptncontext, jobID, e, nil, 0, err)
+		return
+	}
+	dbInfo, err := newDatabaseInfo(sc, e.Project+"-"+e.Stage)
+	if err != nil {
+		finishSync(stdLogger, shkeptncontext, jobID, e, nil, 0, err)
+		return
+	}
+	dbInfo.jobID = jobID
+	// the restore invalidates the checkpoint of incremental synchronizations
+	dbInfo.checkpointFile = filepath.Join(dbInfo.dumpDir, checkpointDir, url.PathEscape(dbInfo.getTargetKey())+".json")
+
+	// the snapshot is pinned until the restore has finished, so it is not
+	// pruned by a synchronization of the same source
+	snapshot, err := pinSnapshot(getDumpDirs(), data.Snapshot)
+	if err != nil {
+		finishSync(stdLogger, shkeptncontext, jobID, e, dbInfo, 0, err)
+		return
+	}
+	if err := useSnapshot(dbInfo, snapshot); err != nil {
+		unpinSnapshot(snapshot)
+		finishSync(stdLogger, shkeptncontext, jobID, e, dbInfo, 0, err)
+		return
+	}
+
+	stdLogger.Debug(fmt.Sprintf("Restore of snapshot %s into %s queued", snapshot.ID, dbInfo.getTargetKey()))
+	syncScheduler.submit(&syncTask{
+		jobID:  jobID,
+		target: dbInfo.getTargetKey(),
+		policy: sc.Options.OverlapPolicy,
+		run: func(ctx context.Context) {
+			ctx = withLogger(ctx, stdLogger)
+			defer unpinSnapshot(snapshot)
+			stdLogger.Debug("Snapshot restore started")
+			start := time.Now()
+			err := runPhase(ctx, "restore of snapshot", dbInfo.timeouts.Total, func(ctx context.Context) error {
+				return restoreSync(ctx, jobID, dbInfo)
+			})
+			finishSync(stdLogger, shkeptncontext, jobID, e, dbInfo, time.Since(start), err)
+		},
+		drop: func(err error) {
+			unpinSnapshot(snapshot)
+			finishSync(stdLogger, shkeptncontext, jobID, e, dbInfo, 0, err)
+		},
+	})
+}
+
+// useSnapshot points the database information of a service at a snapshot.
+// The snapshot replaces the source database, it is restored as it is, i.e.
+// without masking and filters, and verified against the target database.
+func useSnapshot(dbInfo *DatabaseInfo, snapshot *SnapshotManifest) error {
+	for _, col := range dbInfo.collections {
+		if _, ok := snapshot.Collections[col]; !ok {
+			return fmt.Errorf("collection %s is not contained in snapshot %s", col, snapshot.ID)
+		}
+	}
+	if snapshot.Archive {
+		// the archives of the snapshot are restored, an archive of the
+		// database contains every collection
+		if len(snapshot.Archives) == 0 && len(dbInfo.collections) > 0 {
+			return fmt.Errorf("snapshot %s is an archive of all collections and can not be restored partially", snapshot.ID)
+		}
+		if len(dbInfo.collections) == 0 {
+			dbInfo.collections = snapshot.Archives
+		}
+	}
+	dbInfo.sourceDB = snapshot.Source.Database
+	dbInfo.sourceHost = snapshot.Source.Host
+	dbInfo.sourceURI = ""
+	dbInfo.port = snapshot.Source.Port
+	dbInfo.dumpDir = snapshot.dir
+	if len(snapshot.KeyIDs) == 0 {
+		dbInfo.encryption = nil
+	}
+	for _, id := range snapshot.KeyIDs {
+		if dbInfo.encryption == nil || dbInfo.encryption.keys[id] == nil {
+			return fmt.Errorf("snapshot %s is encrypted with key %s, which is not configured", snapshot.ID, id)
+		}
+	}
+	dbInfo.gzip = snapshot.Gzip
+	dbInfo.archive = snapshot.Archive
+	dbInfo.archivePrefix = ""
+	dbInfo.streaming = false
+	dbInfo.deepVerification = false
+	dbInfo.masking = nil
+	dbInfo.filters = nil
+	dbInfo.incremental = false
+	dbInfo.snapshots = nil
+	dbInfo.storage = nil
+	return nil
+}
+
+// restoreSync restores the snapshot of the database information into the
+// target database and verifies the target against the snapshot.
+func restoreSync(ctx context.Context, jobID string, dbInfo *DatabaseInfo) error {
+	stdLogger := loggerFrom(ctx)
+	if err := os.Remove(dbInfo.checkpointFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to remove checkpoint: %s", err.Error())
+	}
+
+	jobs.setState(jobID, JobRestoring)
+	stdLogger.Debug(fmt.Sprintf("start mongo restore of %s", dbInfo.dumpDir))
+	err := runPhase(ctx, "restore", dbInfo.timeouts.Restore, func(ctx context.Context) error {
+		return restoreTarget(ctx, jobID, dbInfo)
+	})
+	if isInterrupted(err) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to execute mongo restore on database  %s: %s", dbInfo.targetDB, err.Error())
+	}
+	stdLogger.Debug(fmt.Sprintf("mongo restore done"))
+	return verifyTarget(ctx, jobID, dbInfo)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// defaultMaxAttempts is the number of attempts of an operation without
+	// a configured retry policy
+	defaultMaxAttempts = 3
+	// defaultInitialBackoff is the backoff before the first retry without a
+	// configured retry policy
+	defaultInitialBackoff = time.Second
+	// defaultMaxBackoff limits the backoff without a configured retry policy
+	defaultMaxBackoff = 30 * time.Second
+)
+
+// retryableCodes are the codes of MongoDB errors which are caused by a
+// failover or a network problem: HostUnreachable, HostNotFound,
+// NetworkTimeout, ShutdownInProgress, PrimarySteppedDown, ExceededTimeLimit,
+// SocketException, NotMaster, InterruptedAtShutdown,
+// InterruptedDueToReplStateChange, NotMasterNoSlaveOk and
+// NotMasterOrSecondary.
+var retryableCodes = map[int32]bool{
+	6: true, 7: true, 89: true, 91: true, 189: true, 262: true, 9001: true,
+	10107: true, 11600: true, 11602: true, 13435: true, 13436: true,
+}
+
+// fatalMessages are parts of error messages which are not resolved by a
+// retry, like failed authentications. They take precedence over
+// retryableMessages, as the tools wrap authentication errors into
+// connection errors.
+var fatalMessages = []string{
+	"authentication failed",
+	"not authorized",
+	"unauthorized",
+	"auth error",
+}
+
+// retryableMessages are parts of error messages of network problems and
+// failovers. mongodump and mongorestore return most errors as text, so the
+// messages are checked besides the error types.
+var retryableMessages = []string{
+	"connection refused",
+	"connection reset",
+	"broken pipe",
+	"i/o timeout",
+	"unexpected eof",
+	"no reachable servers",
+	"server selection error",
+	"server selection timeout",
+	"error connecting to",
+	"not master",
+	"node is recovering",
+	"primary stepped down",
+	"interrupted due to repl state change",
+	"shutdown in progress",
+}
+
+// RetryPolicy configures how often an operation of a collection is
+// attempted when it fails with a retryable error.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one,
+	// defaults to 3. 1 disables retries.
+	MaxAttempts int `yaml:"maxAttempts"`
+	// InitialBackoff is the backoff before the first retry, defaults to 1s.
+	// It is doubled for every further retry.
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	// MaxBackoff limits the backoff, defaults to 30s.
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+// validate checks that the retry policy is not negative.
+func (p *RetryPolicy) validate() error {
+	if p.MaxAttempts < 0 || p.InitialBackoff < 0 || p.MaxBackoff < 0 {
+		return errors.New("invalid retry, maxAttempts, initialBackoff and maxBackoff must not be negative")
+	}
+	return nil
+}
+
+// getMaxAttempts returns the number of attempts of an operation.
+func (p *RetryPolicy) getMaxAttempts() int {
+	if p.MaxAttempts == 0 {
+		return defaultMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+// getBackoff returns the backoff before the given retry, starting with 1.
+// The backoff grows exponentially up to MaxBackoff, a random jitter of up
+// to half of the backoff is subtracted, so parallel retries do not hit the
+// database at the same time.
+func (p *RetryPolicy) getBackoff(retry int) time.Duration {
+	backoff, max := p.InitialBackoff, p.MaxBackoff
+	if backoff == 0 {
+		backoff = defaultInitialBackoff
+	}
+	if max == 0 {
+		max = defaultMaxBackoff
+	}
+	for i := 1; i < retry && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff - time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// Attempt records a failed attempt of an operation, or the successful
+// attempt after failed ones.
+type Attempt struct {
+	// Operation is dump, restore or stream
+	Operation string `json:"operation"`
+	// Collection is the collection of the operation, empty for all
+	// collections
+	Collection string `json:"collection,omitempty"`
+	// Attempt is the number of the attempt, starting with 1
+	Attempt int       `json:"attempt"`
+	Time    time.Time `json:"time"`
+	// Error is the error of a failed attempt
+	Error string `json:"error,omitempty"`
+	// Retryable is true if the error is transient
+	Retryable bool `json:"retryable,omitempty"`
+	// Backoff is the time waited before the next attempt, empty if the
+	// operation is not retried
+	Backoff string `json:"backoff,omitempty"`
+}
+
+// isRetryable returns true if err is a transient error of the network or a
+// failover of a replica set, which may be resolved by a retry. Errors like a
+// failed authentication or a missing database are not retried.
+func isRetryable(err error) bool {
+	if err == nil || isInterrupted(err) || err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if ce, ok := err.(mongo.CommandError); ok {
+		if ce.HasErrorLabel("NetworkError") || ce.HasErrorLabel("TransientTransactionError") || retryableCodes[ce.Code] {
+			return true
+		}
+	}
+	if ne, ok := err.(net.Error); ok && (ne.Timeout() || ne.Temporary()) {
+		return true
+	}
+	if _, ok := err.(*net.OpError); ok {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, fatal := range fatalMessages {
+		if strings.Contains(message, fatal) {
+			return false
+		}
+	}
+	for _, retryable := range retryableMessages {
+		if strings.Contains(message, retryable) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRetry runs an operation of a collection until it succeeds, fails with
+// an error which is not retryable or the attempts of the retry policy are
+// exhausted. Between the attempts, it waits for the backoff of the retry
+// policy. The failed attempts are recorded in the job of dbInfo, the
+// collection is added to the logger of ctx.
+func withRetry(ctx context.Context, dbInfo *DatabaseInfo, operation string, col string, fn func(ctx context.Context) error) error {
+	if col != "" {
+		ctx = withLogger(ctx, loggerFrom(ctx).withCollection(col))
+	}
+	maxAttempts := dbInfo.retry.getMaxAttempts()
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			if attempt > 1 {
+				jobs.addAttempt(dbInfo.jobID, Attempt{Operation: operation, Collection: col, Attempt: attempt, Time: time.Now()})
+			}
+			return nil
+		}
+		// an error caused by the cancellation of ctx is not recorded
+		if ctx.Err() != nil {
+			return err
+		}
+
+		record := Attempt{Operation: operation, Collection: col, Attempt: attempt, Time: time.Now(), Error: err.Error(), Retryable: isRetryable(err)}
+		if !record.Retryable || attempt >= maxAttempts {
+			jobs.addAttempt(dbInfo.jobID, record)
+			if attempt > 1 {
+				return fmt.Errorf("%s failed after %d attempts: %s", operation, attempt, err.Error())
+			}
+			return err
+		}
+		backoff := dbInfo.retry.getBackoff(attempt)
+		record.Backoff = backoff.String()
+		jobs.addAttempt(dbInfo.jobID, record)
+		loggerFrom(ctx).Info(fmt.Sprintf("%s failed, retrying in %s: %s", operation, backoff, err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
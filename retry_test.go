@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TestIsRetryable classifies transient and fatal errors.
+func TestIsRetryable(t *testing.T) {
+	fmt.Println("\n>> TestIsRetryable()")
+
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{errors.New("error connecting to host: connection() : dial tcp 10.0.0.1:27017: connect: connection refused"), true},
+		{errors.New("error reading collection: (NotMasterNoSlaveOk) not master and slaveOk=false"), true},
+		{errors.New("server selection error: server selection timeout"), true},
+		{mongo.CommandError{Code: 10107, Message: "not master"}, true},
+		{mongo.CommandError{Message: "socket closed", Labels: []string{"NetworkError"}}, true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, true},
+		{errors.New("error connecting to host: connection() : auth error: sasl conversation error: unable to authenticate using mechanism \"SCRAM-SHA-1\": (AuthenticationFailed) Authentication failed."), false},
+		{mongo.CommandError{Code: 13, Message: "not authorized on carts-db to execute command"}, false},
+		{errors.New("open /dump/carts-db/items.bson: no such file or directory"), false},
+		{&timeoutError{phase: "dump", timeout: time.Minute}, false},
+		{errCancelled, false},
+	}
+	for _, test := range tests {
+		if isRetryable(test.err) != test.retryable {
+			t.Errorf("unexpected classification of %q, expected retryable: %t", test.err, test.retryable)
+		}
+	}
+}
+
+// TestRetryBackoff checks that the backoff grows exponentially with jitter
+// up to the maximum.
+func TestRetryBackoff(t *testing.T) {
+	fmt.Println("\n>> TestRetryBackoff()")
+
+	policy := &RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	expected := map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second}
+	for retry, max := range expected {
+		if backoff := policy.getBackoff(retry); backoff < max/2 || backoff > max {
+			t.Errorf("unexpected backoff of retry %d, expected: %s to %s, found: %s", retry, max/2, max, backoff)
+		}
+	}
+}
+
+// TestWithRetry retries a collection after transient errors and records the
+// attempts in the job.
+func TestWithRetry(t *testing.T) {
+	fmt.Println("\n>> TestWithRetry()")
+
+	job := jobs.create("ctx-retry", "event-retry")
+	dbInfo := &DatabaseInfo{jobID: job.ID, retry: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}}
+
+	calls := 0
+	err := withRetry(context.Background(), dbInfo, "dump", "items", func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.New("dial tcp 10.0.0.1:27017: i/o timeout")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("unexpected result after %d calls: %v", calls, err)
+	}
+	found, _ := jobs.get(job.ID)
+	if len(found.Attempts) != 3 || found.Attempts[0].Backoff == "" || found.Attempts[2].Error != "" || found.Attempts[2].Attempt != 3 {
+		t.Errorf("unexpected attempts: %+v", found.Attempts)
+	}
+
+	calls = 0
+	err = withRetry(context.Background(), dbInfo, "restore", "users", func(ctx context.Context) error {
+		calls++
+		return errors.New("Authentication failed")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("expected a fatal error without retry, found %d calls: %v", calls, err)
+	}
+
+	calls = 0
+	err = withRetry(context.Background(), dbInfo, "restore", "orders", func(ctx context.Context) error {
+		calls++
+		return errors.New("connection refused")
+	})
+	if err == nil || err.Error() != "restore failed after 3 attempts: connection refused" || calls != 3 {
+		t.Errorf("unexpected result after %d calls: %v", calls, err)
+	}
+	found, _ = jobs.get(job.ID)
+	if last := found.Attempts[len(found.Attempts)-1]; len(found.Attempts) != 7 || last.Backoff != "" || !last.Retryable {
+		t.Errorf("unexpected attempts: %+v", found.Attempts)
+	}
+}
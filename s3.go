@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// file names of a mounted secret with the keys of the object storage
+	accessKeyFile = "accessKey"
+	secretKeyFile = "secretKey"
+
+	// s3PartSize is the size of the parts of a multipart upload, objects
+	// which are smaller are uploaded at once
+	s3PartSize = 8 << 20
+
+	defaultS3Region = "us-east-1"
+
+	// emptyPayloadHash is the sha256 hash of an empty request body
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Storage stores the objects in a bucket of an S3-compatible object
+// storage. The requests use path-style URLs and are signed with AWS
+// Signature Version 4.
+type s3Storage struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	partSize  int
+	client    *http.Client
+}
+
+// s3Error is the error response of the object storage.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// newS3Storage returns the storage of a bucket.
+func newS3Storage(endpoint, region, bucket, prefix, accessKey, secretKey string) (*s3Storage, error) {
+	u, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if region == "" {
+		region = defaultS3Region
+	}
+	return &s3Storage{
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		prefix:    prefix,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		partSize:  s3PartSize,
+		client:    http.DefaultClient,
+	}, nil
+}
+
+// parseEndpoint parses the URL of an object storage.
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage endpoint: %s", err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid storage endpoint %s, expected http(s)://<host>", endpoint)
+	}
+	return u, nil
+}
+
+// readStorageCredentials reads the access key and the secret key from the
+// directory of a mounted secret or from the environment.
+func readStorageCredentials(dir string) (string, string, error) {
+	if dir == "" {
+		return os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), nil
+	}
+	accessKey, err := ioutil.ReadFile(filepath.Join(dir, accessKeyFile))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read storage credentials: %s", err.Error())
+	}
+	secretKey, err := ioutil.ReadFile(filepath.Join(dir, secretKeyFile))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read storage credentials: %s", err.Error())
+	}
+	return strings.TrimSpace(string(accessKey)), strings.TrimSpace(string(secretKey)), nil
+}
+
+// Create returns a writer which uploads the object in parts.
+func (s *s3Storage) Create(ctx context.Context, key string) (ObjectWriter, error) {
+	return &s3ObjectWriter{ctx: ctx, storage: s, key: s.prefix + key}, nil
+}
+
+// Open downloads the object, the body of the response is streamed.
+func (s *s3Storage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.prefix+key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List requests the keys of the objects with ListObjectsV2.
+func (s *s3Storage) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(object.Key, s.prefix))
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Delete removes the object.
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.prefix+key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a signed request for an object of the bucket, or for the bucket
+// if key is empty. Responses with an error status are returned as error.
+func (s *s3Storage) do(ctx context.Context, method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = int64(len(body))
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	signV4(req, s.accessKey, s.secretKey, s.region, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound && method == http.MethodGet && key != "" {
+			return nil, errObjectNotFound
+		}
+		e := s3Error{}
+		xml.NewDecoder(resp.Body).Decode(&e)
+		return nil, fmt.Errorf("s3 %s %s failed with status %d: %s %s", method, key, resp.StatusCode, e.Code, e.Message)
+	}
+	return resp, nil
+}
+
+// signV4 adds the AWS Signature Version 4 of the request to its headers. The
+// host and all headers already set on the request are signed.
+func signV4(req *http.Request, accessKey string, secretKey string, region string, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes the query sorted by name with the escaping of
+// Signature Version 4.
+func canonicalQuery(query url.Values) string {
+	params := []string{}
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// s3Escape percent-encodes all characters except the unreserved ones and,
+// if keepSlash is set, the slash.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3ObjectWriter buffers an object and uploads it in parts of partSize.
+// Objects smaller than a part are uploaded with a single request.
+type s3ObjectWriter struct {
+	ctx      context.Context
+	storage  *s3Storage
+	key      string
+	buf      bytes.Buffer
+	uploadID string
+	parts    []s3Part
+}
+
+// s3Part is an uploaded part of a multipart upload.
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// Write buffers p and uploads the full parts.
+func (w *s3ObjectWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for w.buf.Len() >= w.storage.partSize {
+		if err := w.uploadPart(w.buf.Next(w.storage.partSize)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// uploadPart uploads the next part, the multipart upload is started with
+// the first part.
+func (w *s3ObjectWriter) uploadPart(part []byte) error {
+	if w.uploadID == "" {
+		resp, err := w.storage.do(w.ctx, http.MethodPost, w.key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		w.uploadID = result.UploadID
+	}
+
+	number := len(w.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {w.uploadID}}
+	resp, err := w.storage.do(w.ctx, http.MethodPut, w.key, query, part)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+// Close uploads the rest of the object and completes the multipart upload.
+func (w *s3ObjectWriter) Close() error {
+	if w.uploadID == "" {
+		resp, err := w.storage.do(w.ctx, http.MethodPut, w.key, nil, w.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if w.buf.Len() > 0 {
+		if err := w.uploadPart(w.buf.Next(w.buf.Len())); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := w.storage.do(w.ctx, http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, body)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	defer resp.Body.Close()
+	// the completion can fail after the status 200 was sent
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	e := s3Error{}
+	if xml.Unmarshal(content, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3 complete upload %s failed: %s %s", w.key, e.Code, e.Message)
+	}
+	return nil
+}
+
+// Abort discards the buffer and the uploaded parts.
+func (w *s3ObjectWriter) Abort() error {
+	w.buf.Reset()
+	if w.uploadID == "" {
+		return nil
+	}
+	resp, err := w.storage.do(context.Background(), http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil)
+	w.uploadID = ""
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
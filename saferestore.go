@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// stagingPrefix starts the names of the collections a safe restore
+	// loads the dump into
+	stagingPrefix = "tmp_restore_"
+	// backupPrefix starts the names of the collections the target
+	// collections are moved to while they are swapped
+	backupPrefix = "tmp_backup_"
+)
+
+// restoreTarget restores the dump into the target database, through staging
+// collections if safeRestore is set.
+func restoreTarget(ctx context.Context, jobID string, dbInfo *DatabaseInfo) error {
+	if dbInfo.safeRestore {
+		return safeRestore(ctx, jobID, dbInfo)
+	}
+	return executeMongoRestore(ctx, dbInfo)
+}
+
+// safeRestore restores every collection of the dump into a staging
+// collection of the target database, verifies the staging collections
+// against the dump and swaps them with the target collections. If the
+// restore, the verification or the swap fails or ctx is done before the
+// swap, the staging collections are dropped and the target collections are
+// left untouched.
+func safeRestore(ctx context.Context, jobID string, dbInfo *DatabaseInfo) error {
+	collections := dbInfo.collections
+	if len(collections) == 0 {
+		names, err := getDumpCollections(dbInfo)
+		if err != nil {
+			return err
+		}
+		collections = names
+	}
+	staging := map[string]string{}
+	for _, col := range collections {
+		staging[col] = getStagingName(jobID, col)
+	}
+
+	// the staging collections are dropped and swapped without ctx, so the
+	// target collections are either untouched or all replaced
+	background := withLogger(context.Background(), loggerFrom(ctx))
+	db, err := getDatabase(background, dbInfo, "target")
+	if err != nil {
+		return err
+	}
+	defer db.Client().Disconnect(background)
+
+	ops := &mongoCollections{db: db}
+
+	// staging and backup collections of interrupted attempts of the job and
+	// of jobs which are not running anymore, e.g. of a killed process, are
+	// removed first
+	if err := dropStaleCollections(background, ops, jobID); err != nil {
+		return err
+	}
+	defer dropStagingCollections(background, ops, jobID)
+
+	for _, col := range collections {
+		path, err := getDumpDataFile(dbInfo, col)
+		if err != nil {
+			return err
+		}
+		err = withRetry(ctx, dbInfo, "restore", col, func(ctx context.Context) error {
+			return restoreCollection(ctx, dbInfo, path, staging[col])
+		})
+		if err != nil {
+			return fmt.Errorf("failed to restore collection %s into %s: %s", col, staging[col], err.Error())
+		}
+	}
+
+	verify := func(ctx context.Context, dbInfo *DatabaseInfo) (*VerificationReport, error) {
+		return verifyStaging(ctx, dbInfo, collections, staging)
+	}
+	if err := runVerification(ctx, jobID, dbInfo, verify); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return swapCollections(background, ops, jobID, collections, staging)
+}
+
+// getJobCollectionPrefix returns the prefix of the staging or backup
+// collections of a job, which contains the start of the job id.
+func getJobCollectionPrefix(prefix string, jobID string) string {
+	if len(jobID) > 8 {
+		jobID = jobID[:8]
+	}
+	return prefix + jobID + "_"
+}
+
+// isTemporaryCollection returns true if name is a staging or backup
+// collection of a safe restore.
+func isTemporaryCollection(name string) bool {
+	return strings.HasPrefix(name, stagingPrefix) || strings.HasPrefix(name, backupPrefix)
+}
+
+// getStagingName returns the name of the staging collection of a job for a
+// collection.
+func getStagingName(jobID string, col string) string {
+	return getJobCollectionPrefix(stagingPrefix, jobID) + col
+}
+
+// getBackupName returns the name of the collection a job moves a target
+// collection to while it is swapped.
+func getBackupName(jobID string, col string) string {
+	return getJobCollectionPrefix(backupPrefix, jobID) + col
+}
+
+// getDumpCollections returns the names of the collections with a data file
+// in the dump directory. Views have no data file.
+func getDumpCollections(dbInfo *DatabaseInfo) ([]string, error) {
+	files, err := getDumpedFiles(dbInfo)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", errorDumpedFiles, err.Error())
+	}
+	names := []string{}
+	for _, file := range files {
+		name, kind := splitDumpFileName(file.Name())
+		if kind == ".bson" && !strings.HasPrefix(name, "system.") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// verifyStaging compares the dump with the staging collections of the
+// target database.
+func verifyStaging(ctx context.Context, dbInfo *DatabaseInfo, collections []string, staging map[string]string) (*VerificationReport, error) {
+	dump, err := getDumpState(dbInfo)
+	if err != nil {
+		return nil, err
+	}
+	target, err := getDatabaseState(ctx, dbInfo, "target")
+	if err != nil {
+		return nil, err
+	}
+	return compareStates("restore", "dump", dump, "staging", getStagedState(target, staging), collections, false), nil
+}
+
+// getStagedState returns the state of the staging collections under the
+// names of the collections they are renamed to.
+func getStagedState(target map[string]*collectionState, staging map[string]string) map[string]*collectionState {
+	state := map[string]*collectionState{}
+	for col, name := range staging {
+		if s, ok := target[name]; ok {
+			state[col] = s
+		}
+	}
+	return state
+}
+
+// collectionOps renames and drops the collections of a database.
+type collectionOps interface {
+	// list returns the names of the collections
+	list(ctx context.Context) ([]string, error)
+	// rename renames a collection, the collection to does not exist
+	rename(ctx context.Context, from string, to string) error
+	// drop drops a collection
+	drop(ctx context.Context, name string) error
+}
+
+// mongoCollections are the operations on the collections of a MongoDB
+// database.
+type mongoCollections struct {
+	db *mongo.Database
+}
+
+// list returns the names of the collections without views.
+func (c *mongoCollections) list(ctx context.Context) ([]string, error) {
+	return listCollections(ctx, c.db)
+}
+
+// rename runs renameCollection in the admin database.
+func (c *mongoCollections) rename(ctx context.Context, from string, to string) error {
+	cmd := bson.D{
+		{Key: "renameCollection", Value: c.db.Name() + "." + from},
+		{Key: "to", Value: c.db.Name() + "." + to},
+	}
+	return c.db.Client().Database("admin").RunCommand(ctx, cmd).Err()
+}
+
+// drop drops a collection.
+func (c *mongoCollections) drop(ctx context.Context, name string) error {
+	return c.db.Collection(name).Drop(ctx)
+}
+
+// swapCollections replaces the target collections by the staging
+// collections. The existing target collections are first renamed to backup
+// collections of the job, then the staging collections are renamed to the
+// target collections. If a rename fails, the swapped collections are
+// dropped and the backups are renamed back, so the target collections are
+// either all replaced or untouched. The swap is not atomic: from the backup
+// of the first collection until its staging collection is renamed, readers
+// of the target database do not find the collection. The backups are
+// dropped after every collection was swapped; a backup which can not be
+// dropped is logged and left to the next safe restore, as the target
+// collections are already replaced.
+func swapCollections(ctx context.Context, ops collectionOps, jobID string, collections []string, staging map[string]string) error {
+	existing, err := ops.list(ctx)
+	if err != nil {
+		return err
+	}
+	backups := []string{}
+	swapped := []string{}
+	rollback := func(err error) error {
+		var failed []string
+		for _, col := range swapped {
+			if dropErr := ops.drop(ctx, col); dropErr != nil {
+				failed = append(failed, fmt.Sprintf("drop of %s: %s", col, dropErr.Error()))
+			}
+		}
+		for _, col := range backups {
+			if renameErr := ops.rename(ctx, getBackupName(jobID, col), col); renameErr != nil {
+				failed = append(failed, fmt.Sprintf("rename of %s: %s", getBackupName(jobID, col), renameErr.Error()))
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("%s, rollback failed: %s", err.Error(), strings.Join(failed, ", "))
+		}
+		return fmt.Errorf("%s, the target collections were restored", err.Error())
+	}
+
+	for _, col := range collections {
+		if !contains(existing, col) {
+			continue
+		}
+		if err := ops.rename(ctx, col, getBackupName(jobID, col)); err != nil {
+			return rollback(fmt.Errorf("failed to back up collection %s: %s", col, err.Error()))
+		}
+		backups = append(backups, col)
+	}
+	for _, col := range collections {
+		if err := ops.rename(ctx, staging[col], col); err != nil {
+			return rollback(fmt.Errorf("failed to swap collection %s: %s", col, err.Error()))
+		}
+		swapped = append(swapped, col)
+	}
+	for _, col := range backups {
+		if err := ops.drop(ctx, getBackupName(jobID, col)); err != nil {
+			loggerFrom(ctx).Warning(fmt.Sprintf("Failed to drop backup %s of collection %s: %s", getBackupName(jobID, col), col, err.Error()))
+		}
+	}
+	return nil
+}
+
+// dropStagingCollections drops the staging collections of a job. Staging
+// collections of other jobs, which may still be restoring, are kept.
+func dropStagingCollections(ctx context.Context, ops collectionOps, jobID string) error {
+	names, err := ops.list(ctx)
+	if err != nil {
+		return err
+	}
+	prefix := getJobCollectionPrefix(stagingPrefix, jobID)
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if err := ops.drop(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropStaleCollections drops the staging and backup collections of a job
+// and of every job which is not running. Interrupted jobs are resumed with
+// a new id, so their collections would be left behind otherwise. The
+// collections of other running jobs are kept.
+func dropStaleCollections(ctx context.Context, ops collectionOps, jobID string) error {
+	names, err := ops.list(ctx)
+	if err != nil {
+		return err
+	}
+	owned := []string{}
+	for _, job := range jobs.list("") {
+		if job.ID != jobID && !job.isFinished() {
+			owned = append(owned, getJobCollectionPrefix(stagingPrefix, job.ID), getJobCollectionPrefix(backupPrefix, job.ID))
+		}
+	}
+	for _, name := range names {
+		if !isTemporaryCollection(name) || hasAnyPrefix(name, owned) {
+			continue
+		}
+		if err := ops.drop(ctx, name); err != nil {
+			return err
+		}
+		loggerFrom(ctx).Info(fmt.Sprintf("Dropped stale collection %s", name))
+	}
+	return nil
+}
+
+// hasAnyPrefix returns true if s starts with one of the prefixes.
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
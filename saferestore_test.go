@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestStagingCollections maps the collections of a dump to the staging
+// collections of a safe restore.
+func TestStagingCollections(t *testing.T) {
+	fmt.Println("\n>> TestStagingCollections()")
+
+	dumpDir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(dumpDir)
+	dbInfo := &DatabaseInfo{sourceDB: "carts-db", dumpDir: dumpDir}
+	dir := filepath.Join(dumpDir, dbInfo.sourceDB)
+	os.MkdirAll(dir, 0755)
+	writeDumpFile(t, dir, "items", 2, dumpMetadata{Indexes: []bson.D{}}, false)
+	writeDumpFile(t, dir, "categories", 1, dumpMetadata{Indexes: []bson.D{}}, false)
+	ioutil.WriteFile(filepath.Join(dir, "cheap.metadata.json"), []byte(`{"options": {"viewOn": "items"}}`), 0644)
+
+	collections, err := getDumpCollections(dbInfo)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if !reflect.DeepEqual(collections, []string{"categories", "items"}) {
+		t.Errorf("unexpected collections: %v", collections)
+	}
+
+	name := getStagingName("0f8fad5b-d9cb-469f-a165-70867728950e", "items")
+	if name != "tmp_restore_0f8fad5b_items" {
+		t.Errorf("unexpected staging collection: %s", name)
+	}
+	target := map[string]*collectionState{
+		"items": {Count: 7},
+		name:    {Count: 2},
+	}
+	staged := getStagedState(target, map[string]string{"items": name, "categories": getStagingName("0f8fad5b", "categories")})
+	if len(staged) != 1 || staged["items"].Count != 2 {
+		t.Errorf("unexpected staged state: %v", staged)
+	}
+}
+
+// fakeCollections are collections with a number of documents, of which
+// the failAt-th rename and the drop of failDrop fail.
+type fakeCollections struct {
+	collections map[string]int
+	renames     int
+	failAt      int
+	failDrop    string
+}
+
+func (c *fakeCollections) list(ctx context.Context) ([]string, error) {
+	names := []string{}
+	for name := range c.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (c *fakeCollections) rename(ctx context.Context, from string, to string) error {
+	c.renames++
+	if c.renames == c.failAt {
+		return errors.New("not master")
+	}
+	if _, ok := c.collections[to]; ok {
+		return fmt.Errorf("target namespace %s exists", to)
+	}
+	count, ok := c.collections[from]
+	if !ok {
+		return fmt.Errorf("source namespace %s does not exist", from)
+	}
+	delete(c.collections, from)
+	c.collections[to] = count
+	return nil
+}
+
+func (c *fakeCollections) drop(ctx context.Context, name string) error {
+	if name == c.failDrop {
+		return errors.New("not master")
+	}
+	delete(c.collections, name)
+	return nil
+}
+
+// TestSwapCollections swaps staging collections with the target
+// collections, rolls back swaps which fail on the second and the fourth
+// rename and drops only the staging collections of the job.
+func TestSwapCollections(t *testing.T) {
+	fmt.Println("\n>> TestSwapCollections()")
+
+	jobID := "0f8fad5b-d9cb-469f-a165-70867728950e"
+	collections := []string{"categories", "items", "users"}
+	staging := map[string]string{}
+	for _, col := range collections {
+		staging[col] = getStagingName(jobID, col)
+	}
+	newCollections := func(failAt int) *fakeCollections {
+		return &fakeCollections{failAt: failAt, collections: map[string]int{
+			"categories": 1, "items": 7, staging["categories"]: 2, staging["items"]: 3, staging["users"]: 5,
+			"tmp_restore_7c9e6679_items": 4,
+		}}
+	}
+	original := map[string]int{"categories": 1, "items": 7}
+
+	// the backup of the second collection fails
+	ops := newCollections(2)
+	err := swapCollections(context.Background(), ops, jobID, collections, staging)
+	assertError(t, "failed to back up collection items: not master, the target collections were restored", err)
+	for col, count := range original {
+		if ops.collections[col] != count {
+			t.Errorf("unexpected collections after the rollback: %v", ops.collections)
+		}
+	}
+	if _, ok := ops.collections[getBackupName(jobID, "categories")]; ok {
+		t.Errorf("unexpected backup after the rollback: %v", ops.collections)
+	}
+
+	// the swap of the second collection fails after the first was swapped
+	ops = newCollections(4)
+	err = swapCollections(context.Background(), ops, jobID, collections, staging)
+	assertError(t, "failed to swap collection items: not master, the target collections were restored", err)
+	if len(ops.collections) != 5 || ops.collections["categories"] != 1 || ops.collections["items"] != 7 || ops.collections[staging["items"]] != 3 {
+		t.Errorf("unexpected collections after the rollback: %v", ops.collections)
+	}
+
+	ops = newCollections(0)
+	if err := swapCollections(context.Background(), ops, jobID, collections, staging); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	expected := map[string]int{"categories": 2, "items": 3, "users": 5, "tmp_restore_7c9e6679_items": 4}
+	if !reflect.DeepEqual(ops.collections, expected) {
+		t.Errorf("unexpected collections after the swap: %v", ops.collections)
+	}
+
+	ops = newCollections(0)
+	if err := dropStagingCollections(context.Background(), ops, jobID); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	expected = map[string]int{"categories": 1, "items": 7, "tmp_restore_7c9e6679_items": 4}
+	if !reflect.DeepEqual(ops.collections, expected) {
+		t.Errorf("unexpected collections after dropping the staging collections: %v", ops.collections)
+	}
+
+	// a backup which can not be dropped does not fail the swapped restore
+	ops = newCollections(0)
+	ops.failDrop = getBackupName(jobID, "items")
+	if err := swapCollections(context.Background(), ops, jobID, collections, staging); err != nil {
+		t.Errorf("Error message: %s", err)
+	}
+	if ops.collections["items"] != 3 || ops.collections[getBackupName(jobID, "items")] != 7 {
+		t.Errorf("unexpected collections after the swap: %v", ops.collections)
+	}
+}
+
+// TestDropStaleCollections drops the staging and backup collections of
+// finished and unknown jobs, e.g. of a job interrupted by a killed process,
+// and keeps the ones of running jobs. Leftover collections are not verified.
+func TestDropStaleCollections(t *testing.T) {
+	fmt.Println("\n>> TestDropStaleCollections()")
+
+	defer func(r *jobRegistry) { jobs = r }(jobs)
+	jobs = newJobRegistry()
+	job := jobs.create("ctx-stale", "event-1")
+	jobs.setState(job.ID, JobRestoring)
+	running := jobs.create("ctx-stale", "event-2")
+	jobs.setState(running.ID, JobRestoring)
+	finished := jobs.create("ctx-stale", "event-3")
+	jobs.finish(finished.ID, time.Second, errShutdown)
+
+	ops := &fakeCollections{collections: map[string]int{
+		"items":                              7,
+		getStagingName(job.ID, "items"):      1,
+		getStagingName(running.ID, "items"):  2,
+		getBackupName(running.ID, "items"):   3,
+		getStagingName(finished.ID, "items"): 4,
+		getBackupName(finished.ID, "items"):  5,
+		"tmp_restore_7c9e6679_categories":    6,
+		"tmp_backup_7c9e6679_categories":     8,
+	}}
+	if err := dropStaleCollections(context.Background(), ops, job.ID); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	expected := map[string]int{
+		"items":                             7,
+		getStagingName(running.ID, "items"): 2,
+		getBackupName(running.ID, "items"):  3,
+	}
+	if !reflect.DeepEqual(ops.collections, expected) {
+		t.Errorf("unexpected collections after dropping the stale collections: %v", ops.collections)
+	}
+
+	dump := map[string]*collectionState{"items": {Count: 7}}
+	target := map[string]*collectionState{"items": {Count: 7}, "tmp_restore_7c9e6679_categories": {Count: 6}, "tmp_backup_7c9e6679_categories": {Count: 8}}
+	if report := compareStates("restore", "dump", dump, "target", target, nil, false); len(report.Mismatches) != 0 {
+		t.Errorf("unexpected mismatches of leftover collections: %v", report.Mismatches)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	keptnevents "github.com/keptn/go-utils/pkg/events"
+)
+
+// stateFileName is the name of the file of the interrupted jobs in DUMP_DIR.
+const stateFileName = "interrupted-jobs.json"
+
+// errShutdown is the error of a synchronization stopped by the shutdown of
+// the service.
+var errShutdown = errors.New("synchronization interrupted by the shutdown of the service")
+
+// getStateFile returns the file the interrupted jobs are persisted in, which
+// is empty if neither SHUTDOWN_STATE_FILE nor DUMP_DIR is set.
+func getStateFile(env envConfig) string {
+	if env.StateFile != "" {
+		return env.StateFile
+	}
+	if dumpDir := os.Getenv("DUMP_DIR"); dumpDir != "" {
+		return filepath.Join(dumpDir, stateFileName)
+	}
+	return ""
+}
+
+// shutdown stops the scheduler: the queued jobs are interrupted at once, the
+// running jobs may finish within the grace period of env. The jobs
+// interrupted by the shutdown are persisted in the state file.
+func shutdown(env envConfig) {
+	start := time.Now()
+	defaultLogger.Info(fmt.Sprintf("Shutting down, running jobs may finish within %s", env.ShutdownGracePeriod))
+
+	ctx, cancel := context.WithTimeout(context.Background(), env.ShutdownGracePeriod)
+	defer cancel()
+	syncScheduler.shutdown(ctx)
+
+	interrupted := []Job{}
+	for _, job := range jobs.list("") {
+		if job.State == JobInterrupted && !job.Finished.Before(start) {
+			interrupted = append(interrupted, job)
+		}
+	}
+	if len(interrupted) == 0 {
+		defaultLogger.Info("Shutdown finished, no job was interrupted")
+		return
+	}
+	path := getStateFile(env)
+	if path == "" {
+		defaultLogger.Error(fmt.Sprintf("%d jobs were interrupted, but no state file is configured", len(interrupted)))
+		return
+	}
+	if err := saveInterruptedJobs(path, interrupted); err != nil {
+		defaultLogger.Error(fmt.Sprintf("Failed to persist %d interrupted jobs: %s", len(interrupted), err.Error()))
+		return
+	}
+	defaultLogger.Info(fmt.Sprintf("Shutdown finished, %d interrupted jobs persisted in %s", len(interrupted), path))
+}
+
+// saveInterruptedJobs writes the jobs as JSON into path. The file is
+// replaced atomically, so a process killed while writing leaves the previous
+// file.
+func saveInterruptedJobs(path string, interrupted []Job) error {
+	content, err := json.MarshalIndent(interrupted, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadInterruptedJobs reads the jobs persisted by the previous process and
+// removes the file, so the jobs are only resumed once. A missing file
+// returns no jobs.
+func loadInterruptedJobs(path string) ([]Job, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	interrupted := []Job{}
+	if err := json.Unmarshal(content, &interrupted); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %s", path, err.Error())
+	}
+	return interrupted, os.Remove(path)
+}
+
+// restoreInterruptedJobs adds the jobs interrupted by the shutdown of the
+// previous process to the registry, so they can be queried. If resume is
+// set, every job is started again as new job in the same Keptn context.
+func restoreInterruptedJobs(path string, resume bool) error {
+	if path == "" {
+		return nil
+	}
+	interrupted, err := loadInterruptedJobs(path)
+	if err != nil {
+		return err
+	}
+	for _, job := range interrupted {
+		jobs.add(job)
+		if !resume {
+			continue
+		}
+		if job.Service == "" {
+			defaultLogger.Error(fmt.Sprintf("Interrupted job %s can not be resumed, its service is unknown", job.ID))
+			continue
+		}
+		resumeJob(job)
+	}
+	if len(interrupted) > 0 {
+		defaultLogger.Info(fmt.Sprintf("Restored %d jobs interrupted by the previous shutdown", len(interrupted)))
+	}
+	return nil
+}
+
+// resumeJob starts an interrupted synchronization, dry run or restore again.
+func resumeJob(interrupted Job) {
+	job := jobs.create(interrupted.KeptnContext, interrupted.EventID)
+	jobs.update(job.ID, func(job *Job) {
+		job.ResumedFrom = interrupted.ID
+	})
+	stdLogger := newLogger(interrupted.KeptnContext, interrupted.EventID).withJob(job.ID)
+	stdLogger.Info(fmt.Sprintf("Resuming job %s interrupted by the previous shutdown", interrupted.ID))
+
+	if interrupted.Mode == SyncRestore {
+		startRestore(stdLogger, interrupted.KeptnContext, job.ID, &RestoreEventData{
+			Project:  interrupted.Project,
+			Stage:    interrupted.Stage,
+			Service:  interrupted.Service,
+			Snapshot: interrupted.Snapshot,
+		})
+		return
+	}
+	startSync(stdLogger, interrupted.KeptnContext, job.ID, &keptnevents.ConfigurationChangeEventData{
+		Project: interrupted.Project,
+		Stage:   interrupted.Stage,
+		Service: interrupted.Service,
+	}, interrupted.Mode == SyncDryRun)
+}
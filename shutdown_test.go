@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestInterruptedJobs persists jobs interrupted by a shutdown and restores
+// them into the registry.
+func TestInterruptedJobs(t *testing.T) {
+	fmt.Println("\n>> TestInterruptedJobs()")
+
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, stateFileName)
+
+	defer func(r *jobRegistry) { jobs = r }(jobs)
+	jobs = newJobRegistry()
+	job := jobs.create("ctx-1", "event-1")
+	jobs.setService(job.ID, "sockshop", "dev", "carts")
+	jobs.setState(job.ID, JobRestoring)
+	jobs.finish(job.ID, time.Second, errShutdown)
+
+	interrupted, _ := jobs.get(job.ID)
+	if interrupted.State != JobInterrupted || interrupted.InterruptedIn != JobRestoring || !interrupted.isFinished() {
+		t.Fatalf("unexpected job: %+v", interrupted)
+	}
+	if err := saveInterruptedJobs(path, []Job{interrupted}); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+
+	jobs = newJobRegistry()
+	if err := restoreInterruptedJobs(path, false); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	restored, ok := jobs.get(job.ID)
+	if !ok || restored.State != JobInterrupted || restored.Service != "carts" || restored.Error != errShutdown.Error() {
+		t.Errorf("unexpected restored job: %+v", restored)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the state file to be removed")
+	}
+
+	// without a state file, no job is restored
+	if err := restoreInterruptedJobs(path, false); err != nil {
+		t.Errorf("Error message: %s", err)
+	}
+	ioutil.WriteFile(path, []byte("{"), 0600)
+	if err := restoreInterruptedJobs(path, false); err == nil {
+		t.Errorf("expected an invalid state file to fail")
+	}
+}
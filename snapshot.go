@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotsDir = "snapshots"
+	manifestFile = "manifest.json"
+
+	// snapshotTimeFormat is the timestamp in the directory name of a snapshot
+	snapshotTimeFormat = "20060102T150405Z"
+)
+
+// toolModules are the modules whose versions are recorded in a snapshot.
+var toolModules = map[string]string{
+	"mongo-tools":        "github.com/mongodb/mongo-tools",
+	"mongo-tools-common": "github.com/mongodb/mongo-tools-common",
+	"mongo-driver":       "go.mongodb.org/mongo-driver",
+}
+
+var (
+	// snapshotMu serializes the numbering and the pruning of snapshots
+	snapshotMu sync.Mutex
+	// pinnedSnapshots counts the restores of a snapshot directory, pinned
+	// snapshots are not pruned
+	pinnedSnapshots = map[string]int{}
+)
+
+// SnapshotOptions enables keeping the dumps as snapshots and configures
+// their retention. A zero value does not limit the snapshots.
+type SnapshotOptions struct {
+	// Keep is the number of snapshots kept per source database
+	Keep int `yaml:"keep"`
+	// MaxAge is the time a snapshot is kept, e.g. 168h
+	MaxAge time.Duration `yaml:"maxAge"`
+	// MaxBytes is the total size of the snapshots of a source database
+	MaxBytes int64 `yaml:"maxBytes"`
+}
+
+// validate checks that the retention limits are not negative.
+func (o *SnapshotOptions) validate() error {
+	if o.Keep < 0 || o.MaxAge < 0 || o.MaxBytes < 0 {
+		return errors.New("invalid snapshot retention, keep, maxAge and maxBytes must not be negative")
+	}
+	return nil
+}
+
+// SnapshotManifest describes a dump kept as snapshot.
+type SnapshotManifest struct {
+	// ID is the id of the job which created the snapshot
+	ID string `json:"id"`
+	// Version numbers the snapshots of a source database
+	Version      int             `json:"version"`
+	Created      time.Time       `json:"created"`
+	KeptnContext string          `json:"shkeptncontext"`
+	Project      string          `json:"project"`
+	Stage        string          `json:"stage"`
+	Service      string          `json:"service"`
+	Source       DatabaseSummary `json:"source"`
+	// Collections maps the dumped collections to their number of documents
+	Collections  map[string]int64  `json:"collections"`
+	Masked       bool              `json:"masked"`
+	Gzip         bool              `json:"gzip"`
+	ToolVersions map[string]string `json:"toolVersions"`
+	// KeyIDs are the ids of the keys the archives are encrypted with
+	KeyIDs []string `json:"keyIds,omitempty"`
+	// Archive is set if the dump is written as archives, Archives are the
+	// collections archived separately, empty if the dump is one archive of
+	// the database
+	Archive  bool     `json:"archive"`
+	Archives []string `json:"archives,omitempty"`
+	// Size is the size of the dump files in bytes
+	Size int64 `json:"size"`
+
+	// dir is the directory of the snapshot
+	dir string
+}
+
+// getSnapshotDir returns the directory of the snapshots of the source
+// database below the dump directory.
+func getSnapshotDir(dumpDir string, dbInfo *DatabaseInfo) string {
+	return filepath.Join(dumpDir, snapshotsDir, url.PathEscape(dbInfo.sourceHost+"/"+dbInfo.sourceDB))
+}
+
+// getPendingSnapshotDir returns the directory a job dumps into before the
+// dump becomes a snapshot. It is hidden from the catalog.
+func getPendingSnapshotDir(snapshotDir string, jobID string) string {
+	return filepath.Join(snapshotDir, "."+jobID)
+}
+
+// saveSnapshot turns the dump of a job into the next version of the
+// snapshots of its source database. The manifest is written, the dump
+// directory is renamed to v<version>-<timestamp> and the retention policy
+// is applied, which also removes the pending snapshots of jobs which are
+// not running anymore.
+func saveSnapshot(jobID string, dbInfo *DatabaseInfo) (*SnapshotManifest, error) {
+	dump, err := getDumpState(dbInfo)
+	if err != nil {
+		return nil, err
+	}
+	size, err := getDirSize(dbInfo.dumpDir)
+	if err != nil {
+		return nil, err
+	}
+	job, _ := jobs.get(jobID)
+
+	manifest := &SnapshotManifest{
+		ID:           jobID,
+		Created:      time.Now().UTC(),
+		KeptnContext: job.KeptnContext,
+		Project:      job.Project,
+		Stage:        job.Stage,
+		Service:      job.Service,
+		Source:       DatabaseSummary{Host: dbInfo.sourceHost, Port: dbInfo.port, Database: dbInfo.sourceDB},
+		Collections:  map[string]int64{},
+		Masked:       len(dbInfo.masking) > 0,
+		Gzip:         dbInfo.gzip,
+		Archive:      dbInfo.archive,
+		ToolVersions: getToolVersions(),
+		Size:         size,
+	}
+	for name, state := range dump {
+		manifest.Collections[name] = state.Count
+	}
+	if dbInfo.archive {
+		manifest.Archives = append(manifest.Archives, dbInfo.collections...)
+	}
+	if dbInfo.encryption != nil {
+		manifest.KeyIDs = []string{dbInfo.encryption.keyID}
+	}
+
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	removePendingSnapshots(dbInfo.snapshotDir)
+	snapshots, err := readSnapshots(dbInfo.snapshotDir)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Version = 1
+	if len(snapshots) > 0 {
+		manifest.Version = snapshots[0].Version + 1
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dbInfo.dumpDir, manifestFile), content, 0644); err != nil {
+		return nil, err
+	}
+	manifest.dir = filepath.Join(dbInfo.snapshotDir, fmt.Sprintf("v%d-%s", manifest.Version, manifest.Created.Format(snapshotTimeFormat)))
+	if err := os.Rename(dbInfo.dumpDir, manifest.dir); err != nil {
+		return nil, err
+	}
+	dbInfo.dumpDir = manifest.dir
+
+	pruneSnapshots(append([]*SnapshotManifest{manifest}, snapshots...), dbInfo.snapshots, time.Now())
+	return manifest, nil
+}
+
+// pruneSnapshots removes the snapshots exceeding the retention limits. The
+// snapshots are ordered from newest to oldest, the newest one and the
+// pinned ones are always kept.
+func pruneSnapshots(snapshots []*SnapshotManifest, retention *SnapshotOptions, now time.Time) []*SnapshotManifest {
+	removed := []*SnapshotManifest{}
+	var total int64
+	for i, snapshot := range snapshots {
+		total += snapshot.Size
+		if i == 0 || pinnedSnapshots[snapshot.dir] > 0 {
+			continue
+		}
+		if (retention.Keep > 0 && i >= retention.Keep) ||
+			(retention.MaxAge > 0 && now.Sub(snapshot.Created) > retention.MaxAge) ||
+			(retention.MaxBytes > 0 && total > retention.MaxBytes) {
+
+			if err := os.RemoveAll(snapshot.dir); err != nil {
+				defaultLogger.Error(fmt.Sprintf("failed to remove snapshot %s: %s", snapshot.dir, err))
+				continue
+			}
+			total -= snapshot.Size
+			removed = append(removed, snapshot)
+		}
+	}
+	return removed
+}
+
+// removePendingSnapshots removes the pending snapshot directories of jobs
+// which are not running, e.g. of jobs killed with the previous process.
+// Their dumps are incomplete and would fill the volume unnoticed by the
+// retention limits.
+func removePendingSnapshots(snapshotDir string) []string {
+	removed := []string{}
+	dirs, err := ioutil.ReadDir(snapshotDir)
+	if err != nil {
+		return removed
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || !strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		if job, ok := jobs.get(strings.TrimPrefix(dir.Name(), ".")); ok && !job.isFinished() {
+			continue
+		}
+		path := filepath.Join(snapshotDir, dir.Name())
+		if err := os.RemoveAll(path); err != nil {
+			defaultLogger.Error(fmt.Sprintf("failed to remove pending snapshot %s: %s", path, err))
+			continue
+		}
+		removed = append(removed, path)
+	}
+	return removed
+}
+
+// readSnapshots returns the manifests of the snapshots in a directory of a
+// source database, the newest first. Directories without manifest, e.g. of
+// running jobs, are skipped.
+func readSnapshots(snapshotDir string) ([]*SnapshotManifest, error) {
+	dirs, err := ioutil.ReadDir(snapshotDir)
+	if os.IsNotExist(err) {
+		return []*SnapshotManifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []*SnapshotManifest{}
+	for _, dir := range dirs {
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(snapshotDir, dir.Name(), manifestFile))
+		if err != nil {
+			continue
+		}
+		manifest := &SnapshotManifest{dir: filepath.Join(snapshotDir, dir.Name())}
+		if err := json.Unmarshal(content, manifest); err != nil {
+			continue
+		}
+		snapshots = append(snapshots, manifest)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Version > snapshots[j].Version })
+	return snapshots, nil
+}
+
+// listSnapshots returns the snapshots of all source databases below the
+// given dump directories, the newest first.
+func listSnapshots(dumpDirs []string) ([]*SnapshotManifest, error) {
+	snapshots := []*SnapshotManifest{}
+	for _, dumpDir := range dumpDirs {
+		root := filepath.Join(dumpDir, snapshotsDir)
+		sources, err := ioutil.ReadDir(root)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, source := range sources {
+			if !source.IsDir() {
+				continue
+			}
+			found, err := readSnapshots(filepath.Join(root, source.Name()))
+			if err != nil {
+				return nil, err
+			}
+			snapshots = append(snapshots, found...)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.After(snapshots[j].Created) })
+	return snapshots, nil
+}
+
+// findSnapshot returns the snapshot with the given id, or nil if there is
+// none.
+func findSnapshot(dumpDirs []string, id string) (*SnapshotManifest, error) {
+	snapshots, err := listSnapshots(dumpDirs)
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.ID == id {
+			return snapshot, nil
+		}
+	}
+	return nil, nil
+}
+
+// pinSnapshot returns the snapshot with the given id and protects it from
+// being pruned until unpinSnapshot is called.
+func pinSnapshot(dumpDirs []string, id string) (*SnapshotManifest, error) {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	snapshot, err := findSnapshot(dumpDirs, id)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return nil, fmt.Errorf("snapshot %s not found", id)
+	}
+	pinnedSnapshots[snapshot.dir]++
+	return snapshot, nil
+}
+
+// unpinSnapshot releases a snapshot returned by pinSnapshot.
+func unpinSnapshot(snapshot *SnapshotManifest) {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	if pinnedSnapshots[snapshot.dir]--; pinnedSnapshots[snapshot.dir] <= 0 {
+		delete(pinnedSnapshots, snapshot.dir)
+	}
+}
+
+// getDumpDirs returns the dump directories of the environment and of the
+// configured services.
+func getDumpDirs() []string {
+	dirs := []string{}
+	if dumpDir := os.Getenv("DUMP_DIR"); dumpDir != "" {
+		dirs = append(dirs, dumpDir)
+	}
+	for _, dir := range syncConfig.getDumpDirs() {
+		if !contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// getDirSize returns the total size of the files in a directory.
+func getDirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// getToolVersions returns the versions of the mongo tools and the driver
+// the service is built with.
+func getToolVersions() map[string]string {
+	versions := map[string]string{}
+	info, ok := debug.ReadBuildInfo()
+	for name, path := range toolModules {
+		versions[name] = "unknown"
+		if !ok {
+			continue
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == path {
+				versions[name] = dep.Version
+			}
+		}
+	}
+	return versions
+}
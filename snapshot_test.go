@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// dumpSnapshot writes a dump of the items collection into the pending
+// snapshot directory of a new job and saves it as snapshot.
+func dumpSnapshot(t *testing.T, dumpDir string, retention *SnapshotOptions) *SnapshotManifest {
+	job := jobs.create("ctx-snapshot", "event-snapshot")
+	jobs.setService(job.ID, "sockshop", "production", "carts")
+
+	dbInfo := &DatabaseInfo{sourceDB: "carts-db", sourceHost: "carts-db.sockshop-production", port: "27017", snapshots: retention}
+	dbInfo.snapshotDir = getSnapshotDir(dumpDir, dbInfo)
+	dbInfo.dumpDir = getPendingSnapshotDir(dbInfo.snapshotDir, job.ID)
+	dir := filepath.Join(dbInfo.dumpDir, dbInfo.sourceDB)
+	os.MkdirAll(dir, 0755)
+	writeDumpFile(t, dir, "items", 4, dumpMetadata{Indexes: []bson.D{}}, false)
+
+	snapshot, err := saveSnapshot(job.ID, dbInfo)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if dbInfo.dumpDir != snapshot.dir {
+		t.Errorf("unexpected dump directory, expected: %s, found: %s", snapshot.dir, dbInfo.dumpDir)
+	}
+	return snapshot
+}
+
+// TestSnapshotCatalog saves versioned snapshots, prunes them and lists them
+// with the REST endpoint.
+func TestSnapshotCatalog(t *testing.T) {
+	fmt.Println("\n>> TestSnapshotCatalog()")
+
+	dumpDir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(dumpDir)
+	os.Setenv("DUMP_DIR", dumpDir)
+	defer os.Unsetenv("DUMP_DIR")
+
+	first := dumpSnapshot(t, dumpDir, &SnapshotOptions{Keep: 2})
+	second := dumpSnapshot(t, dumpDir, &SnapshotOptions{Keep: 2})
+	third := dumpSnapshot(t, dumpDir, &SnapshotOptions{Keep: 2})
+	if first.Version != 1 || second.Version != 2 || third.Version != 3 {
+		t.Errorf("unexpected versions: %d, %d, %d", first.Version, second.Version, third.Version)
+	}
+	if third.Collections["items"] != 4 || third.KeptnContext != "ctx-snapshot" || third.Service != "carts" || third.Size == 0 {
+		t.Errorf("unexpected manifest: %+v", third)
+	}
+	if _, err := os.Stat(first.dir); !os.IsNotExist(err) {
+		t.Errorf("expected the first snapshot to be pruned")
+	}
+
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/snapshots?database=carts-db")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	var list []SnapshotManifest
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 2 || list[0].ID != third.ID || list[1].ID != second.ID {
+		t.Errorf("unexpected snapshots: %+v", list)
+	}
+
+	resp, err = http.Get(server.URL + "/snapshots/" + first.ID)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status code, expected: %d, found: %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+// TestPruneSnapshots applies the age and size limits of the retention policy.
+func TestPruneSnapshots(t *testing.T) {
+	fmt.Println("\n>> TestPruneSnapshots()")
+
+	now := time.Now()
+	snapshots := []*SnapshotManifest{
+		{Version: 4, Created: now.Add(-100 * time.Hour), Size: 60},
+		{Version: 3, Created: now.Add(-2 * time.Hour), Size: 30},
+		{Version: 2, Created: now.Add(-3 * time.Hour), Size: 30},
+		{Version: 1, Created: now.Add(-200 * time.Hour), Size: 10},
+	}
+
+	removed := pruneSnapshots(snapshots, &SnapshotOptions{MaxAge: 24 * time.Hour}, now)
+	if len(removed) != 1 || removed[0].Version != 1 {
+		t.Errorf("unexpected removed snapshots: %+v", removed)
+	}
+	removed = pruneSnapshots(snapshots[:3], &SnapshotOptions{MaxBytes: 100}, now)
+	if len(removed) != 1 || removed[0].Version != 2 {
+		t.Errorf("unexpected removed snapshots: %+v", removed)
+	}
+}
+
+// TestRemovePendingSnapshots removes the pending snapshots of finished and
+// unknown jobs and keeps the ones of running jobs and the snapshots.
+func TestRemovePendingSnapshots(t *testing.T) {
+	fmt.Println("\n>> TestRemovePendingSnapshots()")
+
+	defer func(r *jobRegistry) { jobs = r }(jobs)
+	jobs = newJobRegistry()
+
+	dir, err := ioutil.TempDir("", "pending")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	running := jobs.create("ctx-pending", "event-1")
+	jobs.setState(running.ID, JobDumping)
+	finished := jobs.create("ctx-pending", "event-2")
+	jobs.finish(finished.ID, time.Second, fmt.Errorf("dump failed"))
+	for _, name := range []string{"." + running.ID, "." + finished.ID, ".unknown-job", "v1-20191101T000000Z"} {
+		if err := os.MkdirAll(filepath.Join(dir, name, "carts"), 0755); err != nil {
+			t.Fatalf("Error message: %s", err)
+		}
+	}
+
+	removed := removePendingSnapshots(dir)
+	if len(removed) != 2 {
+		t.Errorf("unexpected removed pending snapshots: %v", removed)
+	}
+	for name, exists := range map[string]bool{
+		"." + running.ID:      true,
+		"." + finished.ID:     false,
+		".unknown-job":        false,
+		"v1-20191101T000000Z": true,
+	} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != exists {
+			t.Errorf("expected %s to exist: %t", name, exists)
+		}
+	}
+}
+
+// TestRestoreSnapshot points a service at a snapshot and requests restores
+// from the REST endpoint.
+func TestRestoreSnapshot(t *testing.T) {
+	fmt.Println("\n>> TestRestoreSnapshot()")
+
+	dumpDir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(dumpDir)
+	os.Setenv("DUMP_DIR", dumpDir)
+	defer os.Unsetenv("DUMP_DIR")
+	snapshot := dumpSnapshot(t, dumpDir, &SnapshotOptions{})
+
+	dbInfo := &DatabaseInfo{sourceDB: "carts-db-v2", targetDB: "carts-db-canary", collections: []string{"items"}, incremental: true}
+	if err := useSnapshot(dbInfo, snapshot); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if dbInfo.sourceDB != "carts-db" || dbInfo.dumpDir != snapshot.dir || dbInfo.incremental {
+		t.Errorf("unexpected database information: %+v", dbInfo)
+	}
+	dbInfo.collections = []string{"items", "users"}
+	assertError(t, "collection users is not contained in snapshot "+snapshot.ID, useSnapshot(dbInfo, snapshot))
+
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/snapshots/unknown/restore", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status code, expected: %d, found: %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	// a restore without project is rejected
+	body := strings.NewReader(`{"service": "carts"}`)
+	resp, err = http.Post(server.URL+"/snapshots/"+snapshot.ID+"/restore", "application/json", body)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status code, expected: %d, found: %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// the job is accepted at once, it fails before it is queued, as the
+	// service is not configured
+	body = strings.NewReader(`{"project": "sockshop", "stage": "staging", "service": "unknown"}`)
+	resp, err = http.Post(server.URL+"/snapshots/"+snapshot.ID+"/restore", "application/json", body)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	var job Job
+	json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || job.Mode != SyncRestore || job.Snapshot != snapshot.ID ||
+		job.Stage != "staging" || job.State != JobQueued {
+		t.Errorf("unexpected job: %+v", job)
+	}
+	if job = waitForJob(t, job.ID); job.State != JobFailed {
+		t.Errorf("unexpected job: %+v", job)
+	}
+	if len(pinnedSnapshots) != 0 {
+		t.Errorf("expected no pinned snapshots, found: %v", pinnedSnapshots)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// StorageFilesystem stores the archives in a directory
+	StorageFilesystem = "filesystem"
+	// StorageS3 stores the archives in a bucket of an S3-compatible object
+	// storage
+	StorageS3 = "s3"
+)
+
+// errObjectNotFound is returned when opening an object which does not exist.
+var errObjectNotFound = errors.New("object not found")
+
+// Storage stores the dump archives as objects addressed by slash separated
+// keys.
+type Storage interface {
+	// Create returns a writer for the object with the given key. The object
+	// is stored when the writer is closed, an aborted object is discarded.
+	Create(ctx context.Context, key string) (ObjectWriter, error)
+	// Open returns a reader for the object with the given key.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns the keys of the objects starting with prefix, sorted.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes the object with the given key.
+	Delete(ctx context.Context, key string) error
+}
+
+// ObjectWriter writes an object of a Storage.
+type ObjectWriter interface {
+	io.Writer
+	// Close stores the written object.
+	Close() error
+	// Abort discards the written object.
+	Abort() error
+}
+
+// StorageConfig selects and configures the storage of the dump archives.
+type StorageConfig struct {
+	// Type is filesystem or s3
+	Type string `yaml:"type"`
+	// Path is the directory of the filesystem storage, defaults to the dump
+	// directory
+	Path string `yaml:"path"`
+	// Endpoint is the URL of the S3-compatible object storage
+	Endpoint string `yaml:"endpoint"`
+	Bucket   string `yaml:"bucket"`
+	Region   string `yaml:"region"`
+	// Prefix is prepended to the keys of the archives in the bucket
+	Prefix string `yaml:"prefix"`
+	// Credentials is the directory of a mounted secret containing the files
+	// accessKey and secretKey, the AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY environment variables are used if it is empty
+	Credentials string `yaml:"credentials"`
+}
+
+// validate checks the type and the settings of the storage.
+func (c *StorageConfig) validate() error {
+	switch c.Type {
+	case "", StorageFilesystem:
+		return nil
+	case StorageS3:
+		if c.Endpoint == "" || c.Bucket == "" {
+			return errors.New("s3 storage requires an endpoint and a bucket")
+		}
+		_, err := parseEndpoint(c.Endpoint)
+		return err
+	}
+	return fmt.Errorf("unknown storage type %s", c.Type)
+}
+
+// newStorage returns the storage of the configuration. The filesystem
+// storage defaults to the dump directory.
+func newStorage(c *StorageConfig, dumpDir string) (Storage, error) {
+	if c.Type == StorageS3 {
+		accessKey, secretKey, err := readStorageCredentials(c.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		return newS3Storage(c.Endpoint, c.Region, c.Bucket, c.Prefix, accessKey, secretKey)
+	}
+	dir := c.Path
+	if dir == "" {
+		dir = dumpDir
+	}
+	return &fsStorage{dir: dir}, nil
+}
+
+// fsStorage stores the objects as files below a directory.
+type fsStorage struct {
+	dir string
+}
+
+// path returns the file of an object.
+func (s *fsStorage) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+// Create writes the object into a temporary file, which is renamed when the
+// writer is closed.
+func (s *fsStorage) Create(ctx context.Context, key string) (ObjectWriter, error) {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return nil, err
+	}
+	return &fsObjectWriter{File: file, path: path}, nil
+}
+
+// Open opens the file of the object.
+func (s *fsStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, errObjectNotFound
+	}
+	return file, err
+}
+
+// List walks the directory for the files of the objects. Temporary files
+// of unfinished objects are skipped.
+func (s *fsStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// Delete removes the file of the object and the directories which become
+// empty.
+func (s *fsStorage) Delete(ctx context.Context, key string) error {
+	path := s.path(key)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	root := filepath.Clean(s.dir) + string(filepath.Separator)
+	for dir := filepath.Dir(path); strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		// fails for directories which are not empty
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// fsObjectWriter writes an object of the filesystem storage.
+type fsObjectWriter struct {
+	*os.File
+	path string
+}
+
+// Close renames the temporary file to the file of the object.
+func (w *fsObjectWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	return os.Rename(w.Name(), w.path)
+}
+
+// Abort removes the temporary file.
+func (w *fsObjectWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.Name())
+}
+
+// memStorage keeps the objects in memory.
+type memStorage struct {
+	mu      sync.RWMutex
+	objects map[string][]byte
+}
+
+// newMemStorage returns an empty in-memory storage.
+func newMemStorage() *memStorage {
+	return &memStorage{objects: map[string][]byte{}}
+}
+
+// Create buffers the object until the writer is closed.
+func (s *memStorage) Create(ctx context.Context, key string) (ObjectWriter, error) {
+	return &memObjectWriter{storage: s, key: key}, nil
+}
+
+// Open returns a reader for a copy of the object.
+func (s *memStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	content, ok := s.objects[key]
+	if !ok {
+		return nil, errObjectNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+// List returns the keys of the objects starting with prefix.
+func (s *memStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := []string{}
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Delete removes the object.
+func (s *memStorage) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+// memObjectWriter writes an object of the in-memory storage.
+type memObjectWriter struct {
+	bytes.Buffer
+	storage *memStorage
+	key     string
+}
+
+// Close stores the buffered object.
+func (w *memObjectWriter) Close() error {
+	w.storage.mu.Lock()
+	defer w.storage.mu.Unlock()
+	w.storage.objects[w.key] = append([]byte{}, w.Bytes()...)
+	return nil
+}
+
+// Abort discards the buffered object.
+func (w *memObjectWriter) Abort() error {
+	w.Reset()
+	return nil
+}
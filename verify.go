@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	mr "github.com/mongodb/mongo-tools/mongorestore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// CheckCollection reports a collection missing on one side
+	CheckCollection = "collection"
+	// CheckCount reports a different number of documents
+	CheckCount = "count"
+	// CheckIndex reports a missing or different index definition
+	CheckIndex = "index"
+
+	missing = "missing"
+
+	// maxReportedMismatches is the number of mismatches included in the error
+	maxReportedMismatches = 3
+)
+
+// Mismatch is a difference between the expected and the found state of a
+// collection.
+type Mismatch struct {
+	Collection string `json:"collection"`
+	// Check is one of collection, count, index or checksum
+	Check string `json:"check"`
+	// Index is the name of the index of an index mismatch
+	Index string `json:"index,omitempty"`
+	// DocumentID is the first differing _id of a checksum mismatch
+	DocumentID string `json:"documentId,omitempty"`
+	Expected   string `json:"expected"`
+	Found      string `json:"found"`
+}
+
+// String describes the mismatch in one line.
+func (m Mismatch) String() string {
+	subject := m.Collection + " " + m.Check
+	if m.Index != "" {
+		subject += " " + m.Index
+	}
+	if m.DocumentID != "" {
+		subject += " first differing _id " + m.DocumentID
+	}
+	return fmt.Sprintf("%s expected: %s, found: %s", subject, m.Expected, m.Found)
+}
+
+// VerificationReport is the result of comparing two states of the
+// synchronized collections, e.g. the source database and the dump.
+type VerificationReport struct {
+	// Phase is dump, restore or checksum
+	Phase string `json:"phase"`
+	// Expected and Found name the compared states: source, dump or target
+	Expected   string     `json:"expected"`
+	Found      string     `json:"found"`
+	Mismatches []Mismatch `json:"mismatches"`
+	// Warnings are differences which do not fail the verification, like
+	// collections of the found state which are not expected
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// err returns an error describing the first mismatches, or nil if there
+// are none.
+func (r *VerificationReport) err() error {
+	if len(r.Mismatches) == 0 {
+		return nil
+	}
+	details := []string{}
+	for i, m := range r.Mismatches {
+		if i == maxReportedMismatches {
+			details = append(details, "...")
+			break
+		}
+		details = append(details, m.String())
+	}
+	return fmt.Errorf("verification of the %s found %d mismatches between %s and %s: %s",
+		r.Phase, len(r.Mismatches), r.Expected, r.Found, strings.Join(details, "; "))
+}
+
+// collectionState is the number of documents and the index definitions of
+// a collection. Indexes maps the index name to its definition.
+type collectionState struct {
+	Count int64
+	// MaxCount marks the count as upper bound, e.g. of a sampled collection
+	MaxCount bool
+	Indexes  map[string]string
+}
+
+// dumpMetadata is the part of a <collection>.metadata.json file used by the
+// verification.
+type dumpMetadata struct {
+	Options bson.M   `bson:"options"`
+	Indexes []bson.D `bson:"indexes"`
+}
+
+// verifyDump compares the source database with the dump.
+func verifyDump(ctx context.Context, dbInfo *DatabaseInfo) (*VerificationReport, error) {
+	source, err := getDatabaseState(ctx, dbInfo, "source")
+	if err != nil {
+		return nil, err
+	}
+	dump, err := getDumpState(dbInfo)
+	if err != nil {
+		return nil, err
+	}
+	return compareStates("dump", "source", source, "dump", dump, dbInfo.collections, false), nil
+}
+
+// verifyRestore compares the dump, or the source database if the dump was
+// streamed or written to a storage, with the target database. If the existing collections of the
+// target are kept, only missing collections and indexes are reported.
+func verifyRestore(ctx context.Context, dbInfo *DatabaseInfo) (*VerificationReport, error) {
+	expectedName := "dump"
+	var expected map[string]*collectionState
+	var err error
+	if dbInfo.streaming || dbInfo.storage != nil {
+		expectedName = "source"
+		expected, err = getDatabaseState(ctx, dbInfo, "source")
+	} else {
+		expected, err = getDumpState(dbInfo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	target, err := getDatabaseState(ctx, dbInfo, "target")
+	if err != nil {
+		return nil, err
+	}
+	keepExisting := !contains(dbInfo.args, mr.DropOption)
+	return compareStates("restore", expectedName, expected, "target", target, dbInfo.collections, keepExisting), nil
+}
+
+// compareStates reports the differences of the given collections, or of all
+// collections if none are given. Additional collections of the found state
+// are reported as warnings. If subset is set, they and additional documents
+// and indexes are accepted. Staging and backup collections of safe restores
+// are never compared.
+func compareStates(phase string, expectedName string, expected map[string]*collectionState,
+	foundName string, found map[string]*collectionState, collections []string, subset bool) *VerificationReport {
+
+	report := &VerificationReport{Phase: phase, Expected: expectedName, Found: foundName, Mismatches: []Mismatch{}}
+
+	names := collections
+	if len(names) == 0 {
+		names = []string{}
+		for name := range expected {
+			names = append(names, name)
+		}
+		if !subset {
+			// mongorestore only drops the restored collections, so other
+			// collections of the target are kept and only reported. Leftover
+			// staging and backup collections of safe restores are not part of
+			// the synchronized collections.
+			for name := range found {
+				if _, ok := expected[name]; !ok && !isTemporaryCollection(name) {
+					report.Warnings = append(report.Warnings, fmt.Sprintf("collection %s is %s, but %s", name, presence(true, foundName), presence(false, expectedName)))
+				}
+			}
+			sort.Strings(report.Warnings)
+		}
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		e, inExpected := expected[name]
+		f, inFound := found[name]
+		if !inExpected || !inFound {
+			report.Mismatches = append(report.Mismatches, Mismatch{
+				Collection: name,
+				Check:      CheckCollection,
+				Expected:   presence(inExpected, expectedName),
+				Found:      presence(inFound, foundName),
+			})
+			continue
+		}
+		if e.Count != f.Count && !(subset && f.Count > e.Count) && !(e.MaxCount && f.Count < e.Count) {
+			report.Mismatches = append(report.Mismatches, Mismatch{
+				Collection: name,
+				Check:      CheckCount,
+				Expected:   strconv.FormatInt(e.Count, 10),
+				Found:      strconv.FormatInt(f.Count, 10),
+			})
+		}
+		report.Mismatches = append(report.Mismatches, compareIndexes(name, e.Indexes, f.Indexes, subset)...)
+	}
+	return report
+}
+
+// compareIndexes reports missing and different index definitions.
+func compareIndexes(collection string, expected map[string]string, found map[string]string, subset bool) []Mismatch {
+	names := []string{}
+	for name := range expected {
+		names = append(names, name)
+	}
+	for name := range found {
+		if _, ok := expected[name]; !ok && !subset {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	mismatches := []Mismatch{}
+	for _, name := range names {
+		e, inExpected := expected[name]
+		f, inFound := found[name]
+		if !inExpected {
+			e = missing
+		}
+		if !inFound {
+			f = missing
+		}
+		if e != f {
+			mismatches = append(mismatches, Mismatch{Collection: collection, Check: CheckIndex, Index: name, Expected: e, Found: f})
+		}
+	}
+	return mismatches
+}
+
+// presence describes whether a collection exists in the named state.
+func presence(ok bool, name string) string {
+	if ok {
+		return "present in " + name
+	}
+	return missing + " in " + name
+}
+
+// getDatabaseState returns the state of all collections of the source or
+// target database. Views and system collections are skipped. The documents
+// of the source are counted with the collection filters.
+func getDatabaseState(ctx context.Context, dbInfo *DatabaseInfo, host string) (map[string]*collectionState, error) {
+	db, err := getDatabase(ctx, dbInfo, host)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Client().Disconnect(context.Background())
+
+	names, err := listCollections(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	state := map[string]*collectionState{}
+	for _, name := range names {
+		// the filter of a collection selects the documents of the source
+		// which are expected in the dump and the target
+		filter := CollectionFilter{}
+		if host == "source" {
+			filter = dbInfo.filters[name]
+		}
+		query, err := filter.getQuery()
+		if err != nil {
+			return nil, err
+		}
+		col := db.Collection(name)
+		count, err := col.CountDocuments(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		indexCursor, err := col.Indexes().List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		indexes := []bson.D{}
+		if err := indexCursor.All(ctx, &indexes); err != nil {
+			return nil, err
+		}
+		definitions, err := getIndexDefinitions(indexes)
+		if err != nil {
+			return nil, err
+		}
+		state[name] = &collectionState{Indexes: definitions}
+		state[name].Count, state[name].MaxCount = filter.getExpectedCount(count)
+	}
+	return state, nil
+}
+
+// listCollections returns the names of the collections of a database
+// without views and system collections.
+func listCollections(ctx context.Context, db *mongo.Database) ([]string, error) {
+	cursor, err := db.ListCollections(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	names := []string{}
+	for cursor.Next(ctx) {
+		var info struct {
+			Name string `bson:"name"`
+			Type string `bson:"type"`
+		}
+		if err := cursor.Decode(&info); err != nil {
+			return nil, err
+		}
+		if info.Type != "view" && !strings.HasPrefix(info.Name, "system.") {
+			names = append(names, info.Name)
+		}
+	}
+	return names, cursor.Err()
+}
+
+// getDumpState returns the state of the collections in the dump directory.
+// Views and files which do not belong to a collection are skipped.
+func getDumpState(dbInfo *DatabaseInfo) (map[string]*collectionState, error) {
+	if dbInfo.archive {
+		return getArchiveState(dbInfo)
+	}
+	files, err := getDumpedFiles(dbInfo)
+	if err != nil {
+		return nil, errors.New(errorDumpedFiles)
+	}
+	dir := filepath.Join(dbInfo.dumpDir, dbInfo.sourceDB)
+
+	counts := map[string]int64{}
+	metadata := map[string]*dumpMetadata{}
+	for _, file := range files {
+		name, kind := splitDumpFileName(file.Name())
+		if kind == "" || strings.HasPrefix(name, "system.") {
+			continue
+		}
+		r, err := openDumpFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if kind == ".bson" {
+			counts[name], err = countBSONDocuments(r)
+		} else {
+			metadata[name], err = readDumpMetadata(r)
+		}
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid dump file %s: %s", file.Name(), err.Error())
+		}
+	}
+
+	// a collection with only one of both files is treated as missing
+	state := map[string]*collectionState{}
+	for name, meta := range metadata {
+		if _, isView := meta.Options["viewOn"]; isView {
+			continue
+		}
+		count, ok := counts[name]
+		if !ok {
+			continue
+		}
+		indexes, err := getIndexDefinitions(meta.Indexes)
+		if err != nil {
+			return nil, err
+		}
+		state[name] = &collectionState{Count: count, Indexes: indexes}
+	}
+	return state, nil
+}
+
+// readDumpMetadata parses a <collection>.metadata.json file.
+func readDumpMetadata(r io.Reader) (*dumpMetadata, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	meta := &dumpMetadata{}
+	if err := bson.UnmarshalExtJSON(content, true, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// getIndexDefinitions maps index names to a canonical definition. The
+// version and namespace of an index are left out because they differ
+// between servers, the remaining fields are sorted except for the key.
+func getIndexDefinitions(indexes []bson.D) (map[string]string, error) {
+	definitions := map[string]string{}
+	for _, index := range indexes {
+		name := ""
+		definition := bson.D{}
+		for _, e := range index {
+			switch e.Key {
+			case "name":
+				name, _ = e.Value.(string)
+			case "v", "ns":
+			default:
+				definition = append(definition, e)
+			}
+		}
+		sort.Slice(definition, func(i, j int) bool { return definition[i].Key < definition[j].Key })
+
+		content, err := bson.MarshalExtJSON(definition, false, false)
+		if err != nil {
+			return nil, err
+		}
+		definitions[name] = string(content)
+	}
+	return definitions, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// writeDumpFile writes the documents of a collection and its metadata into
+// the dump directory.
+func writeDumpFile(t *testing.T, dir string, name string, docs int, meta dumpMetadata, compress bool) {
+	data := []byte{}
+	for i := 0; i < docs; i++ {
+		doc, err := bson.Marshal(bson.D{{Key: "_id", Value: i}, {Key: "name", Value: fmt.Sprintf("item %d", i)}})
+		if err != nil {
+			t.Fatalf("Error message: %s", err)
+		}
+		data = append(data, doc...)
+	}
+	metadata, err := bson.MarshalExtJSON(meta, true, false)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+
+	dataFile, metadataFile := name+".bson", name+".metadata.json"
+	if compress {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(data)
+		gz.Close()
+		data, dataFile = buf.Bytes(), dataFile+".gz"
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, dataFile), data, 0644); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, metadataFile), metadata, 0644); err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+}
+
+// TestGetDumpState reads the collections of a dump directory containing a
+// compressed collection, a view and an unrelated file.
+func TestGetDumpState(t *testing.T) {
+	fmt.Println("\n>> TestGetDumpState()")
+
+	dumpDir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	defer os.RemoveAll(dumpDir)
+	dbInfo := &DatabaseInfo{sourceDB: "carts-db", dumpDir: dumpDir}
+	dir := filepath.Join(dumpDir, dbInfo.sourceDB)
+	os.MkdirAll(dir, 0755)
+
+	idIndex := bson.D{{Key: "v", Value: 2}, {Key: "key", Value: bson.D{{Key: "_id", Value: 1}}}, {Key: "name", Value: "_id_"}}
+	writeDumpFile(t, dir, "items", 3, dumpMetadata{Indexes: []bson.D{idIndex}}, false)
+	writeDumpFile(t, dir, "users", 2, dumpMetadata{Indexes: []bson.D{idIndex}}, true)
+	writeDumpFile(t, dir, "cheap-items", 0, dumpMetadata{Options: bson.M{"viewOn": "items"}, Indexes: []bson.D{}}, false)
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a collection"), 0644)
+
+	state, err := getDumpState(dbInfo)
+	if err != nil {
+		t.Fatalf("Error message: %s", err)
+	}
+	if len(state) != 2 || state["items"] == nil || state["users"] == nil {
+		t.Fatalf("unexpected collections: %v", state)
+	}
+	if state["items"].Count != 3 || state["users"].Count != 2 {
+		t.Errorf("unexpected document counts, items: %d, users: %d", state["items"].Count, state["users"].Count)
+	}
+	if state["items"].Indexes["_id_"] != `{"key":{"_id":1}}` {
+		t.Errorf("unexpected index definition: %s", state["items"].Indexes["_id_"])
+	}
+}
+
+// TestCompareStates checks the reported collection, count and index
+// mismatches and the warnings of additional target collections.
+func TestCompareStates(t *testing.T) {
+	fmt.Println("\n>> TestCompareStates()")
+
+	source := map[string]*collectionState{
+		"items":      {Count: 3, Indexes: map[string]string{"_id_": `{"key":{"_id":1}}`, "name_1": `{"key":{"name":1}}`}},
+		"users":      {Count: 2, Indexes: map[string]string{"_id_": `{"key":{"_id":1}}`}},
+		"categories": {Count: 1, Indexes: map[string]string{"_id_": `{"key":{"_id":1}}`}},
+	}
+	target := map[string]*collectionState{
+		"items": {Count: 3, Indexes: map[string]string{"_id_": `{"key":{"_id":1}}`, "name_1": `{"key":{"name":-1}}`}},
+		"users": {Count: 1, Indexes: map[string]string{"_id_": `{"key":{"_id":1}}`}},
+		"carts": {Count: 5, Indexes: map[string]string{"_id_": `{"key":{"_id":1}}`}},
+	}
+
+	report := compareStates("restore", "source", source, "target", target, nil, false)
+	expected := []string{
+		"categories collection expected: present in source, found: missing in target",
+		`items index name_1 expected: {"key":{"name":1}}, found: {"key":{"name":-1}}`,
+		"users count expected: 2, found: 1",
+	}
+	if len(report.Mismatches) != len(expected) {
+		t.Fatalf("unexpected mismatches: %v", report.Mismatches)
+	}
+	for i, m := range report.Mismatches {
+		if m.String() != expected[i] {
+			t.Errorf("unexpected mismatch, expected: %s, found: %s", expected[i], m)
+		}
+	}
+
+	// mongorestore keeps the collections of the target which are not in the
+	// source, they do not fail the verification
+	if len(report.Warnings) != 1 || report.Warnings[0] != "collection carts is present in target, but missing in source" {
+		t.Errorf("unexpected warnings: %v", report.Warnings)
+	}
+	synced := map[string]*collectionState{"users": source["users"], "carts": target["carts"]}
+	report = compareStates("restore", "source", map[string]*collectionState{"users": source["users"]}, "target", synced, nil, false)
+	if err := report.err(); err != nil || len(report.Warnings) != 1 {
+		t.Errorf("unexpected result for an additional target collection: %v, %v", err, report.Warnings)
+	}
+
+	report = compareStates("restore", "source", source, "target", target, []string{"items"}, true)
+	if len(report.Mismatches) != 1 || report.Mismatches[0].Check != CheckIndex {
+		t.Errorf("unexpected mismatches: %v", report.Mismatches)
+	}
+	if report.err() == nil {
+		t.Error("expected an error, but no error was thrown.")
+	}
+}
+
+// TestDatabaseStateContext checks that the queries of the verification and
+// the checkpoint of an unreachable database end with the context of the
+// phase.
+func TestDatabaseStateContext(t *testing.T) {
+	fmt.Println("\n>> TestDatabaseStateContext()")
+
+	uri := "mongodb://127.0.0.1:1/"
+	dbInfo := &DatabaseInfo{sourceDB: "carts-db", targetDB: "carts-db-canary", sourceURI: uri, targetURI: uri}
+	for name, query := range map[string]func(ctx context.Context) error{
+		"getDatabaseState": func(ctx context.Context) error {
+			_, err := getDatabaseState(ctx, dbInfo, "target")
+			return err
+		},
+		"getDocumentCounts": func(ctx context.Context) error {
+			_, err := getDocumentCounts(ctx, dbInfo, "target")
+			return err
+		},
+		"getOperationTime": func(ctx context.Context) error {
+			_, err := getOperationTime(ctx, dbInfo)
+			return err
+		},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		start := time.Now()
+		err := query(ctx)
+		cancel()
+		if err == nil || time.Since(start) > 2*time.Second {
+			t.Errorf("expected %s to fail with the context, found %v after %s", name, err, time.Since(start))
+		}
+	}
+}
+
+// TestReadBSONDocumentLength reads documents whose length header is out of
+// range.
+func TestReadBSONDocumentLength(t *testing.T) {
+	fmt.Println("\n>> TestReadBSONDocumentLength()")
+
+	for _, length := range []int32{-1, 4, maxBSONDocumentSize + 1, 1 << 30} {
+		header := make([]byte, 4)
+		binary.LittleEndian.PutUint32(header, uint32(length))
+		if _, err := readBSONDocument(bytes.NewReader(header)); err == nil || err.Error() != fmt.Sprintf("invalid document length %d", length) {
+			t.Errorf("expected length %d to be rejected, got %v", length, err)
+		}
+	}
+
+	doc := []byte{5, 0, 0, 0, 0}
+	read, err := readBSONDocument(bytes.NewReader(doc))
+	if err != nil {
+		t.Errorf("Error message: %s", err)
+	} else if !bytes.Equal(read, doc) {
+		t.Errorf("unexpected document: %v", read)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// OverlapPolicy decides what happens to a synchronization of a target
+// database which is already being synchronized.
+type OverlapPolicy string
+
+const (
+	// PolicyQueue runs the newer synchronization after all earlier ones
+	PolicyQueue OverlapPolicy = "queue"
+	// PolicyCoalesce runs only the newest of the waiting synchronizations
+	// after the running one
+	PolicyCoalesce OverlapPolicy = "coalesce"
+	// PolicyCancel cancels the running and the waiting synchronizations and
+	// runs the newer one
+	PolicyCancel OverlapPolicy = "cancel"
+)
+
+// errCancelled is the error of a synchronization stopped in favor of a newer one.
+var errCancelled = errors.New("synchronization cancelled by a newer event")
+
+// isValid checks if the policy is known.
+func (p OverlapPolicy) isValid() bool {
+	return p == PolicyQueue || p == PolicyCoalesce || p == PolicyCancel
+}
+
+// syncTask is a synchronization waiting for or running on a worker.
+type syncTask struct {
+	jobID  string
+	target string
+	policy OverlapPolicy
+	// run executes the synchronization, ctx is cancelled if a newer task
+	// or a cancel request cancels this one
+	run func(ctx context.Context)
+	// drop is called instead of run if the task is removed from the queue
+	// or cancelled before it started, err is the reason
+	drop func(err error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	cause  *cancelCause
+}
+
+// scheduler runs synchronization tasks on a fixed number of workers. Tasks
+// of the same target database never run at the same time.
+type scheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	ready   []*syncTask
+	running map[string]*syncTask
+	waiting map[string][]*syncTask
+	policy  OverlapPolicy
+	// closed is set by shutdown, active counts the tasks being run
+	closed bool
+	active sync.WaitGroup
+}
+
+var syncScheduler = newScheduler(PolicyQueue)
+
+// newScheduler returns a scheduler using policy for tasks without one.
+func newScheduler(policy OverlapPolicy) *scheduler {
+	s := &scheduler{
+		running: map[string]*syncTask{},
+		waiting: map[string][]*syncTask{},
+		policy:  policy,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// start starts the given number of workers.
+func (s *scheduler) start(workers int) error {
+	if workers < 1 {
+		return fmt.Errorf("invalid number of workers: %d", workers)
+	}
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return nil
+}
+
+// submit adds a task. If its target is free the task is ready to run,
+// otherwise the policy of the task decides how it is queued. After the
+// shutdown of the scheduler, the task is dropped with errShutdown.
+func (s *scheduler) submit(task *syncTask) {
+	task.cause = &cancelCause{}
+	task.ctx, task.cancel = context.WithCancel(context.WithValue(context.Background(), causeKey{}, task.cause))
+	if task.policy == "" {
+		task.policy = s.policy
+	}
+
+	dropped := []*syncTask{}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		task.cause.set(errShutdown)
+		task.cancel()
+		task.drop(errShutdown)
+		return
+	}
+	if _, busy := s.running[task.target]; !busy {
+		s.running[task.target] = task
+		s.ready = append(s.ready, task)
+		s.cond.Signal()
+	} else {
+		switch task.policy {
+		case PolicyCoalesce:
+			dropped = s.waiting[task.target]
+			s.waiting[task.target] = []*syncTask{task}
+		case PolicyCancel:
+			dropped = s.waiting[task.target]
+			s.waiting[task.target] = []*syncTask{task}
+			s.running[task.target].cancel()
+		default:
+			s.waiting[task.target] = append(s.waiting[task.target], task)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, t := range dropped {
+		t.cancel()
+		t.drop(errCancelled)
+	}
+}
+
+// cancel cancels the running or waiting task of a job. A waiting task is
+// removed from the queue and dropped. It returns false if the job has no
+// task.
+func (s *scheduler) cancel(jobID string) bool {
+	s.mu.Lock()
+	for _, task := range s.running {
+		if task.jobID == jobID {
+			task.cause.set(errCancelRequested)
+			task.cancel()
+			s.mu.Unlock()
+			return true
+		}
+	}
+	for target, waiting := range s.waiting {
+		for i, task := range waiting {
+			if task.jobID != jobID {
+				continue
+			}
+			rest := append(waiting[:i:i], waiting[i+1:]...)
+			if len(rest) == 0 {
+				delete(s.waiting, target)
+			} else {
+				s.waiting[target] = rest
+			}
+			s.mu.Unlock()
+
+			task.cause.set(errCancelRequested)
+			task.cancel()
+			task.drop(errCancelRequested)
+			return true
+		}
+	}
+	s.mu.Unlock()
+	return false
+}
+
+// work runs ready tasks until the process ends.
+func (s *scheduler) work() {
+	for {
+		s.mu.Lock()
+		for len(s.ready) == 0 {
+			s.cond.Wait()
+		}
+		task := s.ready[0]
+		s.ready = s.ready[1:]
+		s.active.Add(1)
+		s.mu.Unlock()
+
+		// a task cancelled before it started is not run
+		if task.ctx.Err() != nil {
+			task.drop(cancelled(task.ctx))
+		} else {
+			task.run(task.ctx)
+		}
+		task.cancel()
+		s.done(task)
+		s.active.Done()
+	}
+}
+
+// done releases the target of a finished task and makes the next waiting
+// task of this target ready.
+func (s *scheduler) done(task *syncTask) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.running, task.target)
+	waiting := s.waiting[task.target]
+	if len(waiting) == 0 {
+		delete(s.waiting, task.target)
+		return
+	}
+	next := waiting[0]
+	if len(waiting) == 1 {
+		delete(s.waiting, task.target)
+	} else {
+		s.waiting[task.target] = waiting[1:]
+	}
+	s.running[task.target] = next
+	s.ready = append(s.ready, next)
+	s.cond.Signal()
+}
+
+// isClosed returns true if the scheduler is shut down.
+func (s *scheduler) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// shutdown stops the scheduler. The tasks which have not started yet are
+// dropped with errShutdown and the running tasks may finish until ctx is
+// done. Then they are cancelled with errShutdown. shutdown returns when all
+// running tasks have returned.
+func (s *scheduler) shutdown(ctx context.Context) {
+	s.mu.Lock()
+	s.closed = true
+	dropped := s.ready
+	s.ready = nil
+	for _, task := range dropped {
+		delete(s.running, task.target)
+	}
+	for target, waiting := range s.waiting {
+		dropped = append(dropped, waiting...)
+		delete(s.waiting, target)
+	}
+	s.mu.Unlock()
+
+	for _, task := range dropped {
+		task.cause.set(errShutdown)
+		task.cancel()
+		task.drop(errShutdown)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	for _, task := range s.running {
+		task.cause.set(errShutdown)
+		task.cancel()
+	}
+	s.mu.Unlock()
+	<-finished
+}
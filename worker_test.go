@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// taskRecorder creates tasks which block until they are released and
+// records the order in which they run or are dropped.
+type taskRecorder struct {
+	mu      sync.Mutex
+	started []string
+	dropped []string
+	release chan struct{}
+	done    sync.WaitGroup
+}
+
+func newTaskRecorder() *taskRecorder {
+	return &taskRecorder{release: make(chan struct{})}
+}
+
+func (r *taskRecorder) task(id string, target string, policy OverlapPolicy) *syncTask {
+	r.done.Add(1)
+	return &syncTask{
+		jobID:  id,
+		target: target,
+		policy: policy,
+		run: func(ctx context.Context) {
+			r.mu.Lock()
+			r.started = append(r.started, id)
+			r.mu.Unlock()
+			select {
+			case <-r.release:
+			case <-ctx.Done():
+			}
+			r.done.Done()
+		},
+		drop: func(err error) {
+			r.mu.Lock()
+			r.dropped = append(r.dropped, id)
+			r.mu.Unlock()
+			r.done.Done()
+		},
+	}
+}
+
+// waitStarted waits until n tasks are running.
+func (r *taskRecorder) waitStarted(t *testing.T, n int) {
+	for i := 0; i < 100; i++ {
+		r.mu.Lock()
+		started := len(r.started)
+		r.mu.Unlock()
+		if started >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d started tasks", n)
+}
+
+// TestSchedulerQueue runs tasks of the same target one after another and
+// tasks of different targets in parallel.
+func TestSchedulerQueue(t *testing.T) {
+	fmt.Println("\n>> TestSchedulerQueue()")
+
+	s := newScheduler(PolicyQueue)
+	s.start(2)
+	r := newTaskRecorder()
+
+	s.submit(r.task("1", "carts", ""))
+	s.submit(r.task("2", "carts", ""))
+	s.submit(r.task("3", "orders", ""))
+	r.waitStarted(t, 2)
+
+	r.mu.Lock()
+	if r.started[0] == "2" || r.started[1] == "2" {
+		t.Errorf("task 2 started while task 1 of the same target was running: %v", r.started)
+	}
+	r.mu.Unlock()
+
+	close(r.release)
+	r.done.Wait()
+	if len(r.started) != 3 || len(r.dropped) != 0 {
+		t.Errorf("unexpected tasks, started: %v, dropped: %v", r.started, r.dropped)
+	}
+}
+
+// TestSchedulerCoalesce runs only the newest of the waiting tasks.
+func TestSchedulerCoalesce(t *testing.T) {
+	fmt.Println("\n>> TestSchedulerCoalesce()")
+
+	s := newScheduler(PolicyCoalesce)
+	s.start(1)
+	r := newTaskRecorder()
+
+	s.submit(r.task("1", "carts", ""))
+	r.waitStarted(t, 1)
+	s.submit(r.task("2", "carts", ""))
+	s.submit(r.task("3", "carts", ""))
+
+	close(r.release)
+	r.done.Wait()
+	if fmt.Sprint(r.started) != "[1 3]" || fmt.Sprint(r.dropped) != "[2]" {
+		t.Errorf("unexpected tasks, started: %v, dropped: %v", r.started, r.dropped)
+	}
+}
+
+// TestSchedulerCancel cancels the running task in favor of the newer one.
+func TestSchedulerCancel(t *testing.T) {
+	fmt.Println("\n>> TestSchedulerCancel()")
+
+	s := newScheduler(PolicyQueue)
+	s.start(1)
+	r := newTaskRecorder()
+
+	s.submit(r.task("1", "carts", ""))
+	r.waitStarted(t, 1)
+	s.submit(r.task("2", "carts", PolicyCancel))
+	r.waitStarted(t, 2)
+
+	close(r.release)
+	r.done.Wait()
+	if fmt.Sprint(r.started) != "[1 2]" || len(r.dropped) != 0 {
+		t.Errorf("unexpected tasks, started: %v, dropped: %v", r.started, r.dropped)
+	}
+}
+
+// TestSchedulerCancelJob cancels a running and a waiting task on request.
+func TestSchedulerCancelJob(t *testing.T) {
+	fmt.Println("\n>> TestSchedulerCancelJob()")
+
+	s := newScheduler(PolicyQueue)
+	s.start(1)
+	r := newTaskRecorder()
+
+	var mu sync.Mutex
+	causes := map[string]error{}
+	running := r.task("1", "carts", "")
+	run := running.run
+	running.run = func(ctx context.Context) {
+		run(ctx)
+		mu.Lock()
+		causes["1"] = cancelled(ctx)
+		mu.Unlock()
+	}
+	waiting := r.task("2", "carts", "")
+	drop := waiting.drop
+	waiting.drop = func(err error) {
+		mu.Lock()
+		causes["2"] = err
+		mu.Unlock()
+		drop(err)
+	}
+
+	s.submit(running)
+	r.waitStarted(t, 1)
+	s.submit(waiting)
+	if !s.cancel("2") || !s.cancel("1") {
+		t.Fatalf("expected the tasks to be cancelled")
+	}
+	if s.cancel("3") {
+		t.Errorf("expected an unknown task not to be cancelled")
+	}
+
+	r.done.Wait()
+	if fmt.Sprint(r.started) != "[1]" || fmt.Sprint(r.dropped) != "[2]" {
+		t.Errorf("unexpected tasks, started: %v, dropped: %v", r.started, r.dropped)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if causes["1"] != errCancelRequested || causes["2"] != errCancelRequested {
+		t.Errorf("unexpected causes: %v", causes)
+	}
+}
+
+// TestSchedulerShutdown drops the waiting tasks, lets a running task finish
+// within the grace period and cancels the other one.
+func TestSchedulerShutdown(t *testing.T) {
+	fmt.Println("\n>> TestSchedulerShutdown()")
+
+	s := newScheduler(PolicyQueue)
+	s.start(2)
+	r := newTaskRecorder()
+
+	var mu sync.Mutex
+	causes := map[string]error{}
+	finishing := r.task("1", "carts", "")
+	finishing.run = func(ctx context.Context) {
+		r.mu.Lock()
+		r.started = append(r.started, "1")
+		r.mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		r.done.Done()
+	}
+	blocking := r.task("3", "orders", "")
+	run := blocking.run
+	blocking.run = func(ctx context.Context) {
+		run(ctx)
+		mu.Lock()
+		causes["3"] = cancelled(ctx)
+		mu.Unlock()
+	}
+	waiting := r.task("2", "carts", "")
+	drop := waiting.drop
+	waiting.drop = func(err error) {
+		mu.Lock()
+		causes["2"] = err
+		mu.Unlock()
+		drop(err)
+	}
+
+	s.submit(finishing)
+	s.submit(blocking)
+	r.waitStarted(t, 2)
+	s.submit(waiting)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	s.shutdown(ctx)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected the running task to get the grace period, shutdown took %s", elapsed)
+	}
+	if !s.isClosed() {
+		t.Errorf("expected the scheduler to be closed")
+	}
+
+	s.submit(r.task("4", "carts", ""))
+	r.done.Wait()
+	if fmt.Sprint(r.dropped) != "[2 4]" {
+		t.Errorf("unexpected dropped tasks: %v", r.dropped)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if causes["2"] != errShutdown || causes["3"] != errShutdown {
+		t.Errorf("unexpected causes: %v", causes)
+	}
+}
+
+// TestRunPhase checks the errors of phases which time out or are cancelled.
+func TestRunPhase(t *testing.T) {
+	fmt.Println("\n>> TestRunPhase()")
+
+	wait := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	err := runPhase(context.Background(), "dump", 10*time.Millisecond, wait)
+	if err == nil || err.Error() != "dump exceeded the timeout of 10ms" || !isInterrupted(err) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if err := runPhase(ctx, "restore", time.Minute, wait); err != errCancelled {
+		t.Errorf("unexpected error, expected: %s, found: %v", errCancelled, err)
+	}
+
+	if err := runPhase(context.Background(), "verification", 0, func(ctx context.Context) error { return nil }); err != nil {
+		t.Errorf("Error message: %s", err)
+	}
+}